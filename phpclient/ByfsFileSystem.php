@@ -9,20 +9,24 @@ class ByfsFileSystem
 	static private $port;
 	static private $timeout;
 	static private $auth;
+	//递归删除的授权(服务器-rmall-auth)
+	static private $rmall_auth;
 
 	static private $stream;
 
-	static public function init($server, $port, $timeout, $auth)
+	static public function init($server, $port, $timeout, $auth, $rmall_auth='')
 	{
 		self::$server = $server;
 		self::$port = $port;
 		self::$timeout = $timeout;
 		self::$auth = $auth;
+		self::$rmall_auth = $rmall_auth;
 	}
 
 	static public function connect()
 	{
-		if (!self::$stream) {
+		//服务器关闭过的连接重新连, 升级或重启时不会失败
+		if (!self::$stream || self::$stream->idleClosed()) {
 			self::$stream = new ByfsStream();
 			$ok = self::$stream->connect(self::$server, self::$port, self::$timeout, self::$auth);
 			if (!$ok) {
@@ -38,105 +42,254 @@ class ByfsFileSystem
 		self::$stream = null;
 	}
 
+	//服务器要关闭时收到CODE_SERVER_CLOSE, 指令没有执行, 换个连接再发一次
+	static private function call($fn)
+	{
+		$stream = self::connect();
+		$ret = call_user_func($fn, $stream);
+
+		if ($ret === false && $stream->errno == ByfsStream::CODE_SERVER_CLOSE) {
+			$ret = call_user_func($fn, self::connect());
+		}
+
+		return $ret;
+	}
+
+    //$options['expires'] 设置过期时间(unix秒)
     static public function fopen($path, $mode, $options=null, $opened_path=null)
     {
-		$stream = self::connect();
+		$expires = null;
+		if (is_array($options) && isset($options['expires'])) {
+			$expires = (int)$options['expires'];
+		}
 
-		$file = new ByfsStreamFile($stream);
-		$ok = $file->open($path, $mode);
+		return self::call(function ($stream) use ($path, $mode, $expires) {
+			$file = new ByfsStreamFile($stream);
+			$ok = $file->open($path, $mode, $expires);
 
-		return $ok ? $file : false;
+			return $ok ? $file : false;
+		});
     }
 
 	static public function opendir($path)
 	{
-		$stream = self::connect();
-
-		$file = new ByfsStreamDir($stream);
-		$ok = $file->open($path);
+		return self::call(function ($stream) use ($path) {
+			$file = new ByfsStreamDir($stream);
+			$ok = $file->open($path);
 
-		return $ok ? $file : false;
+			return $ok ? $file : false;
+		});
 	}
 
 	static public function mkdir($path, $mode = 0777, $recursive=false)
 	{
-		$stream = self::connect();
-
-		$stream->write_uint16(ByfsStream::CODE_MKDIR);
-		$stream->write_string($path);
-		$stream->write_uInt8($recursive ? 1 : 0);
+		return self::call(function ($stream) use ($path, $recursive) {
+			$stream->write_uint16(ByfsStream::CODE_MKDIR);
+			$stream->write_string($path);
+			$stream->write_uInt8($recursive ? 1 : 0);
 
-		return $stream->read_bool();
+			return $stream->read_bool();
+		});
 	}
 
 	static public function rename($from, $to)
 	{
-		$stream = self::connect();
+		return self::call(function ($stream) use ($from, $to) {
+			$stream->write_uint16(ByfsStream::CODE_RENAME);
+			$stream->write_string($from);
+			$stream->write_string($to);
+
+			return $stream->read_bool();
+		});
+	}
 
-		$stream->write_uint16(ByfsStream::CODE_MOVE);
-		$stream->write_string($from);
-		$stream->write_string($to);
+	/**
+	 * 服务器端复制,目录会递归复制
+	 */
+	static public function copy($from, $to)
+	{
+		return self::call(function ($stream) use ($from, $to) {
+			$stream->write_uint16(ByfsStream::CODE_COPY);
+			$stream->write_string($from);
+			$stream->write_string($to);
 
-		return $stream->read_bool();
+			return $stream->read_bool();
+		});
 	}
 
 	static public function rmdir($path, $recursive=false)
 	{
-		$stream = self::connect();
-
-		$stream->write_uint16(ByfsStream::CODE_RMDIR);
-		$stream->write_string($path);
-		$stream->write_uInt8($recursive ? 1 : 0);
+		return self::call(function ($stream) use ($path, $recursive) {
+			if ($recursive) {
+				$stream->write_uint16(ByfsStream::CODE_RMDIR_ALL);
+				$stream->write_string($path);
+				$stream->write_string($stream->_makeToken($path, self::$rmall_auth));
+			} else {
+				$stream->write_uint16(ByfsStream::CODE_RMDIR);
+				$stream->write_string($path);
+				$stream->write_uInt8(0);
+			}
 
-		return $stream->read_bool();
+			return $stream->read_bool();
+		});
 	}
 
 	static public function unlink($path)
 	{
-		$stream = self::connect();
+		return self::call(function ($stream) use ($path) {
+			$stream->write_uint16(ByfsStream::CODE_UNLINK);
+			$stream->write_string($path);
 
-		$stream->write_uint16(ByfsStream::CODE_RMDIR);
-		$stream->write_string($path);
+			return $stream->read_bool();
+		});
+	}
 
-		return $stream->read_bool();
+	/**
+	 * 原子追加一条记录, 多个连接同时追加也不会交错
+	 * 返回记录在文件中的位置
+	 */
+	static public function append($path, $data)
+	{
+		return self::call(function ($stream) use ($path, $data) {
+			$stream->write_uint16(ByfsStream::CODE_FILE_APPEND);
+			$stream->write_string($path);
+			//空字符串也会被拆出一段, 那一段就成了结束标记
+			if ($data !== '') {
+				foreach (str_split($data, 4096) as $tmp) {
+					$stream->write_string($tmp);
+				}
+			}
+			$stream->write_uint16(0);
+
+			$ok = $stream->read_bool();
+			if (!$ok) {
+				return false;
+			}
+
+			return $stream->read_int64();
+		});
 	}
 
-	static public function stat($path)
+	/**
+	 * 服务器端计算hash, 支持 sha256 md5 crc32c
+	 * $length < 0 表示到文件结尾
+	 */
+	static public function hash($path, $algo='sha256', $offset=0, $length=-1)
 	{
-		$stream = self::connect();
+		return self::call(function ($stream) use ($path, $algo, $offset, $length) {
+			$stream->write_uint16(ByfsStream::CODE_FILE_HASH);
+			$stream->write_string($path);
+			$stream->write_string($algo);
+			$stream->write_int64($offset);
+			$stream->write_int64($length);
+
+			$ok = $stream->read_bool();
+			if (!$ok) {
+				return false;
+			}
+
+			return $stream->read_string();
+		});
+	}
 
-		$stream->write_uint16(ByfsStream::CODE_STAT);
-		$stream->write_string($path);
+	/**
+	 * 订阅目录变化, 会一直阻塞
+	 * $callback($op, $path, $to) 返回false时结束订阅
+	 * 订阅独占一个连接, 不影响其它操作
+	 */
+	static public function watch($prefix, $callback)
+	{
+		$stream = new ByfsStream();
+		$ok = $stream->connect(self::$server, self::$port, self::$timeout, self::$auth);
+		if (!$ok) {
+			throw new Exception('byfs connect error');
+		}
+
+		$stream->write_uint16(ByfsStream::CODE_WATCH);
+		$stream->write_string($prefix);
 
 		$ok = $stream->read_bool();
 		if (!$ok) {
 			return false;
 		}
 
-		$is_dir = $stream->read_uint8();
-		$size = $stream->read_int64();
-		$modTime = $stream->read_int64();
+		while (true) {
+			$code = $stream->read_uint16();
+
+			if ($code == ByfsStream::CODE_WATCH_PING) {
+				continue;
+			}
+
+			//服务器关闭, 调用方重新订阅
+			if ($code == ByfsStream::CODE_SERVER_CLOSE) {
+				$stream->serverClosed();
+				return false;
+			}
+
+			if ($code != ByfsStream::CODE_WATCH_EVENT) {
+				throw new Exception("watch code err");
+			}
+
+			$op = $stream->read_string();
+			$path = $stream->read_string();
+			$to = $stream->read_string();
+
+			if (call_user_func($callback, $op, $path, $to) === false) {
+				break;
+			}
+		}
+
+		$stream->write_uint16(ByfsStream::CODE_WATCH_STOP);
+
+		//结束前还没读完的事件丢掉
+		do {
+			$code = $stream->read_uint16();
+			if ($code == ByfsStream::CODE_WATCH_EVENT) {
+				$stream->read_string();
+				$stream->read_string();
+				$stream->read_string();
+			}
+		} while ($code != ByfsStream::CODE_WATCH_STOP);
+
+		return true;
+	}
+
+	static public function stat($path)
+	{
+		return self::call(function ($stream) use ($path) {
+			$stream->write_uint16(ByfsStream::CODE_STAT);
+			$stream->write_string($path);
+
+			$ok = $stream->read_bool();
+			if (!$ok) {
+				return false;
+			}
+
+			$is_dir = $stream->read_uint8();
+			$size = $stream->read_int64();
+			$modTime = $stream->read_int64();
 
-		return self::_buildStat($is_dir, $size, $modTime);
+			return self::_buildStat($is_dir, $size, $modTime);
+		});
 	}
 
 	static public function lstat($path)
 	{
-		$stream = self::connect();
-
-		$stream->write_uint16(ByfsStream::CODE_LSTAT);
-		$stream->write_string($path);
+		return self::call(function ($stream) use ($path) {
+			$stream->write_uint16(ByfsStream::CODE_LSTAT);
+			$stream->write_string($path);
 
-		$ok = $stream->read_bool();
-		if (!$ok) {
-			return false;
-		}
+			$ok = $stream->read_bool();
+			if (!$ok) {
+				return false;
+			}
 
-		$is_dir = $stream->read_uint8();
-		$size = $stream->read_int64();
-		$modTime = $stream->read_int64();
+			$is_dir = $stream->read_uint8();
+			$size = $stream->read_int64();
+			$modTime = $stream->read_int64();
 
-		return self::_buildStat($is_dir, $size, $modTime);
+			return self::_buildStat($is_dir, $size, $modTime);
+		});
 	}
 
 	public static function _buildStat($is_dir, $size, $modTime)
@@ -79,6 +79,49 @@ class Byfs
 		return false;
 	}
 
+	/**
+	 * 服务器端复制远程文件(目录递归复制)
+	 */
+	static public function copy($from, $to)
+	{
+		$to = self::_parseFile($to);
+		if (!$to) { return false; }
+
+		$headers = array("Destination: /{$to}");
+		if (self::$auth) {
+			//目标路径也要签名
+			$headers[] = 'Byfs-Dest-' . self::_makeToken($to);
+		}
+
+		$fp = self::_open($from, 'COPY', $headers);
+		if (!$fp) { return false; }
+
+		$ok = stream_get_contents($fp, 4096);
+		fclose($fp);
+
+		if ($ok == 'Success') {
+			return true;
+		}
+
+		trigger_error("COPY {$from} Fail {$ok}");
+
+		return false;
+	}
+
+	/**
+	 * 取远程文件的hash(服务器端计算)
+	 */
+	static public function hash($path, $algo='sha256')
+	{
+		$fp = self::_open($path.'?hash='.$algo, 'GET');
+		if (!$fp) { return false; }
+
+		$sum = stream_get_contents($fp, 4096);
+		fclose($fp);
+
+		return $sum;
+	}
+
 	/**
 	 * 测试一个文件是否存在
 	 */
@@ -124,15 +167,14 @@ class Byfs
 	/**
 	 * 打开连接
 	 */
-	static private function _open($file, $method)
+	static private function _open($file, $method, $headers=array())
 	{
 		$file = self::_parseFile($file);
 		if (!$file) { return false; }
 
-		$headers = array();
 		$headers[] = "Byfs-Version: 1";
 		$headers[] = "Connection: close";
-		if ($method == 'DELETE') {
+		if ($method == 'DELETE' || $method == 'COPY') {
 			if (self::$auth) {
 				$headers[] = self::_makeToken($file);
 			}
@@ -170,17 +212,24 @@ class Byfs
 	/**
 	 * 上传文件
 	 */
-	static private function _put($src, $file)
+	static private function _put($src, $file, $server=null, $port=null, $redirects=0)
 	{
 		$file = self::_parseFile($file);
 		if (!$file) { return false; }
 
+		if ($server === null) {
+			$server = self::$server;
+			$port = self::$port;
+		}
+
 		$req = array();
 		$req[] = "PUT /{$file} HTTP/1.1";
 		$req[] = "Connection: close";
 		$req[] = "Byfs-Version: 1";
 		$req[] = "Transfer-Encoding: chunked";
 		$req[] = "Content-Type: application/octet-stream";
+		//集群模式下不归这台服务器的文件会先返回重定向
+		$req[] = "Expect: 100-continue";
 		if (self::$auth) {
 			$req[] = self::_makeToken($file);
 		}
@@ -188,13 +237,36 @@ class Byfs
 		$req[] = "\r\n";
 		$req = implode("\r\n", $req);
 
-		$dst = fsockopen(self::$server, self::$port, $errno, $error, self::$timeout);
+		$dst = fsockopen($server, $port, $errno, $error, self::$timeout);
 		if (!$dst) { return false; }
 
 		//请求头
 		$ok = self::_write($dst, $req, false);
 		if ($ok == false) { return false; }
 
+		$head = self::_readHead($dst);
+		if (!$head) {
+			fclose($dst);
+			return false;
+		}
+
+		if (strpos($head[0], ' 100 ') === false) {
+			fclose($dst);
+
+			$location = self::_location($head);
+			if (!$location || $redirects >= 3) {
+				trigger_error("PUT {$file} Fail {$head[0]}");
+				return false;
+			}
+
+			if (is_resource($src) && !rewind($src)) {
+				return false;
+			}
+
+			$url = parse_url($location);
+			return self::_put($src, 'byfs:/'.$url['path'], $url['host'], $url['port'], $redirects+1);
+		}
+
 		if (is_resource($src)) {
 			while (!feof($src)) {
 				$data = fread($src, 2048);
@@ -233,6 +305,34 @@ class Byfs
 		return false;
 	}
 
+	static private function _readHead($fp)
+	{
+		$head = array();
+		while (($buf = fgets($fp, 2048)) !== false) {
+			if ($buf == "\r\n") {
+				break;
+			}
+			$head[] = rtrim($buf);
+		}
+
+		return $head;
+	}
+
+	static private function _location($head)
+	{
+		if (!preg_match('#^HTTP/1\.[01] 30[78] #', $head[0])) {
+			return false;
+		}
+
+		foreach ($head as $tmp) {
+			if (stripos($tmp, 'Location:') === 0) {
+				return trim(substr($tmp, strlen('Location:')));
+			}
+		}
+
+		return false;
+	}
+
 	static private function _write($fp, $data, $encode=true)
 	{
 		if ($encode) {
@@ -7,6 +7,8 @@ class ByfsStream
 {
 	const CODE_AUTH = 0xee01;
 	const CODE_CLOSE = 0xee02;
+	//服务器要关闭, 在状态字节的位置收到, 指令没有执行, 需要重连
+	const CODE_SERVER_CLOSE = 0xee03;
 
 	const CODE_FILE_OPEN = 0xff01;
 	const CODE_FILE_READ = 0xff02;
@@ -16,6 +18,8 @@ class ByfsStream
 	const CODE_FILE_FLUSH = 0xff06;
 	const CODE_FILE_TRUNCATE = 0xff07;
 	const CODE_FILE_CLOSE = 0xff08;
+	const CODE_FILE_HASH = 0xff09;
+	const CODE_FILE_APPEND = 0xff0a;
 
 	const CODE_DIR_OPEN = 0xfe01;
 	const CODE_DIR_READ = 0xfe02;
@@ -23,9 +27,17 @@ class ByfsStream
 
 	const CODE_MKDIR = 0xfc01;
 	const CODE_RMDIR = 0xfc02;
-	const CODE_COPY = 0xfc03;
+	const CODE_RENAME = 0xfc03;
 	const CODE_STAT = 0xfc04;
 	const CODE_LSTAT = 0xfc05;
+	const CODE_COPY = 0xfc06;
+	const CODE_UNLINK = 0xfc07;
+	const CODE_RMDIR_ALL = 0xfc08;
+
+	const CODE_WATCH = 0xfd01;
+	const CODE_WATCH_EVENT = 0xfd02;
+	const CODE_WATCH_PING = 0xfd03;
+	const CODE_WATCH_STOP = 0xfd04;
 
 	const O_RDONLY = 0x0;
 	const O_WRONLY = 0x1;
@@ -35,6 +47,8 @@ class ByfsStream
 	const O_EXCL = 0x80;
 	const O_SYNC = 0x101000;
 	const O_TRUNC = 0x200;
+	//后面跟int64的过期时间(unix秒)
+	const O_EXPIRES = 0x40000000;
 
 	public $fp;
 	public $errno;
@@ -113,7 +127,7 @@ class ByfsStream
 		return true;
 	}
 
-	private function _makeToken($file, $auth)
+	public function _makeToken($file, $auth)
 	{
 		$salt = dechex(mt_rand(0, 100000000));
 		return md5($auth . $file . $salt) . $salt;
@@ -143,11 +157,43 @@ class ByfsStream
 			$this->errno = $num;
 			$this->error = $this->read_string();
 			return false;
+		} else if ($num == (self::CODE_SERVER_CLOSE >> 8) && $this->read_uint8() == (self::CODE_SERVER_CLOSE & 0xff)) {
+			$this->serverClosed();
+			return false;
 		}
 
 		throw new Exception("bool val err");
 	}
 
+	//服务器已经不再读这个连接, 不用再发CODE_CLOSE
+	public function serverClosed()
+	{
+		$this->errno = self::CODE_SERVER_CLOSE;
+		$this->error = 'Server Closing';
+		if ($this->fp) {
+			fclose($this->fp);
+			$this->fp = null;
+		}
+	}
+
+	//空闲时能读到数据只会是CODE_SERVER_CLOSE或者连接已断开, 这个连接不能再用
+	public function idleClosed()
+	{
+		if (!$this->fp) {
+			return true;
+		}
+
+		$r = array($this->fp);
+		$w = null;
+		$e = null;
+		if (stream_select($r, $w, $e, 0) > 0) {
+			$this->serverClosed();
+			return true;
+		}
+
+		return false;
+	}
+
 	public function read_array_string()
 	{
 		$arr = array();
@@ -15,7 +15,8 @@ class ByfsStreamFile
 		$this->stream = $stream;
 	}
 
-    public function open($path, $mode)
+    //$expires 过期时间(unix秒), 0取消过期, null不修改
+    public function open($path, $mode, $expires=null)
     {
 		$mode = strtolower(trim(trim($mode), 'b'));
 
@@ -55,9 +56,16 @@ class ByfsStreamFile
 			throw new Exception("未识别的文件打开模式:{$mode}");
 		}
 
+		if ($expires !== null) {
+			$flag |= ByfsStream::O_EXPIRES;
+		}
+
 		$this->stream->write_uint16(ByfsStream::CODE_FILE_OPEN);
 		$this->stream->write_string($path);
 		$this->stream->write_int32($flag);
+		if ($expires !== null) {
+			$this->stream->write_int64($expires);
+		}
 
 		$ok = $this->stream->read_bool();
 		if (!$ok) {
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"sync"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"encoding/json"
+)
+
+//访问日志,审计用,和运行日志分开
+//HTTP请求和流协议的每个指令各一行,格式是Combined Log Format或JSON
+//Combined后面多三列: 请求或连接ID、耗时毫秒、改名和复制的目标(没有时是-)
+//流指令的请求行是 "FOPEN /path BYFS-STREAM",状态 ok=200 notice=400 warning=500 fatal=400
+//用户一列是访问密钥,没带时是-
+//超过大小时切割,file -> file.1 -> file.2 ...
+
+var accessLogFile = flag.String("access-log", "", "Access Log File (disabled if empty)")
+var accessLogFormat = flag.String("access-log-format", "combined", "Access Log Format (combined|json)")
+var accessLogMaxSize = flag.String("access-log-max-size", "100M", "Rotate Access Log At Size (never if 0)")
+var accessLogBackups = flag.Int("access-log-backups", 10, "Rotated Access Logs To Keep")
+
+//参数在SIGHUP时会变,用这里的副本
+var accessLog struct {
+	mu sync.Mutex
+	fp *os.File
+	path string
+	json bool
+	size int64
+	maxSize int64
+	backups int
+}
+
+type accessEntry struct {
+	Time time.Time `json:"time"`
+	//http或stream
+	Proto string `json:"proto"`
+	ID string `json:"id"`
+	Remote string `json:"remote"`
+	Key string `json:"key,omitempty"`
+	Method string `json:"method"`
+	Path string `json:"path"`
+	//改名和复制的目标
+	To string `json:"to,omitempty"`
+	Status string `json:"status"`
+	BytesIn int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	Duration float64 `json:"duration_ms"`
+	Referer string `json:"referer,omitempty"`
+	Agent string `json:"agent,omitempty"`
+	//请求行里的协议版本
+	version string
+}
+
+func initAccessLog() {
+	err := reopenAccessLog()
+	if err != nil {
+		logExit("access log error", "err", err)
+	}
+}
+
+func checkAccessLog() error {
+	if *accessLogFormat != "combined" && *accessLogFormat != "json" {
+		return errors.New("access-log-format must be combined or json")
+	}
+	if *accessLogBackups < 0 {
+		return errors.New("access-log-backups must not be negative")
+	}
+	_, err := parseSize(*accessLogMaxSize)
+	return err
+}
+
+//SIGHUP时重新打开,外部切割过的也能接上
+func reopenAccessLog() error {
+	maxSize, err := parseSize(*accessLogMaxSize)
+	if err != nil {
+		return err
+	}
+
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+
+	if accessLog.fp != nil {
+		accessLog.fp.Close()
+		accessLog.fp = nil
+	}
+
+	accessLog.path = *accessLogFile
+	accessLog.json = *accessLogFormat == "json"
+	accessLog.maxSize = maxSize
+	accessLog.backups = *accessLogBackups
+
+	if accessLog.path == "" {
+		return nil
+	}
+	return openAccessLog()
+}
+
+func openAccessLog() error {
+	fp, err := os.OpenFile(accessLog.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	accessLog.fp = fp
+	accessLog.size = 0
+	if fi, err := fp.Stat(); err == nil {
+		accessLog.size = fi.Size()
+	}
+	return nil
+}
+
+//拿着锁调用
+func rotateAccessLog() {
+	accessLog.fp.Close()
+	accessLog.fp = nil
+
+	name := accessLog.path
+	n := accessLog.backups
+	if n > 0 {
+		os.Remove(name + "." + strconv.Itoa(n))
+		for i := n - 1; i > 0; i-- {
+			os.Rename(name + "." + strconv.Itoa(i), name + "." + strconv.Itoa(i + 1))
+		}
+		os.Rename(name, name + ".1")
+	} else {
+		os.Remove(name)
+	}
+
+	err := openAccessLog()
+	if err != nil {
+		logWarning("Access Log Rotate Error", "err", err)
+	}
+}
+
+func writeAccess(e *accessEntry) {
+	accessLog.mu.Lock()
+	defer accessLog.mu.Unlock()
+
+	if accessLog.fp == nil {
+		return
+	}
+
+	var line []byte
+	if accessLog.json {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.combined())
+	}
+
+	if accessLog.maxSize > 0 && accessLog.size > 0 && accessLog.size + int64(len(line)) > accessLog.maxSize {
+		rotateAccessLog()
+		if accessLog.fp == nil {
+			return
+		}
+	}
+
+	n, err := accessLog.fp.Write(line)
+	accessLog.size += int64(n)
+	if err != nil {
+		logWarning("Access Log Write Error", "err", err)
+	}
+}
+
+func (e *accessEntry) combined() string {
+	host := e.Remote
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = host[:i]
+	}
+
+	status := e.Status
+	if e.Proto == "stream" {
+		status = streamStatusCodes[e.Status]
+	}
+
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %s %d \"%s\" \"%s\" %s %.3f \"%s\"\n",
+		host, dash(e.Key), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, quoteCLF(e.Path), e.version, status, e.BytesOut,
+		quoteCLF(dash(e.Referer)), quoteCLF(dash(e.Agent)), e.ID, e.Duration, quoteCLF(dash(e.To)))
+}
+
+var streamStatusCodes = map[string]string{
+	"ok": "200",
+	"notice": "400",
+	"warning": "500",
+	"fatal": "400",
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+//路径和UA是客户端给的,不能让它拆开一行
+func quoteCLF(s string) string {
+	s = strconv.Quote(s)
+	return s[1:len(s)-1]
+}
+
+func accessHTTP(r *http.Request, id, uri string, status int, in, out int64, d time.Duration) {
+	var to string
+	if r.Method == "COPY" || r.Method == "MOVE" {
+		to = destination(r)
+	}
+
+	writeAccess(&accessEntry{
+		Time: time.Now(),
+		Proto: "http",
+		ID: id,
+		Remote: r.RemoteAddr,
+		Key: r.Header.Get(keyHeader),
+		Method: r.Method,
+		Path: uri,
+		To: to,
+		Status: strconv.Itoa(status),
+		BytesIn: in,
+		BytesOut: out,
+		Duration: ms(d),
+		Referer: r.Referer(),
+		Agent: r.UserAgent(),
+		version: r.Proto,
+	})
+}
+
+func (f *fconn) accessOp(code uint16, status string, in, out int64, d time.Duration) {
+	path, to := f.opPath, f.opTo
+	if f.vol != nil {
+		path = "/" + f.vol.name + path
+		if to != "" {
+			to = "/" + f.vol.name + to
+		}
+	}
+
+	writeAccess(&accessEntry{
+		Time: time.Now(),
+		Proto: "stream",
+		ID: f.id,
+		Remote: f.conn.RemoteAddr().String(),
+		Key: f.key,
+		Method: strings.ToUpper(codeName(code)),
+		Path: path,
+		To: to,
+		Status: status,
+		BytesIn: in,
+		BytesOut: out,
+		Duration: ms(d),
+		version: "BYFS-STREAM",
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"time"
+	"net/http"
+	"encoding/json"
+)
+
+//管理接口单独监听,不要对外开放
+func adminServer(ln net.Listener) {
+	if ln == nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cluster", adminAuth(adminCluster))
+	mux.HandleFunc("/members", adminAuth(adminMembers))
+	mux.HandleFunc("/rebalance", adminAuth(adminRebalance))
+	mux.HandleFunc("/dedup", adminAuth(adminDedup))
+	mux.HandleFunc("/trash", adminAuth(adminTrash))
+	mux.HandleFunc("/quota", adminAuth(adminQuota))
+	mux.HandleFunc("/mode", adminAuth(adminMode))
+	mux.HandleFunc("/metrics", adminAuth(adminMetrics))
+
+	s := http.Server{
+		Addr: *adminAddr,
+		Handler: mux,
+		ReadTimeout: time.Second * 30,
+		WriteTimeout: time.Second * 30,
+		MaxHeaderBytes: 1024 * 8,
+	}
+
+	trackServer(&s)
+
+	err := s.Serve(ln)
+	if err != http.ErrServerClosed {
+		logExit("admin server error", "err", err)
+	}
+}
+
+//修改类的请求和文件写入一样需要认证
+func adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" || r.Method == "HEAD" {
+			handler(w, r)
+			return
+		}
+
+		authHander(w, r, handler)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
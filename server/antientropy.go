@@ -0,0 +1,706 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"net/url"
+	"net/http"
+	"hash/crc32"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+)
+
+//后台和其它节点对比Merkle树,从对方拉取比本地新的文件
+//每个节点都只拉不推,所有节点都跑一遍后就一致了
+
+//16叉,3层,叶子是4096个桶
+const aeFanout = 16
+const aeDepth = 3
+const aeBuckets = 4096
+
+//一次请求最多要多少个桶的文件列表
+const aeBatch = 64
+
+const merklePath = "/" + sysDirName + "/merkle"
+
+//对方请求过来的树保留多久,一次对比要请求好几次
+var aeTreeTTL = 5 * time.Minute
+
+//对方在后台建树,最多等这么久
+var aeBuildWait = 10 * time.Minute
+
+var aeClient = &http.Client{Timeout: 300 * time.Second}
+
+//扫描计算hash和拉取文件共用的限速
+var aeLimit *rateLimiter
+
+//树里的一个文件或墓碑
+type aeEntry struct {
+	Path string `json:"path"`
+	Size int64 `json:"size"`
+	Mtime int64 `json:"mtime"`
+	Hash string `json:"hash,omitempty"`
+	Version versionVector `json:"version,omitempty"`
+	VersionTime int64 `json:"vtime,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func (e *aeEntry) key() string {
+	if e.Deleted {
+		return e.Path + "\x00deleted\n"
+	}
+	return fmt.Sprintf("%s\x00%d\x00%d\x00%s\n", e.Path, e.Size, e.Mtime, e.Hash)
+}
+
+type merkleTree struct {
+	//levels[0] 是根
+	levels [][][]byte
+	buckets [][]*aeEntry
+	built time.Time
+}
+
+func aeBucket(p string) int {
+	return int(crc32.ChecksumIEEE([]byte(p)) % aeBuckets)
+}
+
+func buildTree(entries []*aeEntry) *merkleTree {
+	t := &merkleTree{
+		levels: make([][][]byte, aeDepth + 1),
+		buckets: make([][]*aeEntry, aeBuckets),
+		built: time.Now(),
+	}
+
+	for _, e := range entries {
+		i := aeBucket(e.Path)
+		t.buckets[i] = append(t.buckets[i], e)
+	}
+
+	leaves := make([][]byte, aeBuckets)
+	for i, list := range t.buckets {
+		sort.Slice(list, func(a, b int) bool { return list[a].Path < list[b].Path })
+
+		h := sha256.New()
+		for _, e := range list {
+			io.WriteString(h, e.key())
+		}
+		leaves[i] = h.Sum(nil)
+	}
+	t.levels[aeDepth] = leaves
+
+	for d := aeDepth - 1; d >= 0; d-- {
+		children := t.levels[d+1]
+		nodes := make([][]byte, len(children) / aeFanout)
+		for i := range nodes {
+			h := sha256.New()
+			for _, c := range children[i*aeFanout : (i+1)*aeFanout] {
+				h.Write(c)
+			}
+			nodes[i] = h.Sum(nil)
+		}
+		t.levels[d] = nodes
+	}
+
+	return t
+}
+
+//集群模式下只比两个节点都存放的路径
+func aeShared(rg *ring, p string, peer string) bool {
+	if rg == nil {
+		return true
+	}
+
+	self, other := false, false
+	for _, n := range rg.Owners(p) {
+		if n.Name == *serverName {
+			self = true
+		} else if n.Name == peer {
+			other = true
+		}
+	}
+
+	return self && other
+}
+
+//扫描本地文件和墓碑
+func aeScan(peer string) ([]*aeEntry, error) {
+	rg := currentRing()
+	sysdir := filepath.Join(fs.rootdir, sysDirName)
+
+	var list []*aeEntry
+
+	err := filepath.Walk(fs.rootdir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if name == sysdir {
+			return filepath.SkipDir
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fs.rootdir, name)
+		if err != nil {
+			return nil
+		}
+		p := "/" + filepath.ToSlash(rel)
+
+		if !aeShared(rg, p, peer) {
+			return nil
+		}
+
+		e, err := aeFileEntry(p, name, fi)
+		if err != nil {
+			logNotice("Anti Entropy Scan Error", "path", p, "err", err)
+			return nil
+		}
+
+		list = append(list, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//只有集群模式才有墓碑
+	if rg == nil {
+		return list, nil
+	}
+
+	err = walkMeta(fs.meta.metadir, func(q, rel string) {
+		if rel == "." {
+			return
+		}
+		p := "/" + filepath.ToSlash(rel)
+
+		if !aeShared(rg, p, peer) {
+			return
+		}
+
+		v := localVersion(p)
+		if v.deleted {
+			list = append(list, &aeEntry{Path: p, Version: v.vv, VersionTime: v.time, Deleted: true})
+		}
+	})
+
+	return list, err
+}
+
+//hash和fs.Hash共用缓存,没缓存时限速计算
+func aeFileEntry(p, name string, fi os.FileInfo) (*aeEntry, error) {
+	e := &aeEntry{Path: p, Size: fi.Size(), Mtime: fi.ModTime().UnixNano()}
+	key := fmt.Sprintf("sha256:0:%d", fi.Size())
+
+	md := fs.meta.Get(name)
+	if md != nil {
+		e.Version, e.VersionTime = md.Version, md.VersionTime
+		if md.Size == e.Size && md.ModTime == e.Mtime {
+			e.Hash = md.Hash[key]
+		}
+	}
+
+	if e.Hash != "" {
+		return e, nil
+	}
+
+	fp, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, aeLimit.Reader(fp))
+	if err != nil {
+		return nil, err
+	}
+	e.Hash = hex.EncodeToString(h.Sum(nil))
+
+	fi2, err := os.Stat(name)
+	if err == nil && fi2.Size() == fi.Size() && fi2.ModTime().Equal(fi.ModTime()) {
+		fs.meta.CacheHash(name, fi, key, e.Hash)
+	}
+
+	return e, nil
+}
+
+func aeBuild(peer string) (*merkleTree, error) {
+	list, err := aeScan(peer)
+	if err != nil {
+		return nil, err
+	}
+	return buildTree(list), nil
+}
+
+// ------ 对方节点 ----------------
+
+type merkleReq struct {
+	From string `json:"from"`
+	//对比开始时要求重新扫描
+	Rebuild bool `json:"rebuild,omitempty"`
+	Level int `json:"level"`
+	Index []int `json:"index,omitempty"`
+	Buckets []int `json:"buckets,omitempty"`
+}
+
+type merkleResp struct {
+	//树还在建,过一会再问
+	Building bool `json:"building,omitempty"`
+	Hashes []string `json:"hashes,omitempty"`
+	Entries []*aeEntry `json:"entries,omitempty"`
+}
+
+var errMerkleNotBuilt = errors.New("merkle tree not built")
+
+//按请求的节点缓存,对比开始时在后台重新扫描
+//扫描和算hash很慢,不能放在请求里,也不能拿着锁做
+var aeTrees struct {
+	mu sync.Mutex
+	trees map[string]*merkleTree
+	building map[string]bool
+}
+
+//返回nil,nil表示还在建
+func aeTreeFor(from string, rebuild bool) (*merkleTree, error) {
+	aeTrees.mu.Lock()
+	defer aeTrees.mu.Unlock()
+
+	if aeTrees.trees == nil {
+		aeTrees.trees = make(map[string]*merkleTree)
+		aeTrees.building = make(map[string]bool)
+	}
+
+	for name, t := range aeTrees.trees {
+		if time.Since(t.built) > aeTreeTTL {
+			delete(aeTrees.trees, name)
+		}
+	}
+
+	if aeTrees.building[from] {
+		return nil, nil
+	}
+
+	if rebuild {
+		delete(aeTrees.trees, from)
+		aeTrees.building[from] = true
+		go aeBuildFor(from)
+		return nil, nil
+	}
+
+	t := aeTrees.trees[from]
+	if t == nil {
+		return nil, errMerkleNotBuilt
+	}
+	return t, nil
+}
+
+func aeBuildFor(from string) {
+	t, err := aeBuild(from)
+	if err != nil {
+		logWarning("Merkle Tree Error", "from", from, "err", err)
+	}
+
+	aeTrees.mu.Lock()
+	delete(aeTrees.building, from)
+	if t != nil {
+		aeTrees.trees[from] = t
+	}
+	aeTrees.mu.Unlock()
+}
+
+func merkleHandler(w http.ResponseWriter, r *http.Request) {
+	req := new(merkleReq)
+	err := json.NewDecoder(io.LimitReader(r.Body, 1 << 20)).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if rg := currentRing(); rg != nil && rg.Node(req.From) == nil {
+		http.Error(w, "Node Not In Cluster", http.StatusBadRequest)
+		return
+	}
+
+	if req.Level < 0 || req.Level > aeDepth {
+		http.Error(w, "Level Error", http.StatusBadRequest)
+		return
+	}
+
+	t, err := aeTreeFor(req.From, req.Rebuild)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	resp := new(merkleResp)
+	if t == nil {
+		resp.Building = true
+		writeJSON(w, resp)
+		return
+	}
+
+	nodes := t.levels[req.Level]
+	for _, i := range req.Index {
+		if i < 0 || i >= len(nodes) {
+			http.Error(w, "Index Error", http.StatusBadRequest)
+			return
+		}
+		resp.Hashes = append(resp.Hashes, hex.EncodeToString(nodes[i]))
+	}
+
+	for _, i := range req.Buckets {
+		if i < 0 || i >= aeBuckets {
+			http.Error(w, "Bucket Error", http.StatusBadRequest)
+			return
+		}
+		resp.Entries = append(resp.Entries, t.buckets[i]...)
+	}
+
+	writeJSON(w, resp)
+}
+
+// ------ 发起对比 ----------------
+
+func initAntiEntropy() {
+	aeLimit = newRateLimiter(*antiEntropyRate)
+
+	if *antiEntropyInterval <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			time.Sleep(*antiEntropyInterval)
+			if !backgroundPaused() {
+				antiEntropy()
+			}
+		}
+	}()
+}
+
+//集群模式和所有活着的节点对比,否则和-peers对比
+func antiEntropy() {
+	rg := currentRing()
+
+	if rg == nil {
+		for _, addr := range staticPeers {
+			aePeer("", addr)
+		}
+		return
+	}
+
+	for _, n := range rg.m.Nodes {
+		if n.Name != *serverName && !memberDead(n.Name) {
+			aePeer(n.Name, n.Addr)
+		}
+	}
+}
+
+func aePeer(name, addr string) {
+	start := time.Now()
+
+	local, err := aeBuild(name)
+	if err != nil {
+		logWarning("Anti Entropy Scan Error", "err", err)
+		return
+	}
+
+	diff, err := aeDiff(local, addr)
+	if err != nil {
+		logWarning("Anti Entropy Error", "peer", addr, "err", err)
+		return
+	}
+
+	repaired := 0
+	for i := 0; i < len(diff) && !backgroundPaused(); i += aeBatch {
+		j := i + aeBatch
+		if j > len(diff) {
+			j = len(diff)
+		}
+
+		resp, err := merkleCall(addr, &merkleReq{Level: aeDepth, Buckets: diff[i:j]})
+		if err != nil {
+			logWarning("Anti Entropy Error", "peer", addr, "err", err)
+			return
+		}
+
+		repaired += aeRepair(addr, local, diff[i:j], resp.Entries)
+	}
+
+	if len(diff) > 0 {
+		logNotice("Anti Entropy", "peer", addr, "buckets", len(diff), "repaired", repaired, "duration_ms", ms(time.Since(start)))
+	}
+}
+
+//让对方重新建树,建好后返回根
+func merkleRoot(addr string) (*merkleResp, error) {
+	req := &merkleReq{Rebuild: true, Level: 0, Index: []int{0}}
+	deadline := time.Now().Add(aeBuildWait)
+
+	for {
+		resp, err := merkleCall(addr, req)
+		if err != nil || !resp.Building {
+			return resp, err
+		}
+		if time.Now().After(deadline) || backgroundPaused() {
+			return nil, errors.New("merkle tree building timeout")
+		}
+
+		req.Rebuild = false
+		time.Sleep(time.Second)
+	}
+}
+
+//从根往下只比不一样的子树,返回不一样的桶
+func aeDiff(local *merkleTree, addr string) ([]int, error) {
+	index := []int{0}
+
+	for level := 0; level <= aeDepth && len(index) > 0; level++ {
+		var resp *merkleResp
+		var err error
+		if level == 0 {
+			resp, err = merkleRoot(addr)
+		} else {
+			resp, err = merkleCall(addr, &merkleReq{Level: level, Index: index})
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Hashes) != len(index) {
+			return nil, errors.New("merkle response error")
+		}
+
+		var next []int
+		for k, i := range index {
+			if resp.Hashes[k] == hex.EncodeToString(local.levels[level][i]) {
+				continue
+			}
+
+			if level == aeDepth {
+				next = append(next, i)
+				continue
+			}
+
+			for c := 0; c < aeFanout; c++ {
+				next = append(next, i*aeFanout + c)
+			}
+		}
+
+		if level == aeDepth {
+			return next, nil
+		}
+		index = next
+	}
+
+	return nil, nil
+}
+
+func merkleCall(addr string, req *merkleReq) (*merkleResp, error) {
+	req.From = *serverName
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	u := url.URL{Scheme: "http", Host: addr, Path: merklePath}
+
+	hr, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	internalHeader(hr)
+
+	resp, err := aeClient.Do(hr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	r := new(merkleResp)
+	err = json.NewDecoder(resp.Body).Decode(r)
+	return r, err
+}
+
+//对比两边桶里的文件,只修复本地
+func aeRepair(addr string, local *merkleTree, buckets []int, remote []*aeEntry) int {
+	mine := make(map[string]*aeEntry)
+	for _, i := range buckets {
+		for _, e := range local.buckets[i] {
+			mine[e.Path] = e
+		}
+	}
+
+	n := 0
+	for _, r := range remote {
+		l := mine[r.Path]
+		if l != nil && l.key() == r.key() {
+			continue
+		}
+
+		err := aeRepairEntry(addr, l, r)
+		if err != nil {
+			logNotice("Anti Entropy Repair Error", "path", r.Path, "peer", addr, "err", err)
+			continue
+		}
+		n++
+	}
+
+	return n
+}
+
+//对方比本地新才拉取,本地新的等对方来拉
+func aeRepairEntry(addr string, l, r *aeEntry) error {
+	//本地没有文件,元数据可能还在
+	if l == nil {
+		cur := localVersion(r.Path)
+		if cur.exists {
+			return nil
+		}
+		l = &aeEntry{Path: r.Path, Version: cur.vv, VersionTime: cur.time, Deleted: cur.deleted}
+	}
+
+	if r.Deleted && l.Hash == "" && !l.Deleted {
+		//本地本来就没有
+		return nil
+	}
+
+	final := &objVersion{vv: r.Version, time: r.VersionTime, deleted: r.Deleted}
+
+	if len(l.Version) > 0 || len(r.Version) > 0 {
+		switch r.Version.Compare(l.Version) {
+		case VV_BEFORE:
+			return nil
+		case VV_CONCURRENT:
+			if *conflictMode == "report" {
+				logNotice("Anti Entropy Conflict", "path", r.Path, "local", l.Version, "remote", r.Version)
+				return nil
+			}
+
+			lv := &objVersion{vv: l.Version, time: l.VersionTime}
+			if newerVersion(lv, &objVersion{vv: r.Version, time: r.VersionTime}) {
+				return nil
+			}
+			final.vv = r.Version.Merge(l.Version)
+		case VV_EQUAL:
+			if !aeNewer(r, l) {
+				return nil
+			}
+		}
+	} else if l.Hash == "" || !aeNewer(r, l) {
+		//没有版本就没有墓碑,分不清本地是删掉了还是没收到,不拉回来
+		return nil
+	}
+
+	//扫描之后本地又改过就不动了
+	cur := localVersion(r.Path)
+	if cur.vv.Compare(l.Version) != VV_EQUAL {
+		return nil
+	}
+
+	if r.Deleted {
+		err := fs.Remove(r.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		setVersion(r.Path, final)
+		return nil
+	}
+
+	//内容一样只差元数据
+	if l.Hash == r.Hash && l.Size == r.Size && !l.Deleted {
+		t := time.Unix(0, r.Mtime)
+		err := os.Chtimes(fs.pathToFile(r.Path), t, t)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := pullFile(addr, r.Path, aeLimit)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(final.vv) > 0 {
+		setVersion(r.Path, final)
+	}
+
+	return nil
+}
+
+//版本一样或没有版本时按修改时间,再按hash,各节点选的一样
+func aeNewer(r, l *aeEntry) bool {
+	if r.Deleted != l.Deleted {
+		return l.Deleted
+	}
+	if r.Mtime != l.Mtime {
+		return r.Mtime > l.Mtime
+	}
+	return r.Hash > l.Hash
+}
+
+// ------ 限速 ----------------
+
+//每秒多少字节,0不限速
+type rateLimiter struct {
+	mu sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+func (l *rateLimiter) Wait(n int64) {
+	if l == nil || l.rate <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	d := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
+
+func (l *rateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil || l.rate <= 0 {
+		return r
+	}
+	return &limitedReader{r, l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *rateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.l.Wait(int64(n))
+	return n, err
+}
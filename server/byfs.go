@@ -1,11 +1,11 @@
 package main
 
 import (
-	"fmt"
 	"flag"
 	"os"
-	"log"
-	//"time"
+	"net"
+	"time"
+	"syscall"
 	"os/signal"
 )
 
@@ -13,6 +13,33 @@ var serverName = flag.String("name", "", "Server Name")
 var listenAddr = flag.String("addr", ":8080", "Listen Addr")
 var password = flag.String("auth", "", "Auth Token")
 var dirroot = flag.String("dir", ".", "file dir")
+var rmallPassword = flag.String("rmall-auth", "", "Recursive Delete Auth Token (disabled if empty)")
+var replicaPeers = flag.String("peers", "", "Replica Addrs (host:port,host:port)")
+var replicaAck = flag.String("replica-ack", "async", "Replica Ack Mode (sync|async)")
+var clusterFile = flag.String("cluster", "", "Cluster Map File")
+var clusterProxy = flag.Bool("cluster-proxy", false, "Proxy Requests For Other Nodes Instead Of Redirect")
+var adminAddr = flag.String("admin-addr", "", "Admin Listen Addr (disabled if empty)")
+var gossipJoin = flag.String("join", "", "Gossip Seed Addrs (host:port,host:port)")
+var advertiseAddr = flag.String("advertise", "", "Addr Other Nodes Use To Reach This Node")
+var conflictMode = flag.String("conflict", "lww", "Concurrent Write Resolve Mode (lww|report)")
+var antiEntropyInterval = flag.Duration("anti-entropy", 10 * time.Minute, "Anti Entropy Interval (disabled if 0)")
+var antiEntropyRate = flag.Int64("anti-entropy-rate", 10 << 20, "Anti Entropy Bytes Per Second (unlimited if 0)")
+var erasureConf = flag.String("erasure", "", "Erasure Coded Prefixes For HTTP Uploads (/archive:6+3,/cold:4+2)")
+var dedupConf = flag.String("dedup", "", "Deduplicated Prefixes (/avatars,/attachments)")
+var dedupGC = flag.Duration("dedup-gc", time.Hour, "Dedup Blob GC Interval (disabled if 0)")
+var versioningConf = flag.String("versioning", "", "Versioned Prefixes With Retention (/docs:10,/reports:30d)")
+var versionPrune = flag.Duration("version-prune", 10 * time.Minute, "Version Prune Interval")
+var trashRetention = flag.Duration("trash", 0, "Keep Deleted Files In Trash For (disabled if 0)")
+var expireInterval = flag.Duration("expire-interval", time.Minute, "Expired File Reap Interval (disabled if 0)")
+var keysConf = flag.String("keys", "", "Access Keys (name:secret,...)")
+var quotaConf = flag.String("quota", "", "Quotas (/prefix:10G:100000,@key:5G)")
+var quotaScan = flag.Duration("quota-scan", 10 * time.Minute, "Quota Usage Reconcile Interval (disabled if 0)")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 30 * time.Second, "Max Time To Wait For Requests And Streams On Shutdown")
+var upgradeTimeout = flag.Duration("upgrade-timeout", 5 * time.Minute, "Max Time For Old Process To Drain After SIGUSR2 Upgrade")
+var readOnlyMode = flag.Bool("read-only", false, "Reject Client Writes (replication still applied)")
+var maintenanceMode = flag.Bool("maintenance", false, "Reject All Writes And Pause Background Cleanup")
+var volumesConf = flag.String("volumes", "", "Named Volumes JSON ({\"name\":{\"dir\":\"/data/name\",\"mode\":\"0644\",\"keys\":{},\"quota\":\"/:10G\",\"read_only\":false}})")
+var erasureMin = flag.Int64("erasure-min", 1 << 20, "Min File Size To Use Erasure Coding")
 
 var fileMode os.FileMode = 0644
 
@@ -20,22 +47,77 @@ var fs *filesystem
 
 func main() {
 	flag.Parse()
+	initConfig()
+	initAccessLog()
 
 	initFilesystem()
+	initVolumes()
+	initCluster()
+	initRebalance()
+	initGossip()
+	initReplica()
+	initPeerAuth()
+	initAntiEntropy()
+	initErasure()
+	initDedup()
+	initVersioning()
+	initTrash()
+	initExpire()
+	initKeys()
+	initQuota()
+	initMode()
+
+	ln := mustListen(*listenAddr)
+	var adminLn net.Listener
+	if *adminAddr != "" {
+		adminLn = mustListen(*adminAddr)
+	}
 
-	go httpServer()
+	go httpServer(ln)
+	go adminServer(adminLn)
 
+	upgradeReady()
 	waitExitSingnal()
 }
 
 func waitExitSingnal() {
-	fmt.Println("Runing.")
+	logInfo("Running", "addr", *listenAddr, "dir", *dirroot)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, watchSignals...)
+
+	timeout := *shutdownTimeout
+	for {
+		s := <-c
+		logNotice("Got Signal", "signal", s.String())
+
+		if s == syscall.SIGHUP {
+			reloadConfig()
+			continue
+		}
+
+		if !isUpgradeSignal(s) {
+			break
+		}
+
+		//新程序起来后老的退出,失败就接着服务
+		err := upgrade()
+		if err != nil {
+			logWarning("Upgrade Error", "err", err)
+			continue
+		}
+		timeout = *upgradeTimeout
+		break
+	}
+
+	//再来一次信号就不等了
+	go func() {
+		s := <-c
+		logWarning("Got Signal, Exit Now", "signal", s.String())
+		os.Exit(1)
+	}()
 
-	s := <-c
-	fmt.Println("Got signal:", s)
+	gracefulShutdown(timeout)
 }
 
 func initFilesystem() {
@@ -45,14 +127,31 @@ func initFilesystem() {
 
 	d, err := os.Stat(*dirroot)
 	if err != nil {
-		log.Fatalln("file dir error", err)
+		logExit("file dir error", "err", err)
 	}
 
 	if !d.IsDir() {
-		log.Fatalln("path not a dir")
+		logExit("path not a dir", "dir", *dirroot)
 	}
 
 	fs = new(filesystem).Init(*dirroot, fileMode)
+	fs.migrateMeta()
 }
 
+func initReplica() {
+	if *replicaAck != "sync" && *replicaAck != "async" {
+		logExit("replica-ack must be sync or async")
+	}
+
+	if *conflictMode != "lww" && *conflictMode != "report" {
+		logExit("conflict must be lww or report")
+	}
+
+	staticPeers = splitList(*replicaPeers)
 
+	var err error
+	repl, err = newReplicator(*replicaAck == "sync", fs.rootdir)
+	if err != nil {
+		logExit("replica init error", "err", err)
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"errors"
+	"strconv"
+	"net/url"
+	"net/http"
+	"hash/crc32"
+	"path/filepath"
+	"encoding/json"
+	"net/http/httputil"
+)
+
+//每个节点默认的虚拟节点数
+const defaultVnodes = 100
+
+//集群里的一个节点,Name就是节点的-name
+type clusterNode struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	Weight int `json:"weight,omitempty"`
+}
+
+//集群配置,静态文件或管理接口设置
+type clusterMap struct {
+	Vnodes int `json:"vnodes,omitempty"`
+	//每个路径放在几个节点上
+	Replicas int `json:"replicas,omitempty"`
+	//默认的读写法定数,请求头可以单独指定
+	ReadQuorum int `json:"read_quorum,omitempty"`
+	WriteQuorum int `json:"write_quorum,omitempty"`
+	Nodes []*clusterNode `json:"nodes"`
+}
+
+func (m *clusterMap) check() error {
+	if len(m.Nodes) == 0 {
+		return errors.New("cluster has no node")
+	}
+
+	names := make(map[string]bool)
+	for _, n := range m.Nodes {
+		if n.Name == "" || n.Addr == "" {
+			return errors.New("cluster node need name and addr")
+		}
+		if names[n.Name] {
+			return errors.New("cluster node name repeat: " + n.Name)
+		}
+		if n.Weight < 0 {
+			return errors.New("cluster node weight error: " + n.Name)
+		}
+		names[n.Name] = true
+	}
+
+	if m.Vnodes < 0 || m.Replicas < 0 || m.Replicas > len(m.Nodes) {
+		return errors.New("cluster vnodes or replicas error")
+	}
+
+	n := m.Replicas
+	if n == 0 {
+		n = 1
+	}
+	if m.ReadQuorum < 0 || m.ReadQuorum > n || m.WriteQuorum < 0 || m.WriteQuorum > n {
+		return errors.New("cluster read_quorum or write_quorum error")
+	}
+
+	return nil
+}
+
+//一致性hash环
+type ring struct {
+	m *clusterMap
+	hashes []uint32
+	owners []*clusterNode
+}
+
+func newRing(m *clusterMap) *ring {
+	r := &ring{m: m}
+
+	vnodes := m.Vnodes
+	if vnodes == 0 {
+		vnodes = defaultVnodes
+	}
+
+	type point struct {
+		hash uint32
+		node *clusterNode
+	}
+	var points []point
+
+	for _, n := range m.Nodes {
+		weight := n.Weight
+		if weight == 0 {
+			weight = 1
+		}
+
+		for i := 0; i < vnodes * weight; i++ {
+			h := crc32.ChecksumIEEE([]byte(n.Name + "#" + strconv.Itoa(i)))
+			points = append(points, point{h, n})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].node.Name < points[j].node.Name
+		}
+		return points[i].hash < points[j].hash
+	})
+
+	for _, p := range points {
+		r.hashes = append(r.hashes, p.hash)
+		r.owners = append(r.owners, p.node)
+	}
+
+	return r
+}
+
+func (r *ring) replicas() int {
+	if r.m.Replicas == 0 {
+		return 1
+	}
+	return r.m.Replicas
+}
+
+//路径的存放节点,顺时针找n个不同的节点,第一个是主节点
+func (r *ring) Lookup(p string, n int) []*clusterNode {
+	if n > len(r.m.Nodes) {
+		n = len(r.m.Nodes)
+	}
+
+	h := crc32.ChecksumIEEE([]byte(cleanPath(p)))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	var list []*clusterNode
+	seen := make(map[string]bool)
+
+	for j := 0; j < len(r.hashes) && len(list) < n; j++ {
+		node := r.owners[(i + j) % len(r.hashes)]
+		if !seen[node.Name] {
+			seen[node.Name] = true
+			list = append(list, node)
+		}
+	}
+
+	return list
+}
+
+//路径的所有副本节点,跳过已经死掉的节点
+func (r *ring) Owners(p string) []*clusterNode {
+	all := r.Lookup(p, len(r.m.Nodes))
+
+	var list []*clusterNode
+	for _, n := range all {
+		if len(list) == r.replicas() {
+			break
+		}
+		if !memberDead(n.Name) {
+			list = append(list, n)
+		}
+	}
+
+	//全死了就还按原来的放
+	if len(list) == 0 {
+		return all[:r.replicas()]
+	}
+
+	return list
+}
+
+func (r *ring) Node(name string) *clusterNode {
+	for _, n := range r.m.Nodes {
+		if n.Name == name {
+			return n
+		}
+	}
+	return nil
+}
+
+//当前集群,没有配置时为nil
+var cluster struct {
+	mu sync.RWMutex
+	ring *ring
+	file string
+}
+
+func currentRing() *ring {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.ring
+}
+
+func loadClusterMap(name string) (*clusterMap, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(clusterMap)
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, m.check()
+}
+
+//本节点必须在集群里
+func setClusterMap(m *clusterMap, save bool) error {
+	if *peerPassword == "" {
+		return errPeerAuthNeed
+	}
+
+	err := m.check()
+	if err != nil {
+		return err
+	}
+
+	r := newRing(m)
+	if r.Node(*serverName) == nil {
+		return errors.New("this node not in cluster: " + *serverName)
+	}
+
+	cluster.mu.Lock()
+
+	if save {
+		data, err := json.MarshalIndent(m, "", "\t")
+		if err == nil {
+			err = writeFileSync(cluster.file, data)
+		}
+		if err != nil {
+			cluster.mu.Unlock()
+			return err
+		}
+	}
+
+	old := cluster.ring
+	cluster.ring = r
+	cluster.mu.Unlock()
+
+	gossipAddNodes(m.Nodes)
+
+	//集群变了,数据迁到新的存放节点
+	if old != nil {
+		startRebalance(old.m, m)
+	}
+
+	return nil
+}
+
+//没有-cluster时用系统目录里保存的配置
+func initCluster() {
+	cluster.file = *clusterFile
+	if cluster.file == "" {
+		cluster.file = filepath.Join(fs.rootdir, sysDirName, "cluster.json")
+		os.MkdirAll(filepath.Dir(cluster.file), 0755)
+	}
+
+	m, err := loadClusterMap(cluster.file)
+	if os.IsNotExist(err) && *clusterFile == "" {
+		return
+	}
+	if err != nil {
+		logExit("cluster map error", "err", err)
+	}
+
+	err = setClusterMap(m, false)
+	if err != nil {
+		logExit("cluster map error", "err", err)
+	}
+}
+
+//转发过的请求不再路由,避免两边集群配置不一致时来回跳
+const routedHeader = "Byfs-Routed"
+
+//不属于本节点的路径重定向或代理到主节点,返回true表示已经处理
+func routeRequest(w http.ResponseWriter, r *http.Request) bool {
+	rg := currentRing()
+	if rg == nil || isReplica(r) || r.Header.Get(routedHeader) != "" {
+		return false
+	}
+
+	owners := rg.Owners(r.URL.Path)
+	isOwner := false
+	for _, n := range owners {
+		if n.Name == *serverName {
+			isOwner = true
+		}
+	}
+
+	//迁移期间旧节点上还有的文件直接读,新节点上还没有的去旧节点读
+	if prev := rebalancePrev(); prev != nil && (r.Method == "GET" || r.Method == "HEAD") {
+		_, err := os.Stat(fs.pathToFile(r.URL.Path))
+		if !isOwner && err == nil {
+			return false
+		}
+
+		if isOwner && os.IsNotExist(err) {
+			for _, n := range prev.Owners(r.URL.Path) {
+				if n.Name != *serverName {
+					forwardRequest(w, r, n)
+					return true
+				}
+			}
+		}
+	}
+
+	if isOwner {
+		return false
+	}
+
+	forwardRequest(w, r, owners[0])
+	return true
+}
+
+func forwardRequest(w http.ResponseWriter, r *http.Request, target *clusterNode) {
+	if *clusterProxy {
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: target.Addr})
+		r.Header.Set(routedHeader, *serverName)
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	u := url.URL{Scheme: "http", Host: target.Addr, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+}
+
+//集群模式下复制到路径的其它副本节点,否则用-peers
+func replicaTargets(p string) []string {
+	rg := currentRing()
+	if rg == nil {
+		return staticPeers
+	}
+
+	var addrs []string
+	for _, n := range rg.Owners(p) {
+		if n.Name != *serverName {
+			addrs = append(addrs, n.Addr)
+		}
+	}
+
+	return addrs
+}
+
+//GET 取集群配置, PUT 设置并保存
+func adminCluster(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rg := currentRing()
+		if rg == nil {
+			http.Error(w, "Cluster Not Set", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, rg.m)
+	case "PUT":
+		m := new(clusterMap)
+		err := json.NewDecoder(r.Body).Decode(m)
+		if err == nil {
+			err = setClusterMap(m, true)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqLog(r).Notice("Cluster Map Changed")
+		fmt.Fprint(w, "Success")
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
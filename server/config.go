@@ -0,0 +1,474 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"flag"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"encoding/json"
+)
+
+//JSON配置文件,和命令行参数是同一套设置,命令行上给了的以命令行为准
+//收到SIGHUP时重新读取,只有能安全修改的设置会生效,其它的改了要重启
+//
+//	{
+//		"name": "node1",
+//		"listen": ":8080",
+//		"admin_listen": "127.0.0.1:9090",
+//		"dir": "/data/byfs",
+//		"auth": "secret",
+//		"peer_auth": "node-secret",
+//		"keys": {"app1": "secret1"},
+//		"timeouts": {"action": "3s", "idle": "5m", "http_read": "5m", "http_write": "5m"},
+//		"limits": {"max_append": "16M", "quota": "/app1:10G:100000"},
+//		"log": {"file": "/var/log/byfs.log", "level": "info", "format": "json", "access": "/var/log/byfs-access.log", "access_max_size": "100M"},
+//		"volumes": {"photos": {"dir": "/data/photos", "read_only": true}},
+//		"options": {"trash": "72h", "read-only": "true"}
+//	}
+
+var configFile = flag.String("config", "", "JSON Config File (reload on SIGHUP)")
+var actionTimeoutFlag = flag.Duration("action-timeout", 3 * time.Second, "Stream Action Timeout")
+var idleTimeoutFlag = flag.Duration("idle-timeout", 300 * time.Second, "Stream Idle Timeout")
+var httpReadTimeout = flag.Duration("http-read-timeout", 300 * time.Second, "HTTP Read Timeout")
+var httpWriteTimeout = flag.Duration("http-write-timeout", 300 * time.Second, "HTTP Write Timeout")
+var maxAppendFlag = flag.Int64("max-append", 16 << 20, "Max Bytes Of One Atomic Append")
+var logFile = flag.String("log-file", "", "Log File (stderr if empty, reopen on SIGHUP)")
+
+type fileConfig struct {
+	Name string `json:"name"`
+	Listen string `json:"listen"`
+	AdminListen string `json:"admin_listen"`
+	Dir string `json:"dir"`
+	Auth string `json:"auth"`
+	RmallAuth string `json:"rmall_auth"`
+	PeerAuth string `json:"peer_auth"`
+	Keys map[string]string `json:"keys"`
+	Timeouts struct {
+		Action string `json:"action"`
+		Idle string `json:"idle"`
+		HTTPRead string `json:"http_read"`
+		HTTPWrite string `json:"http_write"`
+		Shutdown string `json:"shutdown"`
+		Upgrade string `json:"upgrade"`
+	} `json:"timeouts"`
+	Limits struct {
+		MaxAppend string `json:"max_append"`
+		Quota string `json:"quota"`
+		QuotaScan string `json:"quota_scan"`
+	} `json:"limits"`
+	Log struct {
+		File string `json:"file"`
+		Level string `json:"level"`
+		Format string `json:"format"`
+		Access string `json:"access"`
+		AccessFormat string `json:"access_format"`
+		AccessMaxSize string `json:"access_max_size"`
+		AccessBackups string `json:"access_backups"`
+	} `json:"log"`
+	Volumes map[string]*volumeConfig `json:"volumes"`
+	//其它命令行参数,按参数名
+	Options map[string]string `json:"options"`
+}
+
+//运行中可以修改的
+var reloadable = map[string]bool{
+	"auth": true,
+	"rmall-auth": true,
+	"keys": true,
+	"action-timeout": true,
+	"idle-timeout": true,
+	"max-append": true,
+	"quota": true,
+	"log-file": true,
+	"log-level": true,
+	"access-log": true,
+	"access-log-format": true,
+	"access-log-max-size": true,
+	"access-log-backups": true,
+	"read-only": true,
+	"maintenance": true,
+}
+
+var config struct {
+	//保护可以热加载的字符串参数
+	mu sync.RWMutex
+	//命令行上给了的参数
+	cmdline map[string]bool
+	//上次配置文件里有的参数,重新加载时去掉了的回到默认值
+	file map[string]bool
+}
+
+//读得很频繁,用原子变量
+var liveAction, liveIdle, liveMaxAppend int64
+
+var logOut struct {
+	mu sync.Mutex
+	fp *os.File
+}
+
+func authPassword() string {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return *password
+}
+
+func rmallAuthPassword() string {
+	config.mu.RLock()
+	defer config.mu.RUnlock()
+	return *rmallPassword
+}
+
+func actionTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&liveAction))
+}
+
+func idleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&liveIdle))
+}
+
+//原子追加一次最多的数据
+func maxAppendSize() int64 {
+	return atomic.LoadInt64(&liveMaxAppend)
+}
+
+//在flag.Parse之后调用
+func initConfig() {
+	config.cmdline = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		config.cmdline[f.Name] = true
+	})
+
+	if *configFile != "" {
+		values, err := readConfig(*configFile)
+		if err == nil {
+			_, _, err = applyConfig(values, true)
+		}
+		if err != nil {
+			logExit("config error", "err", err)
+		}
+		rememberConfig(values)
+	}
+
+	err := checkConfig()
+	if err != nil {
+		logExit("config error", "err", err)
+	}
+
+	err = reopenLog()
+	if err != nil {
+		logExit("log file error", "err", err)
+	}
+	initLogging()
+
+	applyLive()
+}
+
+//读配置文件,转成参数名对应的值
+func readConfig(name string) (map[string]string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := new(fileConfig)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	set := func(name, v string) {
+		if v != "" {
+			values[name] = v
+		}
+	}
+
+	//options先放,具体的字段覆盖它
+	for k, v := range conf.Options {
+		if flag.Lookup(k) == nil || k == "config" {
+			return nil, errors.New("unknown option " + k)
+		}
+		values[k] = v
+	}
+
+	set("name", conf.Name)
+	set("addr", conf.Listen)
+	set("admin-addr", conf.AdminListen)
+	set("dir", conf.Dir)
+	set("auth", conf.Auth)
+	set("rmall-auth", conf.RmallAuth)
+	set("peer-auth", conf.PeerAuth)
+	set("action-timeout", conf.Timeouts.Action)
+	set("idle-timeout", conf.Timeouts.Idle)
+	set("http-read-timeout", conf.Timeouts.HTTPRead)
+	set("http-write-timeout", conf.Timeouts.HTTPWrite)
+	set("shutdown-timeout", conf.Timeouts.Shutdown)
+	set("upgrade-timeout", conf.Timeouts.Upgrade)
+	set("quota", conf.Limits.Quota)
+	set("quota-scan", conf.Limits.QuotaScan)
+	set("log-file", conf.Log.File)
+	set("log-level", conf.Log.Level)
+	set("log-format", conf.Log.Format)
+	set("access-log", conf.Log.Access)
+	set("access-log-format", conf.Log.AccessFormat)
+	set("access-log-max-size", conf.Log.AccessMaxSize)
+	set("access-log-backups", conf.Log.AccessBackups)
+
+	if conf.Limits.MaxAppend != "" {
+		n, err := parseSize(conf.Limits.MaxAppend)
+		if err != nil {
+			return nil, errors.New("max_append " + err.Error())
+		}
+		values["max-append"] = strconv.FormatInt(n, 10)
+	}
+
+	if conf.Volumes != nil {
+		data, _ := json.Marshal(conf.Volumes)
+		values["volumes"] = string(data)
+	}
+
+	if conf.Keys != nil {
+		var list []string
+		for k, v := range conf.Keys {
+			if k == "" || v == "" || strings.ContainsAny(k, ":,") || strings.Contains(v, ",") {
+				return nil, errors.New("keys error " + k)
+			}
+			list = append(list, k + ":" + v)
+		}
+		sort.Strings(list)
+		values["keys"] = strings.Join(list, ",")
+	}
+
+	return values, nil
+}
+
+func rememberConfig(values map[string]string) {
+	config.file = make(map[string]bool)
+	for name := range values {
+		config.file[name] = true
+	}
+}
+
+//上次文件里有这次没有的参数用默认值,不然删掉的设置还一直生效
+func withRemoved(values map[string]string) map[string]string {
+	all := make(map[string]string)
+	for name := range config.file {
+		all[name] = flag.Lookup(name).DefValue
+	}
+	for name, v := range values {
+		all[name] = v
+	}
+	return all
+}
+
+//设置参数,命令行给了的跳过,出错时全部还原
+//start为false时只改可以热加载的,返回原来的值和改不了的参数
+func applyConfig(values map[string]string, start bool) (map[string]string, []string, error) {
+	old := make(map[string]string)
+	var skipped []string
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if config.cmdline[name] {
+			continue
+		}
+
+		f := flag.Lookup(name)
+		if sameValue(f, values[name]) {
+			continue
+		}
+
+		if !start && !reloadable[name] {
+			skipped = append(skipped, name)
+			continue
+		}
+
+		old[name] = f.Value.String()
+		err := f.Value.Set(values[name])
+		if err != nil {
+			restoreConfig(old)
+			return nil, nil, errors.New(name + ": " + err.Error())
+		}
+	}
+
+	return old, skipped, nil
+}
+
+//1h和1h0m0s是一样的
+func sameValue(f *flag.Flag, v string) bool {
+	g, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() == v
+	}
+
+	switch cur := g.Get().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(v)
+		return err == nil && d == cur
+	case bool:
+		b, err := strconv.ParseBool(v)
+		return err == nil && b == cur
+	case int64:
+		n, err := strconv.ParseInt(v, 0, 64)
+		return err == nil && n == cur
+	case int:
+		n, err := strconv.ParseInt(v, 0, 64)
+		return err == nil && int(n) == cur
+	}
+	return f.Value.String() == v
+}
+
+func restoreConfig(old map[string]string) {
+	for name, v := range old {
+		flag.Set(name, v)
+	}
+}
+
+//参数之间和取值的检查
+func checkConfig() error {
+	if *actionTimeoutFlag <= 0 || *idleTimeoutFlag <= 0 {
+		return errors.New("stream timeouts must be positive")
+	}
+	if *httpReadTimeout < 0 || *httpWriteTimeout < 0 {
+		return errors.New("http timeouts must not be negative")
+	}
+	if *maxAppendFlag <= 0 {
+		return errors.New("max-append must be positive")
+	}
+	if _, err := parseKeys(*keysConf); err != nil {
+		return err
+	}
+	if _, err := parseQuota(*quotaConf); err != nil {
+		return err
+	}
+	if _, err := parseVolumes(*volumesConf); err != nil {
+		return err
+	}
+	if _, err := parseLevel(*logLevelFlag); err != nil {
+		return err
+	}
+	if *logFormat != "logfmt" && *logFormat != "json" {
+		return errors.New("log-format must be logfmt or json")
+	}
+	if err := checkAccessLog(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func applyLive() {
+	atomic.StoreInt64(&liveAction, int64(*actionTimeoutFlag))
+	atomic.StoreInt64(&liveIdle, int64(*idleTimeoutFlag))
+	atomic.StoreInt64(&liveMaxAppend, *maxAppendFlag)
+
+	if level, err := parseLevel(*logLevelFlag); err == nil {
+		logLevel.Set(level)
+	}
+}
+
+//日志文件被切割后重新打开
+func reopenLog() error {
+	logOut.mu.Lock()
+	defer logOut.mu.Unlock()
+
+	var fp *os.File
+	if *logFile != "" {
+		var err error
+		fp, err = os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if logOut.fp != nil {
+		logOut.fp.Close()
+	}
+	logOut.fp = fp
+	return nil
+}
+
+//运行日志和访问日志
+func reopenLogs() {
+	err := reopenLog()
+	if err != nil {
+		logWarning("Log Reopen Error", "err", err)
+	}
+
+	err = reopenAccessLog()
+	if err != nil {
+		logWarning("Access Log Reopen Error", "err", err)
+	}
+}
+
+//SIGHUP
+func reloadConfig() {
+	if *configFile == "" {
+		reopenLogs()
+		return
+	}
+
+	values, err := readConfig(*configFile)
+	if err != nil {
+		logWarning("Config Reload Error", "err", err)
+		return
+	}
+
+	quota, keys := *quotaConf, *keysConf
+
+	config.mu.Lock()
+	old, skipped, err := applyConfig(withRemoved(values), false)
+	if err == nil {
+		err = checkConfig()
+		if err != nil {
+			restoreConfig(old)
+		}
+	}
+	if err == nil {
+		rememberConfig(values)
+	}
+	config.mu.Unlock()
+
+	if err != nil {
+		logWarning("Config Reload Error", "err", err)
+		return
+	}
+
+	applyLive()
+
+	_, ro := old["read-only"]
+	_, mt := old["maintenance"]
+	if ro || mt {
+		initMode()
+	}
+
+	if *keysConf != keys {
+		loadKeys(*keysConf)
+	}
+	//新加的规则要扫描,扫完才换上
+	if *quotaConf != quota {
+		err := fs.reloadQuota(*quotaConf)
+		if err != nil {
+			logWarning("Quota Reload Error", "err", err)
+		}
+	}
+
+	reopenLogs()
+
+	if len(skipped) > 0 {
+		logWarning("Config Changed But Need Restart", "flags", strings.Join(skipped, ","))
+	}
+	logNotice("Config Reloaded", "file", *configFile)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"os"
+	"flag"
+	"testing"
+	"path/filepath"
+)
+
+//按两份配置文件先启动再重新加载,返回重新加载时改不了的参数
+func reloadWith(t *testing.T, first, second string) []string {
+	name := filepath.Join(t.TempDir(), "byfs.json")
+
+	config.cmdline = make(map[string]bool)
+	config.file = nil
+
+	os.WriteFile(name, []byte(first), 0644)
+	values, err := readConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = applyConfig(values, true); err != nil {
+		t.Fatal(err)
+	}
+	rememberConfig(values)
+
+	os.WriteFile(name, []byte(second), 0644)
+	values, err = readConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, skipped, err := applyConfig(withRemoved(values), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rememberConfig(values)
+
+	return skipped
+}
+
+func resetFlags(names ...string) {
+	for _, name := range names {
+		f := flag.Lookup(name)
+		f.Value.Set(f.DefValue)
+	}
+}
+
+func TestReloadRemovedKeyReverts(t *testing.T) {
+	cases := []struct {
+		name string
+		first string
+		second string
+		flag string
+		want string
+		restart bool
+	}{
+		{"read-only", `{"options": {"read-only": "true"}}`, `{}`, "read-only", "false", false},
+		{"quota", `{"limits": {"quota": "/a:1G"}}`, `{"auth": "x"}`, "quota", "", false},
+		{"keys", `{"keys": {"app": "s"}}`, `{}`, "keys", "", false},
+		{"auth", `{"auth": "x"}`, `{}`, "auth", "", false},
+		{"kept", `{"auth": "x"}`, `{"auth": "x"}`, "auth", "x", false},
+		{"changed", `{"auth": "x"}`, `{"auth": "y"}`, "auth", "y", false},
+		{"volumes", `{"volumes": {"v": {"dir": "/tmp/v"}}}`, `{}`, "volumes",
+			`{"v":{"dir":"/tmp/v","mode":"","keys":null,"quota":"","read_only":false}}`, true},
+	}
+
+	for _, c := range cases {
+		skipped := reloadWith(t, c.first, c.second)
+
+		got := flag.Lookup(c.flag).Value.String()
+		if got != c.want {
+			t.Errorf("%s: %s = %q, want %q", c.name, c.flag, got, c.want)
+		}
+
+		restart := len(skipped) == 1 && skipped[0] == c.flag
+		if restart != c.restart {
+			t.Errorf("%s: skipped %v", c.name, skipped)
+		}
+
+		resetFlags("read-only", "quota", "keys", "auth", "volumes")
+	}
+}
+
+//命令行给了的不受配置文件影响
+func TestReloadKeepsCmdline(t *testing.T) {
+	defer resetFlags("read-only")
+
+	config.cmdline = map[string]bool{"read-only": true}
+	config.file = map[string]bool{"read-only": true}
+	flag.Set("read-only", "true")
+
+	_, _, err := applyConfig(withRemoved(map[string]string{}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !*readOnlyMode {
+		t.Fatal("read-only from cmdline reverted")
+	}
+}
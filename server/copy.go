@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io"
+	"os"
+	"errors"
+	"strings"
+	"path/filepath"
+)
+
+func (f *filesystem) Copy(name, to string) error {
+	return f.copy(name, to, true)
+}
+
+//副本跟着主节点复制,不检查配额
+func (f *filesystem) ReplicaCopy(name, to string) error {
+	return f.copy(name, to, false)
+}
+
+func (f *filesystem) copy(name, to string, check bool) error {
+	p, pt := cleanPath(name), cleanPath(to)
+	name = f.pathToFile(name)
+	if name == "." {
+		return errors.New("File Name Error")
+	}
+
+	to = f.pathToFile(to)
+	if to == "." {
+		return errors.New("File Name Error")
+	}
+
+	if to == name || isSubPath(name, to) {
+		return errors.New("Copy Into Itself")
+	}
+
+	//副本跟着主节点,主节点上已经检查过
+	if check && f.Expired(p) {
+		return expiredError("copy", p)
+	}
+
+	//目标是纠删码存储的文件也算已存在
+	if f.erasure(pt) != nil {
+		return &os.PathError{Op: "copy", Path: pt, Err: os.ErrExist}
+	}
+
+	if man := f.erasure(p); man != nil && check {
+		err := f.ecCopy(p, pt, man, "")
+		if err == nil {
+			f.watch.Publish(EVENT_CREATE, pt, "")
+		}
+		return err
+	}
+
+	//复制出来的文件没有所有者
+	target := rebaseEntries(f.quotaEntries(name), p, pt)
+	for i := range target {
+		target[i].owner = ""
+	}
+
+	var err error
+	if check {
+		err = f.quota.chargeAll(target)
+		if err != nil {
+			return err
+		}
+	} else {
+		f.quota.add(target)
+	}
+
+	err = copyPath(name, to, f.fileMode)
+	if err == nil {
+		f.watch.Publish(EVENT_CREATE, pt, "")
+	} else {
+		//复制了一半的等后台扫描校正
+		f.quota.drop(target)
+	}
+	return err
+}
+
+//目标已存在时失败,与PUT的行为一致
+func copyPath(src, dst string, mode os.FileMode) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return copyDir(src, dst, fi, mode)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return errors.New("Not Regular File: " + src)
+	}
+
+	return copyFile(src, dst, mode)
+}
+
+func copyDir(src, dst string, fi os.FileInfo, mode os.FileMode) error {
+	err := os.Mkdir(dst, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	d, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	for {
+		names, err := d.Readdirnames(100)
+		for _, n := range names {
+			err := copyPath(filepath.Join(src, n), filepath.Join(dst, n), mode)
+			if err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+
+	//优先reflink,不支持时io.Copy会走copy_file_range
+	err = reflink(out, in)
+	if err != nil {
+		_, err = io.Copy(out, in)
+	}
+
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return out.Close()
+}
+
+func isSubPath(dir, p string) bool {
+	return strings.HasPrefix(p, dir+string(filepath.Separator))
+}
@@ -0,0 +1,21 @@
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//linux/fs.h FICLONE
+const ficlone = 0x40049409
+
+//btrfs/xfs等支持的写时复制
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"errors"
+)
+
+func reflink(dst, src *os.File) error {
+	return errors.New("reflink not support")
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+	"errors"
+	"strconv"
+	"net/http"
+	"encoding/hex"
+	"path/filepath"
+)
+
+//内容寻址的去重存储,按路径前缀开启
+//内容按sha256只在 .byfs/blobs 下存一份,路径是它的硬链接,读的代码都不用改
+//引用数就是硬链接数,写打开前先拆开链接,删除和覆盖时释放引用
+
+//PUT时声明的内容sha256,客户端的只用来校验
+//节点之间的副本本地已经有这份内容时不用传body
+const sha256Header = "Byfs-Sha256"
+
+var dedupPrefixes []string
+
+type blobStore struct {
+	mu sync.Mutex
+	dir string
+}
+
+func newBlobStore(root string) *blobStore {
+	return &blobStore{dir: filepath.Join(root, sysDirName, "blobs")}
+}
+
+func initDedup() {
+	if !dedupSupported {
+		if *dedupConf != "" {
+			logExit("dedup not support on this platform")
+		}
+		return
+	}
+
+	for _, p := range splitList(*dedupConf) {
+		dedupPrefixes = append(dedupPrefixes, cleanPath(p))
+	}
+
+	//去掉前缀后留下的blob也要回收
+	if *dedupGC > 0 {
+		go blobGCLoop()
+	}
+}
+
+//纠删码存储的不去重
+func dedupFor(p string) bool {
+	p = cleanPath(p)
+	if erasureFor(p) != nil {
+		return false
+	}
+
+	for _, prefix := range dedupPrefixes {
+		if hasPathPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validBlobSum(sum string) bool {
+	if len(sum) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(sum)
+	return err == nil
+}
+
+func (b *blobStore) path(sum string) string {
+	return filepath.Join(b.dir, sum[:2], sum)
+}
+
+func (b *blobStore) Has(sum string) bool {
+	if !validBlobSum(sum) {
+		return false
+	}
+	_, err := os.Lstat(b.path(sum))
+	return err == nil
+}
+
+//刚写好的文件放进blob库,内容已经有了就换成已有blob的链接
+func (b *blobStore) Adopt(name, sum string, tmp string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bp := b.path(sum)
+
+	_, err := os.Lstat(bp)
+	if err == nil {
+		err = os.Link(bp, tmp)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, name)
+		if err != nil {
+			os.Remove(tmp)
+		}
+		return err
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(bp), 0755)
+	if err != nil {
+		return err
+	}
+	return os.Link(name, bp)
+}
+
+//没有路径引用时删掉blob
+func (b *blobStore) Release(sum string) {
+	if !validBlobSum(sum) {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bp := b.path(sum)
+	fi, err := os.Lstat(bp)
+	if err == nil && linkCount(fi) <= 1 {
+		os.Remove(bp)
+	}
+}
+
+type blobStats struct {
+	Blobs int `json:"blobs"`
+	Bytes int64 `json:"bytes"`
+	Refs uint64 `json:"refs"`
+	//去重省下的空间
+	Saved int64 `json:"saved"`
+	//本次回收的
+	Removed int `json:"removed,omitempty"`
+	RemovedBytes int64 `json:"removed_bytes,omitempty"`
+}
+
+//统计blob库,gc为true时删掉没有引用的blob
+func (b *blobStore) Scan(gc bool) (*blobStats, error) {
+	st := new(blobStats)
+
+	err := filepath.Walk(b.dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		refs := linkCount(fi) - 1
+		if refs == 0 && gc {
+			b.mu.Lock()
+			fi, err = os.Lstat(name)
+			if err == nil && linkCount(fi) <= 1 && os.Remove(name) == nil {
+				st.Removed++
+				st.RemovedBytes += fi.Size()
+				b.mu.Unlock()
+				return nil
+			}
+			b.mu.Unlock()
+			if err != nil {
+				return nil
+			}
+			refs = linkCount(fi) - 1
+		}
+
+		st.Blobs++
+		st.Bytes += fi.Size()
+		st.Refs += refs
+		if refs > 1 {
+			st.Saved += fi.Size() * int64(refs - 1)
+		}
+		return nil
+	})
+
+	return st, err
+}
+
+func blobGCLoop() {
+	for {
+		time.Sleep(*dedupGC)
+		if backgroundPaused() {
+			continue
+		}
+
+		st, err := fs.blobs.Scan(true)
+		if err != nil {
+			logWarning("Dedup GC Error", "err", err)
+			continue
+		}
+		if st.Removed > 0 {
+			logNotice("Dedup GC Removed", "files", st.Removed, "bytes", st.RemovedBytes)
+		}
+	}
+}
+
+// ------ filesystem 上的引用 ----------------
+
+//路径引用的blob,name是本地路径
+func (f *filesystem) blobOf(name string) string {
+	md := f.meta.Get(name)
+	if md == nil {
+		return ""
+	}
+	return md.Blob
+}
+
+//目录下所有路径引用的blob
+func (f *filesystem) blobsUnder(name string) []string {
+	var list []string
+	f.meta.Each(name, func(md *metadata) {
+		if md.Blob != "" {
+			list = append(list, md.Blob)
+		}
+	})
+	return list
+}
+
+func (f *filesystem) setBlob(name, sum string) {
+	f.meta.Update(name, func(md *metadata) bool {
+		md.Blob = sum
+		return true
+	})
+
+	//顺便缓存整个文件的hash
+	fi, err := os.Lstat(name)
+	if err == nil && sum != "" {
+		f.meta.CacheHash(name, fi, "sha256:0:" + strconv.FormatInt(fi.Size(), 10), sum)
+	}
+}
+
+//写好的文件交给blob库
+func (f *filesystem) AdoptBlob(name, sum string) error {
+	name = f.pathToFile(name)
+	if name == "." {
+		return errors.New("File Name Error")
+	}
+
+	tmp, err := f.tempName("blob-")
+	if err != nil {
+		return err
+	}
+
+	err = f.blobs.Adopt(name, sum, tmp)
+	if err != nil {
+		return err
+	}
+
+	f.setBlob(name, sum)
+	return nil
+}
+
+//写打开之前拆开硬链接,其它引用同样内容的路径不受影响
+func (f *filesystem) unshare(name string, truncate bool) error {
+	sum := f.blobOf(name)
+	if sum == "" {
+		return nil
+	}
+
+	tmp, err := f.tempFile("unshare-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	//反正要清空就不用复制了
+	if !truncate {
+		var src *os.File
+		src, err = os.Open(name)
+		if err == nil {
+			_, err = io.Copy(tmp, src)
+			src.Close()
+		}
+	}
+	if err == nil {
+		err = tmp.Chmod(f.fileMode)
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		return err
+	}
+
+	f.meta.Update(name, func(md *metadata) bool {
+		md.Blob = ""
+		md.Hash = nil
+		return true
+	})
+	f.blobs.Release(sum)
+	return nil
+}
+
+//GET 统计, POST ?action=gc 立即回收
+func adminDedup(w http.ResponseWriter, r *http.Request) {
+	gc := false
+
+	if r.Method == "POST" {
+		if r.URL.Query().Get("action") != "gc" {
+			http.Error(w, "Action Error", http.StatusBadRequest)
+			return
+		}
+		if adminDenied(w, r) {
+			return
+		}
+		gc = true
+	}
+
+	st, err := fs.blobs.Scan(gc)
+	if err != nil {
+		http.Error(w, "Dedup Scan Error "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, st)
+}
@@ -0,0 +1,14 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+//拿不到硬链接数,不能去重
+const dedupSupported = false
+
+func linkCount(fi os.FileInfo) uint64 {
+	return 1
+}
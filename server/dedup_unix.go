@@ -0,0 +1,19 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const dedupSupported = true
+
+//blob的引用数就是硬链接数
+func linkCount(fi os.FileInfo) uint64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 1
+	}
+	return uint64(st.Nlink)
+}
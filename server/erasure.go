@@ -0,0 +1,898 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"hash"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+)
+
+//冷数据的纠删码存储,按路径前缀开启
+//HTTP PUT 的大文件切成数据分片和校验分片放到环上的各个节点,存放节点的元数据里只留分片清单
+//流协议写的和小文件还是普通文件,流协议可以只读打开分片存储的文件
+
+//编码解码每次处理的分片长度
+const ecChunk = 64 << 10
+
+const shardPath = "/" + sysDirName + "/shard"
+const manifestPath = "/" + sysDirName + "/manifest"
+
+type ecSpec struct {
+	prefix string
+	data int
+	parity int
+}
+
+var ecSpecs []*ecSpec
+
+type ecShard struct {
+	Node string `json:"node,omitempty"`
+	Addr string `json:"addr,omitempty"`
+	Hash string `json:"hash"`
+}
+
+//分片清单,保存在元数据里
+type ecManifest struct {
+	Data int `json:"data"`
+	Parity int `json:"parity"`
+	Size int64 `json:"size"`
+	ShardSize int64 `json:"shard_size"`
+	ModTime int64 `json:"mtime"`
+	Shards []ecShard `json:"shards"`
+}
+
+//格式 /archive:6+3,/cold:4+2
+func initErasure() {
+	for _, item := range splitList(*erasureConf) {
+		i := strings.LastIndex(item, ":")
+		if i < 1 {
+			logExit("erasure config error", "item", item)
+		}
+
+		var data, parity int
+		_, err := fmt.Sscanf(item[i+1:], "%d+%d", &data, &parity)
+		if err == nil {
+			_, err = newReedSolomon(data, parity)
+		}
+		if err != nil {
+			logExit("erasure config error", "item", item, "err", err)
+		}
+
+		ecSpecs = append(ecSpecs, &ecSpec{prefix: cleanPath(item[:i]), data: data, parity: parity})
+	}
+}
+
+//最长的前缀优先
+func erasureFor(p string) *ecSpec {
+	var best *ecSpec
+
+	for _, s := range ecSpecs {
+		if !hasPathPrefix(p, s.prefix) {
+			continue
+		}
+		if best == nil || len(s.prefix) > len(best.prefix) {
+			best = s
+		}
+	}
+
+	return best
+}
+
+func shardFile(p string, i int) string {
+	return filepath.Join(fs.rootdir, sysDirName, "shards", filepath.FromSlash(cleanPath(p))) + "." + strconv.Itoa(i)
+}
+
+//普通文件存在时清单不算数
+func ecLoad(p string) *ecManifest {
+	name := fs.pathToFile(p)
+	if name == "." {
+		return nil
+	}
+
+	if _, err := os.Lstat(name); err == nil {
+		return nil
+	}
+
+	md := fs.meta.Get(name)
+	if md == nil {
+		return nil
+	}
+
+	return md.Erasure
+}
+
+func ecPutManifest(p string, m *ecManifest) error {
+	return fs.meta.Update(fs.pathToFile(p), func(md *metadata) bool {
+		md.Erasure = m
+		return true
+	})
+}
+
+//分片依次放到环上的节点,节点不够时一个节点放多个,不是集群模式都放本地
+func ecPlacement(p string, n int) []*clusterNode {
+	list := make([]*clusterNode, n)
+
+	rg := currentRing()
+	if rg == nil {
+		return list
+	}
+
+	var nodes []*clusterNode
+	all := rg.Lookup(p, len(rg.m.Nodes))
+	for _, node := range all {
+		if !memberDead(node.Name) {
+			nodes = append(nodes, node)
+		}
+	}
+	if len(nodes) == 0 {
+		nodes = all
+	}
+
+	for i := range list {
+		list[i] = nodes[i % len(nodes)]
+	}
+
+	return list
+}
+
+func isLocalShard(s ecShard) bool {
+	return s.Node == "" || s.Node == *serverName
+}
+
+//其它存放节点也保存一份清单
+func ecOwners(p string) []string {
+	rg := currentRing()
+	if rg == nil {
+		return nil
+	}
+
+	var addrs []string
+	for _, n := range rg.Owners(p) {
+		if n.Name != *serverName {
+			addrs = append(addrs, n.Addr)
+		}
+	}
+	return addrs
+}
+
+func ecTempFile() (*os.File, error) {
+	dir := filepath.Join(fs.rootdir, sysDirName, "tmp")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, "ec-")
+}
+
+func closeTemps(list []*os.File) {
+	for _, f := range list {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+}
+
+//编码本地的普通文件,分片和清单都保存好后删除普通文件
+func ecStore(p string, spec *ecSpec) error {
+	name := fs.pathToFile(p)
+
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	rs, err := newReedSolomon(spec.data, spec.parity)
+	if err != nil {
+		return err
+	}
+
+	k, total := spec.data, spec.data + spec.parity
+	size := fi.Size()
+	shardSize := (size + int64(k) - 1) / int64(k)
+
+	tmps := make([]*os.File, total)
+	defer closeTemps(tmps)
+
+	hashes := make([]io.Writer, total)
+	sums := make([]interface{ Sum([]byte) []byte }, total)
+	for i := range tmps {
+		tmps[i], err = ecTempFile()
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		hashes[i], sums[i] = io.MultiWriter(tmps[i], h), h
+	}
+
+	bufs := make([][]byte, total)
+	for i := range bufs {
+		bufs[i] = make([]byte, ecChunk)
+	}
+
+	shards := make([][]byte, total)
+	for off := int64(0); off < shardSize; off += ecChunk {
+		n := shardSize - off
+		if n > ecChunk {
+			n = ecChunk
+		}
+
+		for i := range shards {
+			shards[i] = bufs[i][:n]
+		}
+
+		//最后一个分片不够的补0
+		for i := 0; i < k; i++ {
+			r, err := src.ReadAt(shards[i], int64(i) * shardSize + off)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			for x := r; x < len(shards[i]); x++ {
+				shards[i][x] = 0
+			}
+		}
+
+		rs.Encode(shards)
+
+		for i, w := range hashes {
+			_, err = w.Write(shards[i])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	man := &ecManifest{
+		Data: spec.data,
+		Parity: spec.parity,
+		Size: size,
+		ShardSize: shardSize,
+		ModTime: fi.ModTime().UnixNano(),
+		Shards: make([]ecShard, total),
+	}
+
+	placement := ecPlacement(p, total)
+	for i, node := range placement {
+		man.Shards[i].Hash = hex.EncodeToString(sums[i].Sum(nil))
+		if node != nil {
+			man.Shards[i].Node, man.Shards[i].Addr = node.Name, node.Addr
+		}
+	}
+
+	errs := make(chan error, total)
+	for i := range man.Shards {
+		go func(i int) {
+			errs <- ecPutShard(p, i, man.Shards[i], tmps[i])
+		}(i)
+	}
+
+	for range man.Shards {
+		if err1 := <-errs; err1 != nil {
+			err = err1
+		}
+	}
+
+	if err != nil {
+		ecRemoveShards(p, man)
+		return err
+	}
+
+	err = ecPutManifest(p, man)
+	if err != nil {
+		ecRemoveShards(p, man)
+		return err
+	}
+
+	for _, addr := range ecOwners(p) {
+		err := ecSend("PUT", addr, manifestPath, p, -1, man)
+		if err != nil {
+			logWarning("Erasure Manifest Error", "peer", addr, "path", p, "err", err)
+		}
+	}
+
+	return os.Remove(name)
+}
+
+func ecPutShard(p string, i int, s ecShard, f *os.File) error {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if isLocalShard(s) {
+		return writeShard(shardFile(p, i), f)
+	}
+
+	return ecSend("PUT", s.Addr, shardPath, p, i, f)
+}
+
+func writeShard(name string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(name), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fp, r)
+	if err1 := fp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+//body可以是文件或清单
+func ecSend(method, addr, endpoint, p string, i int, body interface{}) error {
+	q := url.Values{"path": {p}}
+	if i >= 0 {
+		q.Set("index", strconv.Itoa(i))
+	}
+	u := url.URL{Scheme: "http", Host: addr, Path: endpoint, RawQuery: q.Encode()}
+
+	var r io.Reader
+	var size int64 = -1
+
+	switch b := body.(type) {
+	case *os.File:
+		fi, err := b.Stat()
+		if err != nil {
+			return err
+		}
+		r, size = b, fi.Size()
+	case *ecManifest:
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		r, size = strings.NewReader(string(data)), int64(len(data))
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	internalHeader(req)
+
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK || string(msg) != "Success" {
+		return fmt.Errorf("%s %s: %s", resp.Status, endpoint, msg)
+	}
+
+	return nil
+}
+
+func ecRemoveShards(p string, man *ecManifest) {
+	for i, s := range man.Shards {
+		var err error
+		if isLocalShard(s) {
+			err = os.Remove(shardFile(p, i))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = ecSend("DELETE", s.Addr, shardPath, p, i, nil)
+		}
+		if err != nil {
+			logWarning("Erasure Shard Remove Error", "path", p, "shard", i, "err", err)
+		}
+	}
+}
+
+func ecDelete(p string, man *ecManifest) {
+	ecDrop(p, man)
+	fs.watch.Publish(EVENT_REMOVE, p, "")
+}
+
+//删掉分片和各节点的清单
+func ecDrop(p string, man *ecManifest) {
+	ecRemoveShards(p, man)
+
+	fs.meta.Remove(fs.pathToFile(p))
+	for _, addr := range ecOwners(p) {
+		err := ecSend("DELETE", addr, manifestPath, p, -1, nil)
+		if err != nil {
+			logWarning("Erasure Manifest Error", "peer", addr, "path", p, "err", err)
+		}
+	}
+}
+
+//COPY和MOVE纠删码存储的文件,解码成目标的普通文件,目标已存在时失败
+//目标也在纠删码存储的前缀下时重新编码,和PUT一样不计入配额
+//副本上没有普通文件,当作源不存在,由主节点改发目标的内容
+func (f *filesystem) ecCopy(p, pt string, man *ecManifest, owner string) error {
+	to := f.pathToFile(pt)
+	if f.erasure(pt) != nil {
+		return &os.PathError{Op: "copy", Path: pt, Err: os.ErrExist}
+	}
+
+	err := f.quota.charge(pt, owner, man.Size, 1)
+	if err != nil {
+		return err
+	}
+
+	rd, err := ecOpen(p, man)
+	if err == nil {
+		defer rd.Close()
+
+		var out *os.File
+		out, err = os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.fileMode)
+		if err == nil {
+			_, err = io.Copy(out, io.NewSectionReader(rd, 0, man.Size))
+			if err1 := out.Close(); err == nil {
+				err = err1
+			}
+			if err != nil {
+				os.Remove(to)
+			}
+		}
+	}
+	if err != nil {
+		f.quota.adjust(pt, owner, -man.Size, -1)
+		return err
+	}
+	f.setOwner(to, owner)
+
+	if spec := erasureFor(pt); spec != nil && man.Size >= *erasureMin {
+		err = ecStore(pt, spec)
+		if err != nil {
+			//普通文件也能用,留着
+			logWarning("Erasure Error", "path", pt, "err", err)
+			return nil
+		}
+		f.quota.adjust(pt, owner, -man.Size, -1)
+	}
+
+	return nil
+}
+
+//HEAD 不用解码
+func ecServe(w http.ResponseWriter, r *http.Request, p string, man *ecManifest) {
+	mtime := time.Unix(0, man.ModTime)
+	w.Header().Set("Byfs-Erasure", fmt.Sprintf("%d+%d", man.Data, man.Parity))
+
+	if r.Method == "HEAD" {
+		w.Header().Set("Content-Length", strconv.FormatInt(man.Size, 10))
+		w.Header().Set("Last-Modified", mtime.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	rd, err := ecOpen(p, man)
+	if err == nil && man.Size > 0 {
+		//先读一下开头,分片不够时还能返回错误
+		_, err = rd.ReadAt(make([]byte, 1), 0)
+	}
+	if err != nil {
+		if rd != nil {
+			rd.Close()
+		}
+		http.Error(w, "503 Erasure Read Error", http.StatusServiceUnavailable)
+		reqLog(r).Warning("Erasure Read Error", "file", p, "err", err)
+		return
+	}
+	defer rd.Close()
+
+	http.ServeContent(w, r, path.Base(p), mtime, io.NewSectionReader(rd, 0, man.Size))
+}
+
+//读远程分片不限总时间,读多快取决于客户端
+var ecStreamClient = &http.Client{
+	Transport: &http.Transport{ResponseHeaderTimeout: 30 * time.Second},
+}
+
+//一个分片的读取,远程分片顺序读时复用同一个请求
+//从头顺序读完时校验hash,不对的当作缺失;随机读的部分没法校验
+type ecSource struct {
+	p string
+	i int
+	shard ecShard
+	size int64
+
+	bad error
+	local *os.File
+	body io.ReadCloser
+	pos int64
+
+	h hash.Hash
+	hashed int64
+}
+
+func (s *ecSource) readAt(buf []byte, off int64) error {
+	if s.bad != nil {
+		return s.bad
+	}
+
+	err := s.read(buf, off)
+	if err == nil {
+		err = s.verify(buf, off)
+	}
+	if err != nil {
+		logNotice("Erasure Shard Missing", "path", s.p, "shard", s.i, "err", err)
+		s.bad = err
+		s.close()
+	}
+	return err
+}
+
+func (s *ecSource) read(buf []byte, off int64) error {
+	if isLocalShard(s.shard) {
+		if s.local == nil {
+			f, err := os.Open(shardFile(s.p, s.i))
+			if err != nil {
+				return err
+			}
+			s.local = f
+		}
+
+		_, err := s.local.ReadAt(buf, off)
+		return err
+	}
+
+	if s.body == nil || s.pos != off {
+		err := s.open(off)
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := io.ReadFull(s.body, buf)
+	s.pos += int64(n)
+	return err
+}
+
+func (s *ecSource) open(off int64) error {
+	s.close()
+
+	q := url.Values{"path": {s.p}, "index": {strconv.Itoa(s.i)}}
+	u := url.URL{Scheme: "http", Host: s.shard.Addr, Path: shardPath, RawQuery: q.Encode()}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	internalHeader(req)
+	if off > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", off))
+	}
+
+	resp, err := ecStreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && off > 0:
+	case resp.StatusCode == http.StatusOK:
+		//旧版本不支持Range,跳过前面的
+		_, err = io.CopyN(io.Discard, resp.Body, off)
+	default:
+		err = errors.New(resp.Status)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return err
+	}
+
+	s.body, s.pos = resp.Body, off
+	return nil
+}
+
+func (s *ecSource) verify(buf []byte, off int64) error {
+	if s.hashed != off {
+		s.hashed = -1
+		return nil
+	}
+
+	s.h.Write(buf)
+	s.hashed += int64(len(buf))
+	if s.hashed == s.size && hex.EncodeToString(s.h.Sum(nil)) != s.shard.Hash {
+		return errors.New("shard hash mismatch")
+	}
+	return nil
+}
+
+func (s *ecSource) close() {
+	if s.local != nil {
+		s.local.Close()
+		s.local = nil
+	}
+	if s.body != nil {
+		s.body.Close()
+		s.body = nil
+	}
+}
+
+//按块读取纠删码存储的文件,数据分片在就直接读,缺了用任意data个分片解码这一块
+type ecReader struct {
+	mu sync.Mutex
+	man *ecManifest
+	rs *reedSolomon
+	src []*ecSource
+
+	//最近读到的一块,各数据分片在off处的内容,直接读时只有一个
+	off int64
+	chunk [][]byte
+}
+
+func ecOpen(p string, man *ecManifest) (*ecReader, error) {
+	total := man.Data + man.Parity
+	if len(man.Shards) != total {
+		return nil, errors.New("erasure manifest error")
+	}
+
+	rs, err := newReedSolomon(man.Data, man.Parity)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &ecReader{man: man, rs: rs, off: -1}
+	for i, s := range man.Shards {
+		e.src = append(e.src, &ecSource{p: p, i: i, shard: s, size: man.ShardSize, h: sha256.New()})
+	}
+
+	return e, nil
+}
+
+func (e *ecReader) Size() int64 {
+	return e.man.Size
+}
+
+func (e *ecReader) ReadAt(b []byte, off int64) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	size, shardSize := e.man.Size, e.man.ShardSize
+
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		if pos >= size {
+			return n, io.EOF
+		}
+
+		i := int(pos / shardSize)
+		in := pos % shardSize
+		c := in - in % ecChunk
+
+		data, err := e.chunkAt(i, c)
+		if err != nil {
+			return n, err
+		}
+
+		//最后一个分片后面是补的0
+		data = data[in-c:]
+		if int64(len(data)) > size - pos {
+			data = data[:size-pos]
+		}
+		n += copy(b[n:], data)
+	}
+
+	return n, nil
+}
+
+func (e *ecReader) chunkAt(i int, c int64) ([]byte, error) {
+	if e.off == c && e.chunk[i] != nil {
+		return e.chunk[i], nil
+	}
+
+	n := e.man.ShardSize - c
+	if n > ecChunk {
+		n = ecChunk
+	}
+
+	buf := make([]byte, n)
+	if e.src[i].readAt(buf, c) == nil {
+		e.off, e.chunk = c, make([][]byte, e.man.Data)
+		e.chunk[i] = buf
+		return buf, nil
+	}
+
+	//数据分片读不到,凑够data个分片解码
+	var have []int
+	var in [][]byte
+	for j := 0; j < len(e.src) && len(have) < e.man.Data; j++ {
+		buf := make([]byte, n)
+		if e.src[j].readAt(buf, c) == nil {
+			have = append(have, j)
+			in = append(in, buf)
+		}
+	}
+
+	if len(have) < e.man.Data {
+		return nil, fmt.Errorf("erasure shards not enough %d/%d", len(have), e.man.Data)
+	}
+
+	out := make([][]byte, e.man.Data)
+	for j := range out {
+		out[j] = make([]byte, n)
+	}
+
+	err := e.rs.Reconstruct(have, in, out)
+	if err != nil {
+		return nil, err
+	}
+
+	e.off, e.chunk = c, out
+	return out[i], nil
+}
+
+func (e *ecReader) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, s := range e.src {
+		s.close()
+	}
+	return nil
+}
+
+//流协议只读打开的纠删码存储的文件
+type ecFile struct {
+	*io.SectionReader
+	r *ecReader
+	fi os.FileInfo
+}
+
+func (f *filesystem) openErasure(name string, man *ecManifest) (*file, error) {
+	p := cleanPath(name)
+
+	rd, err := ecOpen(p, man)
+	if err != nil {
+		return nil, err
+	}
+
+	ef := &ecFile{SectionReader: io.NewSectionReader(rd, 0, man.Size), r: rd, fi: ecStat(p, man)}
+	return &file{name: f.pathToFile(name), path: p, root: f, ec: ef}, nil
+}
+
+//纠删码存储的文件当作普通文件给stat用
+type ecFileInfo struct {
+	name string
+	man *ecManifest
+}
+
+func (fi *ecFileInfo) Name() string { return fi.name }
+func (fi *ecFileInfo) Size() int64 { return fi.man.Size }
+func (fi *ecFileInfo) Mode() os.FileMode { return 0644 }
+func (fi *ecFileInfo) ModTime() time.Time { return time.Unix(0, fi.man.ModTime) }
+func (fi *ecFileInfo) IsDir() bool { return false }
+func (fi *ecFileInfo) Sys() interface{} { return nil }
+
+func ecStat(p string, man *ecManifest) os.FileInfo {
+	return &ecFileInfo{name: path.Base(cleanPath(p)), man: man}
+}
+
+//纠删码存储只在默认的根目录
+func (f *filesystem) erasure(name string) *ecManifest {
+	if f != fs {
+		return nil
+	}
+	return ecLoad(name)
+}
+
+//普通文件不存在时看是不是纠删码存储的,err是原来的错误
+func (f *filesystem) erasureStat(name string, err error) (os.FileInfo, error) {
+	if man := f.erasure(name); man != nil && os.IsNotExist(err) {
+		return ecStat(name, man), nil
+	}
+	return nil, err
+}
+
+//目录下纠删码存储的文件,没有普通文件只有元数据,列目录时补上
+func ecEntries(p string) []string {
+	var names []string
+	for _, name := range fs.meta.Children(fs.pathToFile(p)) {
+		q := path.Join(cleanPath(p), name)
+		if ecLoad(q) != nil && !fs.Expired(q) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ------ 节点之间的接口 ----------------
+
+//PUT/GET/DELETE /.byfs/shard?path=&index=
+func shardHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	i, err := strconv.Atoi(q.Get("index"))
+	if err != nil || i < 0 || q.Get("path") == "" {
+		http.Error(w, "Shard Error", http.StatusBadRequest)
+		return
+	}
+	name := shardFile(q.Get("path"), i)
+
+	switch r.Method {
+	case "PUT":
+		err = writeShard(name, r.Body)
+		if err != nil {
+			fmt.Fprint(w, "Shard Save Error", err)
+			reqLog(r).Notice("Shard Save Error", "shard", name, "err", err)
+			return
+		}
+		fmt.Fprint(w, "Success")
+	case "GET":
+		fp, err := os.Open(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer fp.Close()
+
+		//按块读取时从中间开始
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, fp)
+	case "DELETE":
+		err = os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprint(w, "Shard Remove Error", err)
+			return
+		}
+		fmt.Fprint(w, "Success")
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+//PUT/DELETE /.byfs/manifest?path=
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	p := cleanPath(r.URL.Query().Get("path"))
+
+	switch r.Method {
+	case "PUT":
+		man := new(ecManifest)
+		err := json.NewDecoder(io.LimitReader(r.Body, 1 << 20)).Decode(man)
+		if err == nil {
+			err = ecPutManifest(p, man)
+		}
+		if err != nil {
+			fmt.Fprint(w, "Manifest Save Error", err)
+			return
+		}
+		fmt.Fprint(w, "Success")
+	case "DELETE":
+		if ecLoad(p) != nil {
+			fs.meta.Remove(fs.pathToFile(p))
+		}
+		fmt.Fprint(w, "Success")
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"time"
+	"errors"
+	"strconv"
+	"net/http"
+	"path/filepath"
+)
+
+//文件过期时间,保存在元数据里,后台定时清理
+//PUT用Byfs-Expires头, 值是unix秒或HTTP时间
+//流协议a_fopen的flag带O_EXPIRES时后面跟int64的unix秒, 0表示取消过期
+
+const expiresHeader = "Byfs-Expires"
+
+//和系统的O_*不冲突
+const O_EXPIRES = 0x40000000
+
+func initExpire() {
+	if *expireInterval > 0 {
+		go expireLoop()
+	} else {
+		//不清理也要有索引,列目录时隐藏过期的文件
+		go fs.meta.LoadExpires()
+	}
+}
+
+func parseExpires(str string) (int64, error) {
+	if str == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err == nil && n > 0 {
+		return n, nil
+	}
+
+	t, err := http.ParseTime(str)
+	if err != nil {
+		return 0, errors.New("Expires Error")
+	}
+	return t.Unix(), nil
+}
+
+func (f *filesystem) SetExpires(name string, expires int64) error {
+	name = f.pathToFile(name)
+	if name == "." {
+		return errors.New("File Name Error")
+	}
+
+	return f.meta.Update(name, func(md *metadata) bool {
+		if md.Expires == expires {
+			return false
+		}
+		md.Expires = expires
+		return true
+	})
+}
+
+func (f *filesystem) Expires(name string) int64 {
+	name = f.pathToFile(name)
+	if name == "." {
+		return 0
+	}
+
+	md := f.meta.Get(name)
+	if md == nil {
+		return 0
+	}
+	return md.Expires
+}
+
+//已过期还没清理的当作不存在
+func (f *filesystem) Expired(name string) bool {
+	exp := f.Expires(name)
+	return exp > 0 && exp <= time.Now().Unix()
+}
+
+//已过期的按不存在报错
+func expiredError(op, p string) error {
+	return &os.PathError{Op: op, Path: p, Err: os.ErrNotExist}
+}
+
+//删除过期的文件,集群模式留下墓碑,免得被其它节点修复回来
+func reapExpired(p string) error {
+	if man := ecLoad(p); man != nil {
+		ecDelete(p, man)
+		return nil
+	}
+
+	_, err := versionedRemove(p, fs.Remove)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+//写之前先清掉已过期的旧文件,不能写的模式下留着给后台清理
+func reapIfExpired(p string, replica bool) {
+	if writeDenied(replica) != nil || !fs.Expired(p) {
+		return
+	}
+
+	err := reapExpired(p)
+	if err != nil {
+		logWarning("Expire Remove Error", "path", p, "err", err)
+	}
+}
+
+func expireLoop() {
+	fs.meta.LoadExpires()
+
+	for {
+		time.Sleep(*expireInterval)
+		if backgroundPaused() {
+			continue
+		}
+
+		removed := 0
+		for _, name := range fs.meta.DueExpires(time.Now().Unix()) {
+			rel, err := filepath.Rel(fs.rootdir, name)
+			if err != nil {
+				continue
+			}
+			p := "/" + filepath.ToSlash(rel)
+
+			//索引之后可能被重新设置过
+			if !fs.Expired(p) {
+				fs.meta.Reindex(name)
+				continue
+			}
+
+			err = reapExpired(p)
+			if err != nil {
+				logWarning("Expire Remove Error", "path", p, "err", err)
+				continue
+			}
+			removed++
+		}
+
+		if removed > 0 {
+			logNotice("Expired Files Removed", "files", removed)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"io"
+	"hash"
 	"sync"
 	"os"
 	"errors"
+	"crypto/sha256"
+	"encoding/hex"
+	"syscall"
+	"strings"
 	"path"
 	"path/filepath"
+	"math"
 )
 
 type filesystem struct {
@@ -13,20 +20,43 @@ type filesystem struct {
 	locks map[string]*lock
 	fileMode os.FileMode
 	rootdir string
+	meta *metaStore
+	watch *watchHub
+	blobs *blobStore
+	quota *quotaSet
+	//卷名,默认的根目录为空
+	volume string
 }
 
 func (f *filesystem) Init(root string, mode os.FileMode) *filesystem {
-	f.rootdir = root
+	f.rootdir = filepath.Clean(root)
 	f.fileMode = mode
 	f.locks = make(map[string]*lock)
+	f.meta = newMetaStore(f.rootdir)
+	f.watch = newWatchHub()
+	f.blobs = newBlobStore(f.rootdir)
+	f.quota = new(quotaSet)
 	return f
 }
 
+//客户端使用的路径
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
 func (f *filesystem) pathToFile(p string) string {
-	return filepath.Join(f.rootdir, filepath.FromSlash(path.Clean("/" + p)))
+	p = cleanPath(p)
+
+	//系统目录不允许访问
+	if p == "/" + sysDirName || strings.HasPrefix(p, "/" + sysDirName + "/") {
+		return "."
+	}
+
+	return filepath.Join(f.rootdir, filepath.FromSlash(p))
 }
 
 func (f *filesystem) Open(name string) (*file, error) {
+	p := cleanPath(name)
 	name = f.pathToFile(name)
 	if name == "." {
 		return nil, errors.New("File Name Error");
@@ -37,68 +67,226 @@ func (f *filesystem) Open(name string) (*file, error) {
 		return nil, err
 	}
 
-	ff := &file{File:fp,name:name}
+	ff := &file{File:fp,name:name,path:p,root:f}
 
 	return ff, nil
 }
 
 func (f *filesystem) OpenFile(name string, flag int) (*file, error) {
+	p := cleanPath(name)
 	name = f.pathToFile(name)
 	if name == "." {
 		return nil, errors.New("File Name Error");
 	}
 
-	fp, err := os.OpenFile(name, flag, fs.fileMode)
+	created := false
+	if flag & os.O_CREATE != 0 {
+		_, err := os.Lstat(name)
+		created = os.IsNotExist(err)
+	}
+
+	if !created && flag & (os.O_WRONLY|os.O_RDWR) != 0 {
+		truncate := flag & os.O_TRUNC != 0
+
+		//截断前保存旧版本,版本是硬链接,所以不能在原文件上截断
+		if truncate {
+			kept, err := f.keepVersion(name, -1)
+			if err != nil {
+				return nil, err
+			}
+			if kept && f.blobOf(name) == "" {
+				err = os.Remove(name)
+				if err != nil {
+					return nil, err
+				}
+				flag |= os.O_CREATE
+			}
+		}
+
+		err := f.unshare(name, truncate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fp, err := os.OpenFile(name, flag, f.fileMode)
 	if err != nil {
 		return nil, err
 	}
 
-	ff := &file{File:fp,name:name}
+	ff := &file{File:fp,name:name,path:p,root:f,flag:flag,created:created}
+	if !created {
+		ff.owner = f.owner(name)
+	}
+
+	if created {
+		ff.dirty = true
+		ff.versioned = true
+		f.watch.Publish(EVENT_CREATE, p, "")
+	}
+
+	if flag & os.O_TRUNC != 0 {
+		ff.versioned = true
+		ff.changed(0)
+		if !created {
+			f.watch.Publish(EVENT_WRITE, p, "")
+		}
+	}
+
+	//不用保留版本的当作已经保存过,要保留的记下原来的长度
+	if !ff.versioned {
+		if !f.versionable(p) {
+			ff.versioned = true
+		} else if fi, err := fp.Stat(); err == nil {
+			ff.base = fi.Size()
+		} else {
+			ff.base = math.MaxInt64
+		}
+	}
 
 	return ff, nil
 }
 
 func (f *filesystem) Mkdir(name string) error {
+	p := cleanPath(name)
 	name = f.pathToFile(name)
 	if name == "." {
 		return errors.New("File Name Error");
 	}
 
-	err := os.Mkdir(name, fs.fileMode)
+	err := os.Mkdir(name, f.fileMode)
+	if err == nil {
+		f.watch.Publish(EVENT_CREATE, p, "")
+	}
 	return err
 }
 
 func (f *filesystem) MkdirAll(name string) error {
+	p := cleanPath(name)
 	name = f.pathToFile(name)
 	if name == "." {
 		return errors.New("File Name Error");
 	}
 
-	err := os.MkdirAll(name, fs.fileMode)
+	err := os.MkdirAll(name, f.fileMode)
+	if err == nil {
+		f.watch.Publish(EVENT_CREATE, p, "")
+	}
 	return err
 }
 
 func (f *filesystem) Remove(name string) error {
+	p := cleanPath(name)
 	name = f.pathToFile(name)
 	if name == "." {
 		return errors.New("File Name Error");
 	}
 
-	err := os.Remove(name)
+	_, err := f.keepVersion(name, -1)
+	if err != nil {
+		return err
+	}
+
+	sum := f.blobOf(name)
+	usage := f.quotaEntries(name)
+
+	err = os.Remove(name)
+	if err == nil {
+		f.quota.drop(usage)
+		f.meta.Remove(name)
+		f.blobs.Release(sum)
+		f.watch.Publish(EVENT_REMOVE, p, "")
+	}
 	return err
 }
 
-func (f *filesystem) RemoveAll(name string) error {
+//只删除文件,目录会失败
+func (f *filesystem) Unlink(name string) error {
+	p := cleanPath(name)
 	name = f.pathToFile(name)
 	if name == "." {
 		return errors.New("File Name Error");
 	}
 
-	err := os.RemoveAll(name)
+	_, err := f.keepVersion(name, -1)
+	if err != nil {
+		return err
+	}
+
+	sum := f.blobOf(name)
+	usage := f.quotaEntries(name)
+
+	err = syscall.Unlink(name)
+	if err != nil {
+		return &os.PathError{Op: "unlink", Path: name, Err: err}
+	}
+
+	f.quota.drop(usage)
+	f.meta.Remove(name)
+	f.blobs.Release(sum)
+	f.watch.Publish(EVENT_REMOVE, p, "")
+	return nil
+}
+
+//只删除空目录
+func (f *filesystem) Rmdir(name string) error {
+	p := cleanPath(name)
+	name = f.pathToFile(name)
+	if name == "." || name == f.rootdir {
+		return errors.New("File Name Error");
+	}
+
+	err := syscall.Rmdir(name)
+	if err != nil {
+		return &os.PathError{Op: "rmdir", Path: name, Err: err}
+	}
+
+	f.meta.Remove(name)
+	f.watch.Publish(EVENT_REMOVE, p, "")
+	return nil
+}
+
+func (f *filesystem) RemoveAll(name string) error {
+	p := cleanPath(name)
+	name = f.pathToFile(name)
+	if name == "." || name == f.rootdir {
+		return errors.New("File Name Error");
+	}
+
+	err := f.keepVersionAll(name)
+	if err != nil {
+		return err
+	}
+
+	blobs := f.blobsUnder(name)
+	usage := f.quotaEntries(name)
+
+	err = os.RemoveAll(name)
+	//删了一半的等后台扫描校正
+	if err == nil {
+		f.quota.drop(usage)
+		f.meta.Remove(name)
+		f.watch.Publish(EVENT_REMOVE, p, "")
+	}
+
+	//删了一半也要释放已经没有引用的
+	for _, sum := range blobs {
+		f.blobs.Release(sum)
+	}
 	return err
 }
 
 func (f *filesystem) Rename(name, to string) error {
+	return f.rename(name, to, true)
+}
+
+//副本跟着主节点改名,不检查配额
+func (f *filesystem) ReplicaRename(name, to string) error {
+	return f.rename(name, to, false)
+}
+
+func (f *filesystem) rename(name, to string, check bool) error {
+	p, pt := cleanPath(name), cleanPath(to)
 	name = f.pathToFile(name)
 	if name == "." {
 		return errors.New("File Name Error");
@@ -109,7 +297,58 @@ func (f *filesystem) Rename(name, to string) error {
 		return errors.New("File Name Error");
 	}
 
-	err := os.Rename(name, to)
+	//纠删码存储的文件复制过去再删掉
+	if man := f.erasure(p); man != nil && check {
+		expires := f.Expires(p)
+		err := f.ecCopy(p, pt, man, f.owner(name))
+		if err != nil {
+			return err
+		}
+
+		ecDrop(p, man)
+		if expires > 0 {
+			f.SetExpires(pt, expires)
+		}
+		f.watch.Publish(EVENT_RENAME, p, pt)
+		return nil
+	}
+
+	//被覆盖的目标保存旧版本并释放引用
+	_, err := f.keepVersion(to, -1)
+	if err != nil {
+		return err
+	}
+
+	sum := f.blobOf(to)
+	replaced := f.quotaEntries(to)
+	moved := f.quotaEntries(name)
+	target := rebaseEntries(moved, p, pt)
+
+	//先退掉会被覆盖和移走的,再按新位置记账
+	f.quota.drop(replaced)
+	f.quota.drop(moved)
+	if check {
+		err = f.quota.chargeAll(target)
+	} else {
+		f.quota.add(target)
+	}
+	if err != nil {
+		f.quota.add(moved)
+		f.quota.add(replaced)
+		return err
+	}
+
+	err = os.Rename(name, to)
+	if err != nil {
+		f.quota.drop(target)
+		f.quota.add(moved)
+		f.quota.add(replaced)
+	} else {
+		f.meta.Rename(name, to)
+		f.meta.InvalidateHash(to)
+		f.blobs.Release(sum)
+		f.watch.Publish(EVENT_RENAME, p, pt)
+	}
 	return err
 }
 
@@ -132,48 +371,252 @@ func (f *filesystem) Stat(name string) (os.FileInfo, error) {
 }
 
 func (f *filesystem) Lock(name string) {
-	f.mu.Lock()
-	l := f.locks[name]
-	if l == nil {
-		l = new(lock)
-		f.locks[name] = l
+	f.getLock(name).rw.Lock()
+}
+
+func (f *filesystem) RLock(name string) {
+	f.getLock(name).rw.RLock()
+}
+
+func (f *filesystem) Unlock(name string) {
+	l := f.putLock(name)
+	if l != nil {
+		l.rw.Unlock()
 	}
-	l.num++
-	f.mu.Unlock()
+}
 
-	f.locks[name].rw.Lock()
+func (f *filesystem) RUnlock(name string) {
+	l := f.putLock(name)
+	if l != nil {
+		l.rw.RUnlock()
+	}
 }
 
-func (f *filesystem) RLock(name string) {
-	f.mu.Lock()
+//引用计数,没人用的锁就删掉
+func (f *filesystem) getLock(name string) *lock {
+	f.lockMu()
+	defer f.mu.Unlock()
+
 	l := f.locks[name]
 	if l == nil {
 		l = new(lock)
 		f.locks[name] = l
 	}
 	l.num++
-	f.mu.Unlock()
 
-	f.locks[name].rw.RLock()
+	return l
 }
 
-func (f *filesystem) Unlock(name string) {
-	f.mu.Lock()
+func (f *filesystem) putLock(name string) *lock {
+	f.lockMu()
 	defer f.mu.Unlock()
 
 	l := f.locks[name]
-
-	if f.locks[name] == nil {
-		delete(f.locks, name)
-		return
+	if l == nil {
+		return nil
 	}
 
-	l.rw.Unlock()
 	l.num--
-
 	if l.num < 1 {
 		delete(f.locks, name)
 	}
+
+	return l
+}
+
+//整块追加写入,同一个文件的追加互斥,返回写入的位置
+func (f *filesystem) Append(name string, data []byte, owner string) (int64, error) {
+	return f.AppendAt(name, data, owner, -1)
+}
+
+//副本追加时带上主节点写入的位置,已经有的部分不再写,重放不会重复
+func (f *filesystem) AppendAt(name string, data []byte, owner string, at int64) (int64, error) {
+	key := f.pathToFile(name)
+	if key == "." {
+		return 0, errors.New("File Name Error")
+	}
+
+	f.Lock(key)
+	defer f.Unlock(key)
+
+	//纠删码存储的文件只能读,追加会建一个普通文件把清单盖住
+	if f.erasure(name) != nil {
+		return 0, errors.New("Erasure File Read Only")
+	}
+
+	fp, err := f.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+
+	size := int64(len(data))
+	if at >= 0 {
+		fi, err := fp.Stat()
+		if err != nil {
+			return 0, err
+		}
+		have := fi.Size() - at
+		if have >= size {
+			return at, nil
+		}
+		if have > 0 {
+			data = data[have:]
+		}
+	}
+
+	var files int64
+	if fp.created {
+		files, fp.owner = 1, owner
+	}
+
+	err = f.quota.charge(fp.path, fp.owner, int64(len(data)), files)
+	if err != nil {
+		fp.ghost = fp.created
+		return 0, err
+	}
+	if fp.created {
+		f.setOwner(key, owner)
+	}
+
+	n, err := fp.Write(data)
+	if err != nil {
+		f.quota.adjust(fp.path, fp.owner, int64(n - len(data)), 0)
+		return 0, err
+	}
+
+	//O_APPEND写完后位置在本次写入的结尾
+	end, err := fp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	f.watch.Publish(EVENT_WRITE, fp.path, "")
+
+	return end - size, nil
+}
+
+//写到临时文件再替换,读的人不会看到写了一半的文件
+//副本跟着主节点写入,不检查配额
+func (f *filesystem) Replace(name string, r io.Reader) error {
+	return f.replace(name, r, false)
+}
+
+//恢复旧版本,按恢复出来的大小检查配额
+func (f *filesystem) Restore(name string, r io.Reader) error {
+	return f.replace(name, r, true)
+}
+
+func (f *filesystem) replace(name string, r io.Reader, check bool) error {
+	p := cleanPath(name)
+	name = f.pathToFile(name)
+	if name == "." {
+		return errors.New("File Name Error")
+	}
+
+	err := os.MkdirAll(filepath.Dir(name), f.fileMode)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := f.tempFile("replace-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var h hash.Hash
+	if dedupFor(p) {
+		h = sha256.New()
+		r = io.TeeReader(r, h)
+	}
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Chmod(f.fileMode)
+	}
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Lstat(name)
+	created := os.IsNotExist(err)
+	old := f.blobOf(name)
+	usage := f.quotaEntries(name)
+	owner := f.owner(name)
+
+	//原来的内容变成旧版本还算在配额里,新内容要先记上
+	var charged int64 = -1
+	if check {
+		fi, err := os.Stat(tmp.Name())
+		if err != nil {
+			return err
+		}
+		err = f.quota.charge(p, owner, fi.Size(), 1)
+		if err != nil {
+			return err
+		}
+		charged = fi.Size()
+	}
+
+	_, err = f.keepVersion(name, -1)
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		if charged >= 0 {
+			f.quota.adjust(p, owner, -charged, -1)
+		}
+		return err
+	}
+
+	f.quota.drop(usage)
+	if fi, err := os.Lstat(name); err == nil && !check {
+		f.quota.adjust(p, owner, fi.Size(), 1)
+	}
+
+	f.meta.InvalidateHash(name)
+	if old != "" {
+		f.setBlob(name, "")
+		f.blobs.Release(old)
+	}
+	if h != nil {
+		err = f.AdoptBlob(p, hex.EncodeToString(h.Sum(nil)))
+		if err != nil {
+			logWarning("Dedup Error", "path", p, "err", err)
+		}
+	}
+	if created {
+		f.watch.Publish(EVENT_CREATE, p, "")
+	}
+	f.watch.Publish(EVENT_WRITE, p, "")
+
+	return nil
+}
+
+//系统目录下的临时文件,和根目录在同一个文件系统里可以直接改名过去
+func (f *filesystem) tempFile(prefix string) (*os.File, error) {
+	tmpdir := filepath.Join(f.rootdir, sysDirName, "tmp")
+	err := os.MkdirAll(tmpdir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(tmpdir, prefix)
+}
+
+//还不存在的临时路径,给要求目标不存在的操作用
+func (f *filesystem) tempName(prefix string) (string, error) {
+	tmpdir := filepath.Join(f.rootdir, sysDirName, "tmp")
+	err := os.MkdirAll(tmpdir, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(tmpdir, prefix + randString()), nil
 }
 
 type lock struct {
@@ -184,11 +627,102 @@ type lock struct {
 type file struct{
 	*os.File
 	name string
+	//客户端路径
+	path string
 	root *filesystem
 	ghost bool
+	//已经写过(元数据已作废)
+	dirty bool
+	//原来的内容已经保存过版本
+	versioned bool
+	//打开时原来内容的长度,只在后面追加的不用保存版本
+	base int64
+	//打开时的flag,是不是新建的
+	flag int
+	created bool
+	//配额记在谁名下
+	owner string
+	//只读打开的纠删码存储的文件,这时没有File
+	ec *ecFile
+	//目录里纠删码存储的文件,列目录时普通文件之后再列
+	ecNames []string
+}
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.ec != nil {
+		return f.ec.Read(b)
+	}
+	return f.File.Read(b)
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	if f.ec != nil {
+		return f.ec.Seek(offset, whence)
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *file) Stat() (os.FileInfo, error) {
+	if f.ec != nil {
+		return f.ec.fi, nil
+	}
+	return f.File.Stat()
+}
+
+func (f *file) Write(b []byte) (int, error) {
+	f.changed(f.writePos())
+	return f.File.Write(b)
+}
+
+func (f *file) ReadFrom(r io.Reader) (int64, error) {
+	f.changed(f.writePos())
+	return f.File.ReadFrom(r)
+}
+
+func (f *file) Truncate(size int64) error {
+	f.changed(size)
+	return f.File.Truncate(size)
+}
+
+//接下来写的位置,已经保存过版本或者追加的不用问
+func (f *file) writePos() int64 {
+	if f.versioned || f.flag & os.O_APPEND != 0 {
+		return f.base
+	}
+
+	off, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	return off
+}
+
+//内容从off开始变化,off在原来的内容之内时先保存版本
+func (f *file) changed(off int64) {
+	//纠删码存储的只读,后面的写会失败
+	if f.ec != nil {
+		return
+	}
+
+	if !f.versioned && off < f.base {
+		f.versioned = true
+		_, err := f.root.keepVersion(f.name, f.base)
+		if err != nil {
+			logWarning("Keep Version Error", "path", f.path, "err", err)
+		}
+	}
+
+	if !f.dirty {
+		f.dirty = true
+		f.root.meta.InvalidateHash(f.name)
+	}
 }
 
 func (f *file) Close() error {
+	if f.ec != nil {
+		return f.ec.r.Close()
+	}
+
 	err := f.File.Close()
 
 	if f.ghost {
@@ -196,6 +730,7 @@ func (f *file) Close() error {
 		if err != nil {
 			panic(err)
 		}
+		f.root.watch.Publish(EVENT_REMOVE, f.path, "")
 	}
 
 	return err
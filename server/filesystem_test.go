@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"path/filepath"
+)
+
+//临时目录当根目录,测完换回原来的
+func testRoot(t *testing.T) *filesystem {
+	old := fs
+	fs = new(filesystem).Init(t.TempDir(), 0755)
+	t.Cleanup(func() {
+		fs = old
+	})
+	return fs
+}
+
+//纠删码存储的文件没有普通文件,追加不能建一个出来盖住清单
+func TestAppendErasureRejected(t *testing.T) {
+	f := testRoot(t)
+
+	err := ecPutManifest("/arc/a", &ecManifest{Data: 4, Parity: 2, Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.Append("/arc/a", []byte("x"), "")
+	if err == nil {
+		t.Fatal("append to erasure file should fail")
+	}
+
+	if _, err := os.Lstat(filepath.Join(f.rootdir, "arc", "a")); !os.IsNotExist(err) {
+		t.Fatal("append created a plain file", err)
+	}
+	if ecLoad("/arc/a") == nil {
+		t.Fatal("manifest lost")
+	}
+
+	//别的文件照常追加
+	os.MkdirAll(filepath.Join(f.rootdir, "arc"), 0755)
+	if _, err := f.Append("/arc/b", []byte("x"), ""); err != nil {
+		t.Fatal(err)
+	}
+}
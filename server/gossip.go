@@ -0,0 +1,401 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+	"bytes"
+	"errors"
+	"net/url"
+	"net/http"
+	"math/rand"
+	"encoding/json"
+)
+
+//SWIM 成员管理,走主端口的 /.byfs/gossip
+const (
+	MEMBER_ALIVE = "alive"
+	MEMBER_SUSPECT = "suspect"
+	MEMBER_DEAD = "dead"
+)
+
+var gossipInterval = time.Second
+var gossipPingTimeout = 500 * time.Millisecond
+var gossipSuspectTimeout = 5 * time.Second
+
+//间接探测找几个节点帮忙
+const gossipIndirect = 3
+
+const gossipPath = "/" + sysDirName + "/gossip"
+
+type member struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+	State string `json:"state"`
+	//只有本节点能增加自己的版本,用来反驳别人的怀疑
+	Incarnation int64 `json:"incarnation"`
+	Since time.Time `json:"since"`
+}
+
+type gossipMsg struct {
+	Type string `json:"type"`
+	From string `json:"from"`
+	//ping-req 要探测的节点
+	Target string `json:"target,omitempty"`
+	Members []member `json:"members"`
+}
+
+var gossip struct {
+	mu sync.Mutex
+	on bool
+	self *member
+	members map[string]*member
+	//轮流探测的顺序
+	probes []string
+}
+
+var gossipClient = &http.Client{}
+
+func stateRank(s string) int {
+	switch s {
+	case MEMBER_SUSPECT:
+		return 1
+	case MEMBER_DEAD:
+		return 2
+	}
+	return 0
+}
+
+//配置了集群,或者指定了-join或-advertise才开启
+func initGossip() {
+	seeds := splitList(*gossipJoin)
+
+	rg := currentRing()
+	if rg == nil && len(seeds) == 0 && *advertiseAddr == "" {
+		return
+	}
+
+	if *serverName == "" {
+		logExit("gossip need -name")
+	}
+
+	addr := *advertiseAddr
+	if addr == "" && rg != nil {
+		addr = rg.Node(*serverName).Addr
+	}
+	if addr == "" {
+		addr = *listenAddr
+	}
+
+	gossip.on = true
+	gossip.members = make(map[string]*member)
+	//重启后的版本一定比之前的大
+	gossip.self = &member{
+		Name: *serverName,
+		Addr: addr,
+		State: MEMBER_ALIVE,
+		Incarnation: time.Now().UnixNano(),
+		Since: time.Now(),
+	}
+	gossip.members[*serverName] = gossip.self
+
+	if rg != nil {
+		gossipAddNodes(rg.m.Nodes)
+	}
+
+	for _, addr := range seeds {
+		go gossipPing(addr)
+	}
+
+	go gossipLoop()
+}
+
+//集群配置里的节点先当作活的
+func gossipAddNodes(nodes []*clusterNode) {
+	if !gossip.on {
+		return
+	}
+
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	for _, n := range nodes {
+		if gossip.members[n.Name] == nil {
+			gossip.members[n.Name] = &member{Name: n.Name, Addr: n.Addr, State: MEMBER_ALIVE, Since: time.Now()}
+		}
+	}
+}
+
+//不在成员表里或者没开gossip都当作活的
+func memberDead(name string) bool {
+	if !gossip.on {
+		return false
+	}
+
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	m := gossip.members[name]
+	return m != nil && m.State == MEMBER_DEAD
+}
+
+func gossipSnapshot() []member {
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	list := make([]member, 0, len(gossip.members))
+	for _, m := range gossip.members {
+		list = append(list, *m)
+	}
+
+	return list
+}
+
+//版本大的为准,版本相同 dead > suspect > alive
+func gossipMerge(list []member) {
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	for _, m := range list {
+		if m.Name == "" {
+			continue
+		}
+
+		if m.Name == gossip.self.Name {
+			//有人怀疑自己,升版本反驳
+			if m.State != MEMBER_ALIVE && m.Incarnation >= gossip.self.Incarnation {
+				gossip.self.Incarnation = m.Incarnation + 1
+				logNotice("Gossip Refute", "state", m.State)
+			}
+			continue
+		}
+
+		e := gossip.members[m.Name]
+		if e == nil {
+			mm := m
+			mm.Since = time.Now()
+			gossip.members[m.Name] = &mm
+			logNotice("Gossip Member Join", "member", m.Name, "addr", m.Addr, "state", m.State)
+			continue
+		}
+
+		if m.Incarnation > e.Incarnation ||
+			(m.Incarnation == e.Incarnation && stateRank(m.State) > stateRank(e.State)) {
+			if e.State != m.State {
+				logNotice("Gossip Member", "member", m.Name, "from", e.State, "to", m.State)
+				e.Since = time.Now()
+			}
+			e.State = m.State
+			e.Addr = m.Addr
+			e.Incarnation = m.Incarnation
+		}
+	}
+}
+
+//本节点自己的判断
+func gossipMark(name string, state string) {
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	//只会往坏的方向变,变好要靠对方升版本
+	e := gossip.members[name]
+	if e == nil || e == gossip.self || stateRank(state) <= stateRank(e.State) {
+		return
+	}
+
+	logNotice("Gossip Member", "member", name, "from", e.State, "to", state)
+	e.State = state
+	e.Since = time.Now()
+}
+
+func gossipLoop() {
+	for range time.Tick(gossipInterval) {
+		gossipExpire()
+
+		target := gossipNext()
+		if target == nil {
+			continue
+		}
+
+		if gossipPing(target.Addr) == nil {
+			continue
+		}
+
+		if gossipIndirectPing(target) {
+			continue
+		}
+
+		gossipMark(target.Name, MEMBER_SUSPECT)
+	}
+}
+
+//怀疑太久的判定死亡
+func gossipExpire() {
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	for _, m := range gossip.members {
+		if m.State == MEMBER_SUSPECT && time.Since(m.Since) > gossipSuspectTimeout {
+			logNotice("Gossip Member", "member", m.Name, "from", m.State, "to", MEMBER_DEAD)
+			m.State = MEMBER_DEAD
+			m.Since = time.Now()
+		}
+	}
+}
+
+//随机顺序轮流探测,死掉的也探测,回来了可以发现
+func gossipNext() *member {
+	gossip.mu.Lock()
+	defer gossip.mu.Unlock()
+
+	for len(gossip.probes) > 0 {
+		name := gossip.probes[0]
+		gossip.probes = gossip.probes[1:]
+
+		m := gossip.members[name]
+		if m != nil {
+			mm := *m
+			return &mm
+		}
+	}
+
+	for name := range gossip.members {
+		if name != gossip.self.Name {
+			gossip.probes = append(gossip.probes, name)
+		}
+	}
+	rand.Shuffle(len(gossip.probes), func(i, j int) {
+		gossip.probes[i], gossip.probes[j] = gossip.probes[j], gossip.probes[i]
+	})
+
+	return nil
+}
+
+func gossipIndirectPing(target *member) bool {
+	gossip.mu.Lock()
+	var helpers []*member
+	for _, m := range gossip.members {
+		if m != gossip.self && m.Name != target.Name && m.State == MEMBER_ALIVE {
+			helpers = append(helpers, m)
+		}
+	}
+	gossip.mu.Unlock()
+
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	if len(helpers) > gossipIndirect {
+		helpers = helpers[:gossipIndirect]
+	}
+
+	if len(helpers) == 0 {
+		return false
+	}
+
+	ok := make(chan bool, len(helpers))
+	for _, h := range helpers {
+		go func(addr string) {
+			msg := &gossipMsg{Type: "ping-req", Target: target.Addr}
+			ok <- gossipSend(addr, msg, 2 * gossipPingTimeout) == nil
+		}(h.Addr)
+	}
+
+	for range helpers {
+		if <-ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func gossipPing(addr string) error {
+	return gossipSend(addr, &gossipMsg{Type: "ping"}, gossipPingTimeout)
+}
+
+func gossipSend(addr string, msg *gossipMsg, timeout time.Duration) error {
+	msg.From = *serverName
+	msg.Members = gossipSnapshot()
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	u := url.URL{Scheme: "http", Host: addr, Path: gossipPath}
+
+	req, err := http.NewRequest("POST", u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	internalHeader(req)
+
+	c := *gossipClient
+	c.Timeout = timeout
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("gossip " + resp.Status)
+	}
+
+	ack := new(gossipMsg)
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(ack)
+	if err != nil {
+		return err
+	}
+
+	gossipMerge(ack.Members)
+	return nil
+}
+
+//节点之间的内部请求
+func internalHeader(req *http.Request) {
+	req.Header.Set("Byfs-Version", "1")
+	signPeer(req.Header, req.Method, req.URL.Path)
+	if pass := authPassword(); pass != "" {
+		req.Header.Set("Byfs-Auth", makeToken(req.URL.Path, pass))
+	}
+}
+
+func gossipHandler(w http.ResponseWriter, r *http.Request) {
+	if !gossip.on {
+		http.Error(w, "Gossip Not Enable", http.StatusNotFound)
+		return
+	}
+
+	msg := new(gossipMsg)
+	err := json.NewDecoder(io.LimitReader(r.Body, 1 << 20)).Decode(msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	gossipMerge(msg.Members)
+
+	switch msg.Type {
+	case "ping":
+	case "ping-req":
+		err := gossipPing(msg.Target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+	default:
+		http.Error(w, "Gossip Type Error", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, &gossipMsg{Type: "ack", From: *serverName, Members: gossipSnapshot()})
+}
+
+func adminMembers(w http.ResponseWriter, r *http.Request) {
+	if !gossip.on {
+		http.Error(w, "Gossip Not Enable", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, gossipSnapshot())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"hash"
+	"errors"
+	"hash/crc32"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errHashRange = errors.New("Hash Offset Beyond End")
+
+func newHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "crc32c":
+		return crc32.New(crc32cTable), nil
+	}
+
+	return nil, errors.New("Hash Algo Not Support: " + algo)
+}
+
+//计算文件或文件的一段(length < 0 表示到文件结尾)的hash
+//整个文件的结果会缓存在元数据里
+func (f *filesystem) Hash(name string, algo string, offset, length int64) (string, error) {
+	h, err := newHash(algo)
+	if err != nil {
+		return "", err
+	}
+
+	if offset < 0 {
+		return "", errors.New("Hash Offset Error")
+	}
+
+	local := f.pathToFile(name)
+	if local == "." {
+		return "", errors.New("File Name Error")
+	}
+	if f.Expired(name) {
+		return "", expiredError("hash", name)
+	}
+
+	var src io.ReaderAt
+	var fi os.FileInfo
+
+	fp, err := f.Open(name)
+	if err == nil {
+		defer fp.Close()
+
+		fi, err = fp.Stat()
+		if err != nil {
+			return "", err
+		}
+		src = fp
+	} else if man := f.erasure(name); man != nil {
+		//纠删码存储的文件按块解码
+		rd, err := ecOpen(cleanPath(name), man)
+		if err != nil {
+			return "", err
+		}
+		defer rd.Close()
+
+		src, fi = rd, ecStat(name, man)
+	} else {
+		return "", err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return "", errors.New("Not Regular File")
+	}
+
+	//正好在结尾的是空的一段,超过结尾的不算
+	if offset > fi.Size() {
+		return "", errHashRange
+	}
+	if length < 0 || offset+length > fi.Size() {
+		length = fi.Size() - offset
+	}
+
+	key := fmt.Sprintf("%s:%d:%d", algo, offset, length)
+
+	sum, ok := f.meta.CachedHash(local, fi, key)
+	if ok {
+		return sum, nil
+	}
+
+	_, err = io.Copy(h, io.NewSectionReader(src, offset, length))
+	if err != nil {
+		return "", err
+	}
+
+	sum = hex.EncodeToString(h.Sum(nil))
+
+	//计算期间文件被改过就不缓存了
+	fi2, err := f.Stat(name)
+	if err != nil {
+		fi2, err = f.erasureStat(name, err)
+	}
+	if err == nil && fi2.Size() == fi.Size() && fi2.ModTime().Equal(fi.ModTime()) {
+		f.meta.CacheHash(local, fi, key, sum)
+	}
+
+	return sum, nil
+}
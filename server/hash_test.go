@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"crypto/md5"
+	"encoding/hex"
+	"path/filepath"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestHashRange(t *testing.T) {
+	f := testRoot(t)
+	os.WriteFile(filepath.Join(f.rootdir, "h"), []byte("hello world"), 0644)
+
+	cases := []struct {
+		offset, length int64
+		want string
+		err bool
+	}{
+		{0, -1, md5Hex("hello world"), false},
+		{6, -1, md5Hex("world"), false},
+		{0, 5, md5Hex("hello"), false},
+		{6, 100, md5Hex("world"), false},
+		{11, -1, md5Hex(""), false},
+		{12, -1, "", true},
+		{100, 5, "", true},
+		{-1, 5, "", true},
+	}
+
+	for _, c := range cases {
+		sum, err := f.Hash("/h", "md5", c.offset, c.length)
+		if (err != nil) != c.err || sum != c.want {
+			t.Errorf("offset %d length %d: got %q %v", c.offset, c.length, sum, err)
+		}
+	}
+
+	if _, err := f.Hash("/h", "md5", 12, -1); err != errHashRange {
+		t.Fatal("want range error", err)
+	}
+}
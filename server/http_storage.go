@@ -4,27 +4,38 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"log"
+	"net"
 	"time"
 	"path"
 	"strings"
+	"hash"
+	"strconv"
+	"net/url"
 	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+	"encoding/json"
 )
 
-func httpServer() {
+func httpServer(ln net.Listener) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", methodRouter)
 
 	s := http.Server{
 		Addr: *listenAddr,
-		Handler:mux,
-		ReadTimeout: time.Second * 300,
-		WriteTimeout: time.Second * 300,
+		Handler: instrumentHTTP(mux),
+		ReadTimeout: *httpReadTimeout,
+		WriteTimeout: *httpWriteTimeout,
 		MaxHeaderBytes: 1024 * 8,
 	}
 
-	err := s.ListenAndServe()
-	log.Fatalln(err)
+	trackServer(&s)
+
+	err := s.Serve(ln)
+	if err != http.ErrServerClosed {
+		logExit("http server error", "err", err)
+	}
 }
 
 func methodRouter(w http.ResponseWriter, r *http.Request) {
@@ -32,7 +43,7 @@ func methodRouter(w http.ResponseWriter, r *http.Request) {
 		err := recover()
 		if err != nil {
 			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
-			log.Println("Error", err, r.URL.Path, r.RemoteAddr)
+			reqLog(r).Fatal("Handler Panic", "err", err)
 		}
 	}()
 
@@ -44,24 +55,116 @@ func methodRouter(w http.ResponseWriter, r *http.Request) {
 		r.URL.Path = "/" + r.URL.Path
 	}
 
+	verifyPeer(r)
+
+	//节点之间的内部接口
+	if strings.HasPrefix(r.URL.Path, "/" + sysDirName + "/") {
+		internalRouter(w, r)
+		return
+	}
+
+	if denyWrite(w, r) {
+		return
+	}
+
+	//命名卷,流协议在连接里选
+	v, p, err := requestVolume(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if v != nil && !isStreamRequest(r) {
+		volumeRouter(w, r, v, p)
+		return
+	}
+
+	//流协议按连接不按路径,不路由
+	if !isStreamRequest(r) && routeRequest(w, r) {
+		return
+	}
+
 	switch (r.Method) {
 	case "GET" :
-		sendFile(w, r)
+		if r.URL.Query().Get("hash") != "" {
+			sendHash(w, r)
+		} else if r.URL.Query().Get("watch") != "" {
+			authHander(w, r, watchEvents)
+		} else if r.URL.Query().Has("versions") {
+			sendVersions(w, r)
+		} else if r.URL.Query().Get("version") != "" {
+			sendVersion(w, r)
+		} else {
+			sendFile(w, r)
+		}
 	case "HEAD" :
 		sendFile(w, r)
 	case "PUT" :
-		authHander(w, r, saveFile)
+		if r.URL.Query().Get("copy-from") != "" {
+			authHander(w, r, copyFrom)
+		} else if isReplica(r) {
+			authHander(w, r, replicaPut)
+		} else {
+			authHander(w, r, saveFile)
+		}
 	case "DELETE" :
 		authHander(w, r, deleteFile)
 	case "POST" :
-		postStream(w, r)
+		if r.URL.Query().Has("append") {
+			authHander(w, r, appendFile)
+		} else if r.URL.Query().Get("restore") != "" {
+			authHander(w, r, restoreVersion)
+		} else {
+			postStream(w, r)
+		}
+	case "COPY" :
+		authHander(w, r, copyTo)
+	case "MOVE" :
+		authHander(w, r, moveTo)
+	case "MKCOL" :
+		authHander(w, r, makeDir)
 	default:
 		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
-		log.Println("Not Allowed Method:", r.Method, r.RemoteAddr)
+		reqLog(r).Notice("Not Allowed Method")
+	}
+}
+
+func internalRouter(w http.ResponseWriter, r *http.Request) {
+	//只给其它节点用
+	if !isReplica(r) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		reqLog(r).Notice("Internal Request Not From Peer")
+		return
+	}
+
+	//分片和清单的修改按副本写入算
+	if (r.URL.Path == shardPath || r.URL.Path == manifestPath) && (r.Method == "PUT" || r.Method == "DELETE") {
+		if err := writeDenied(true); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			reqLog(r).Notice(err.Error())
+			return
+		}
+	}
+
+	switch r.URL.Path {
+	case gossipPath :
+		authHander(w, r, gossipHandler)
+	case merklePath :
+		authHander(w, r, merkleHandler)
+	case shardPath :
+		authHander(w, r, shardHandler)
+	case manifestPath :
+		authHander(w, r, manifestHandler)
+	default:
+		http.NotFound(w, r)
 	}
 }
 
 func authHander(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	authWith(w, r, requestSecret, handler)
+}
+
+//secret按请求头给出用的密钥和密码
+func authWith(w http.ResponseWriter, r *http.Request, secret func(http.Header) (string, string, bool), handler func(http.ResponseWriter, *http.Request)) {
 	version := r.Header.Get("Byfs-Version")
 
 	if version != "1" {
@@ -69,13 +172,22 @@ func authHander(w http.ResponseWriter, r *http.Request, handler func(http.Respon
 		return
 	}
 
-	if *password != "" {
+	_, pass, ok := secret(r.Header)
+	if !ok {
+		authFailed("http")
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		reqLog(r).Notice("Auth Error Unknown Key", "key", r.Header.Get(keyHeader))
+		return
+	}
+
+	if pass != "" {
 		token := r.Header.Get("Byfs-Auth")
 
-		ok := tokenAuth(r.URL.Path, *password, token);
+		ok := tokenAuth(r.URL.Path, pass, token);
 		if !ok {
+			authFailed("http")
 			http.Error(w, "403 Forbidden", http.StatusForbidden)
-			log.Println("Auth Error", r.RemoteAddr)
+			reqLog(r).Notice("Auth Error")
 			return
 		}
 	}
@@ -83,11 +195,54 @@ func authHander(w http.ResponseWriter, r *http.Request, handler func(http.Respon
 	handler(w, r)
 }
 
+//复制和改名的目标路径另外要一个token
+const destAuthHeader = "Byfs-Dest-Auth"
+
+func destAuth(w http.ResponseWriter, r *http.Request, secret func(http.Header) (string, string, bool), to string) bool {
+	if isReplica(r) {
+		return true
+	}
+
+	_, pass, _ := secret(r.Header)
+	if pass == "" || tokenAuth(to, pass, r.Header.Get(destAuthHeader)) {
+		return true
+	}
+
+	authFailed("http")
+	http.Error(w, "403 Forbidden", http.StatusForbidden)
+	reqLog(r).Notice("Auth Error Destination", "to", to)
+	return false
+}
+
 func sendFile(w http.ResponseWriter, r *http.Request) {
-	f, err := fs.Open(r.URL.Path)
+	vfs := requestFS(r)
+	//集群和纠删码只在默认的根目录
+	root := vfs == fs
+
+	if vfs.Expired(r.URL.Path) {
+		http.NotFound(w, r)
+		return
+	}
+
+	if root && r.Method == "GET" && quorumRead(w, r) {
+		return
+	}
+
+	if root && currentRing() != nil {
+		setVersionHeader(w.Header(), localVersion(r.URL.Path))
+	}
+
+	f, err := vfs.Open(r.URL.Path)
 	if err != nil {
+		if root {
+			if man := ecLoad(r.URL.Path); man != nil {
+				ecServe(w, r, cleanPath(r.URL.Path), man)
+				return
+			}
+		}
+
 		http.NotFound(w, r)
-		log.Println(err, r.RemoteAddr)
+		reqLog(r).Debug("Not Found", "err", err)
 		return
 	}
 	defer f.Close()
@@ -103,33 +258,409 @@ func sendFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isReplica(r) {
+		w.Header().Set(mtimeHeader, strconv.FormatInt(d.ModTime().UnixNano(), 10))
+	}
+
 	http.ServeContent(w, r, d.Name(), d.ModTime(), f)
 }
 
+//GET /file?hash=sha256&offset=0&length=100
+func sendHash(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	var offset, length int64 = 0, -1
+	var err error
+
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.ParseInt(v, 10, 64)
+	}
+	if v := q.Get("length"); v != "" && err == nil {
+		length, err = strconv.ParseInt(v, 10, 64)
+	}
+	if err != nil {
+		http.Error(w, "Range Error", http.StatusBadRequest)
+		return
+	}
+
+	sum, err := requestFS(r).Hash(r.URL.Path, q.Get("hash"), offset, length)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else if err == errHashRange {
+			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		reqLog(r).Notice("Hash Error", "err", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprint(w, sum)
+}
+
+//GET /dir?watch=1 Server-Sent Events
+func watchEvents(w http.ResponseWriter, r *http.Request) {
+	serveWatch(w, r, requestFS(r).watch)
+}
+
+func serveWatch(w http.ResponseWriter, r *http.Request, hub *watchHub) {
+	rc := http.NewResponseController(w)
+
+	//长连接不受WriteTimeout限制
+	err := rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		http.Error(w, "Watch Not Support", http.StatusInternalServerError)
+		return
+	}
+
+	wt := hub.Subscribe(r.URL.Path)
+	defer hub.Unsubscribe(wt)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	ping := time.NewTicker(watchPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case e := <-wt.C:
+			data, _ := json.Marshal(e)
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Op, data)
+		case <-ping.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		//退出时不等订阅方断开
+		case <-streams.stop:
+			return
+		}
+
+		if err == nil && len(wt.C) == 0 {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func saveFile(w http.ResponseWriter, r *http.Request) {
-	dir, _ := path.Split(fs.pathToFile(r.URL.Path))
+	vfs := requestFS(r)
+	//卷只是本地目录,没有集群、过期、纠删码和去重
+	root := vfs == fs
+
+	var q *quorum
+	var err error
+	if root {
+		q, err = requestQuorum(r)
+		if err != nil {
+			fmt.Fprint(w, "Quorum Error", err)
+			return
+		}
+	}
+
+	if !root && r.Header.Get(expiresHeader) != "" {
+		fmt.Fprint(w, "Volume Not Support Expires")
+		return
+	}
+
+	expires, err := parseExpires(r.Header.Get(expiresHeader))
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+
+	if root {
+		reapIfExpired(r.URL.Path, isReplica(r))
+	}
+
+	dir, _ := path.Split(vfs.pathToFile(r.URL.Path))
 	if dir != "" {
-		err := os.MkdirAll(dir, fileMode)
+		err := os.MkdirAll(dir, vfs.fileMode)
 		if err != nil {
 			fmt.Fprint(w, "Mkdir Error", err)
-			log.Println("[Notice]", "Mkdir Error", err, r.URL.Path, r.RemoteAddr)
+			reqLog(r).Notice("Mkdir Error", "err", err)
 			return
 		}
 	}
 
-	f, err := fs.OpenFile(r.URL.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	//纠删码存储的文件没有普通文件,一样不能覆盖
+	if root && ecLoad(r.URL.Path) != nil {
+		fmt.Fprint(w, "Open File Error", os.ErrExist)
+		return
+	}
+
+	dedup := root && dedupFor(r.URL.Path)
+	declared := strings.ToLower(r.Header.Get(sha256Header))
+	key := r.Header.Get(keyHeader)
+
+	f, err := vfs.OpenFile(r.URL.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
 		fmt.Fprint(w, "Open File Error", err)
-		log.Println("[Notice]", "Open File Error", err, r.URL.Path, r.RemoteAddr)
+		reqLog(r).Notice("Open File Error", "err", err)
 		return
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, r.Body)
+	//长度已知的先整个记账,不知道的边写边记
+	charged := r.ContentLength
+	if charged < 0 {
+		charged = 0
+	}
+	err = vfs.quota.charge(f.path, key, charged, 1)
+	if err != nil {
+		f.ghost = true
+		quotaFail(w, r, err)
+		return
+	}
+	f.owner = key
+	vfs.setOwner(f.name, key)
+
+	qw := newQuotaWriter(f)
+	dst := io.Writer(f)
+	if r.ContentLength < 0 {
+		dst = qw
+	}
+
+	var h hash.Hash
+	body := io.Reader(r.Body)
+	if dedup {
+		h = sha256.New()
+		body = io.TeeReader(r.Body, h)
+	}
+
+	_, err = io.Copy(dst, body)
+	if err == nil {
+		err = qw.err
+	}
 	if err != nil {
 		f.ghost = true
+		vfs.quota.adjust(f.path, key, -charged - qw.size, -1)
+		if isQuotaError(err) {
+			quotaFail(w, r, err)
+			return
+		}
 		fmt.Fprint(w, "Save Data Error", err)
-		log.Println("[Notice]", "Copy Error", err, r.URL.Path, r.RemoteAddr)
+		reqLog(r).Notice("Copy Error", "err", err)
+		return
+	}
+
+	var sum string
+	if h != nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+		if declared != "" && declared != sum {
+			f.ghost = true
+			fs.quota.adjust(f.path, key, -charged - qw.size, -1)
+			fmt.Fprint(w, "Save Data Error Hash Mismatch")
+			reqLog(r).Notice("Hash Mismatch", "declared", declared, "actual", sum)
+			return
+		}
+	}
+
+	vfs.watch.Publish(EVENT_WRITE, f.path, "")
+
+	if !root {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	if expires > 0 {
+		fs.SetExpires(f.path, expires)
+	}
+
+	//冷数据的大文件改成分片存储,分片已经分散到各节点,不再走副本
+	if spec := erasureFor(f.path); spec != nil && !isReplica(r) {
+		fi, err := f.Stat()
+		if err == nil && fi.Size() >= *erasureMin {
+			err = ecStore(f.path, spec)
+			if err != nil {
+				f.ghost = true
+				fs.quota.adjust(f.path, key, -fi.Size(), -1)
+				fmt.Fprint(w, "Erasure Error", err)
+				reqLog(r).Notice("Erasure Error", "err", err)
+				return
+			}
+
+			//分片存储的不在本地目录里,和后台扫描一样不计入配额
+			fs.quota.adjust(f.path, key, -fi.Size(), -1)
+
+			fmt.Fprint(w, "Success")
+			return
+		}
+	}
+
+	//去重失败也已经按普通文件存好了
+	if sum != "" {
+		err = fs.AdoptBlob(f.path, sum)
+		if err != nil {
+			reqLog(r).Warning("Dedup Error", "err", err)
+		}
+	}
+
+	saveDone(w, r, q, f.path)
+}
+
+//本地写好后更新版本并复制
+func saveDone(w http.ResponseWriter, r *http.Request, q *quorum, p string) {
+	v := bumpVersion(p)
+	setVersionHeader(w.Header(), v)
+
+	err := quorumWrite(q, r, &replOp{Op: REPL_PUT, Path: p})
+	if !quorumResult(w, r, err) {
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+//本地已经写成功,法定数没达到的告诉客户端
+func quorumResult(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == errConflict {
+		w.Header().Set(conflictHeader, "1")
+		http.Error(w, "Write Conflict", http.StatusConflict)
+		return false
+	}
+
+	if err != nil {
+		fmt.Fprint(w, "Quorum Error ", err)
+		reqLog(r).Notice("Quorum Error", "err", err)
+		return false
+	}
+
+	return true
+}
+
+//副本直接覆盖,带版本的比较过版本再决定
+func replicaPut(w http.ResponseWriter, r *http.Request) {
+	v, apply, err := replicaAccept(r)
+	if err == errConflict {
+		http.Error(w, "Version Conflict", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Fprint(w, "Version Error", err)
+		return
+	}
+	if !apply {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	//带了sha256的没有body,内容从本地的blob库取,Replace里会再链接回去
+	body := io.Reader(r.Body)
+	if sum := strings.ToLower(r.Header.Get(sha256Header)); sum != "" {
+		var bp *os.File
+		if dedupFor(r.URL.Path) && fs.blobs.Has(sum) {
+			bp, err = os.Open(fs.blobs.path(sum))
+		}
+		if bp == nil {
+			http.Error(w, "Blob Not Found", http.StatusPreconditionFailed)
+			return
+		}
+		defer bp.Close()
+		body = bp
+	}
+
+	err = fs.Replace(r.URL.Path, body)
+	if err != nil {
+		fmt.Fprint(w, "Save Data Error", err)
+		reqLog(r).Notice("Replica Save Error", "err", err)
+		return
+	}
+
+	applyMtime(r.URL.Path, r.Header)
+	if v != nil {
+		setVersion(r.URL.Path, v)
+	}
+
+	expires, _ := parseExpires(r.Header.Get(expiresHeader))
+	fs.SetExpires(r.URL.Path, expires)
+
+	fmt.Fprint(w, "Success")
+}
+
+//POST /file?append 整个body一次性追加,Byfs-Offset返回写入的位置
+func appendFile(w http.ResponseWriter, r *http.Request) {
+	vfs := requestFS(r)
+
+	//已过期的从头开始
+	if vfs == fs {
+		reapIfExpired(r.URL.Path, isReplica(r))
+	}
+
+	dir, _ := path.Split(vfs.pathToFile(r.URL.Path))
+	if dir != "" {
+		err := os.MkdirAll(dir, vfs.fileMode)
+		if err != nil {
+			fmt.Fprint(w, "Mkdir Error", err)
+			reqLog(r).Notice("Mkdir Error", "err", err)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAppendSize()))
+	if err != nil {
+		fmt.Fprint(w, "Read Data Error", err)
+		reqLog(r).Notice("Read Data Error", "err", err)
+		return
+	}
+
+	//副本先比较版本,重放的PUT已经带上这次追加的就不再追加
+	var v *objVersion
+	at := int64(-1)
+	if vfs == fs && isReplica(r) {
+		var apply bool
+		v, apply, err = replicaAccept(r)
+		if err == errConflict {
+			http.Error(w, "Version Conflict", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			fmt.Fprint(w, "Version Error", err)
+			return
+		}
+		if !apply {
+			fmt.Fprint(w, "Success")
+			return
+		}
+
+		end, _ := strconv.ParseInt(r.Header.Get(appendEndHeader), 10, 64)
+		if end > 0 {
+			at = end - int64(len(data))
+		}
+	}
+
+	off, err := vfs.AppendAt(r.URL.Path, data, r.Header.Get(keyHeader), at)
+	if err != nil {
+		fmt.Fprint(w, "Append Error", err)
+		reqLog(r).Notice("Append Error", "err", err)
+		return
+	}
+
+	w.Header().Set("Byfs-Offset", strconv.FormatInt(off, 10))
+
+	//卷不复制
+	if vfs != fs {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	op := &replOp{Op: REPL_APPEND, Path: cleanPath(r.URL.Path), Data: data, End: off + int64(len(data))}
+	if isReplica(r) {
+		applyMtime(op.Path, r.Header)
+		if v != nil {
+			setVersion(op.Path, v)
+		}
+	} else if v := bumpVersion(op.Path); v != nil {
+		op.Version, op.VersionTime = v.vv, v.time
+	}
+
+	if !replicaResult(w, r, replicate(r, op)) {
 		return
 	}
 
@@ -137,29 +668,307 @@ func saveFile(w http.ResponseWriter, r *http.Request) {
 }
 
 func deleteFile(w http.ResponseWriter, r *http.Request) {
-	name := fs.pathToFile(r.URL.Path)
-	if name == "." {
-		fmt.Fprint(w, "File Name Error")
+	//卷没有副本、纠删码、回收站和墓碑
+	if vfs := requestFS(r); vfs != fs {
+		err := vfs.Remove(r.URL.Path)
+		if err != nil {
+			fmt.Fprint(w, "Delete", r.URL.Path, "Fail", err)
+			reqLog(r).Notice("Delete Fail", "err", err)
+			return
+		}
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	//递归删除只给副本用
+	recursive := isReplica(r) && r.Header.Get("Byfs-Recursive") == "1"
+
+	if isReplica(r) && !recursive {
+		replicaDelete(w, r)
+		return
+	}
+
+	if man := ecLoad(r.URL.Path); man != nil && !recursive {
+		ecDelete(cleanPath(r.URL.Path), man)
+		fmt.Fprint(w, "Success")
 		return
 	}
 
-	err := os.Remove(name)
+	q, err := requestQuorum(r)
 	if err != nil {
+		fmt.Fprint(w, "Quorum Error", err)
+		return
+	}
+
+	op := &replOp{Op: REPL_DELETE, Path: cleanPath(r.URL.Path)}
+
+	if recursive {
+		err = fs.RemoveAll(r.URL.Path)
+	} else {
+		var v *objVersion
+		v, err = versionedRemove(r.URL.Path, fs.SoftRemove)
+		if v != nil {
+			op.Version, op.VersionTime = v.vv, v.time
+		}
+	}
+
+	if err != nil && !replicaIgnore(r, err) {
 		fmt.Fprint(w, "Delete", r.URL.Path, "Fail", err)
-		log.Println("[Notice]", "Delete Fail", err, r.URL.Path, r.RemoteAddr)
+		reqLog(r).Notice("Delete Fail", "err", err)
+		return
+	}
+
+	err = quorumWrite(q, r, op)
+	if !quorumResult(w, r, err) {
+		return
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+//副本删除后留下同样版本的墓碑
+func replicaDelete(w http.ResponseWriter, r *http.Request) {
+	v, apply, err := replicaAccept(r)
+	if err == errConflict {
+		http.Error(w, "Version Conflict", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Fprint(w, "Version Error", err)
+		return
+	}
+	if !apply {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	err = fs.Remove(r.URL.Path)
+	if err != nil && !replicaIgnore(r, err) {
+		fmt.Fprint(w, "Delete", r.URL.Path, "Fail", err)
+		reqLog(r).Notice("Delete Fail", "err", err)
+		return
+	}
+
+	if v != nil {
+		v.deleted = true
+		setVersion(r.URL.Path, v)
+	}
+
+	fmt.Fprint(w, "Success")
+}
+
+//MKCOL /dir 副本会自动建上级目录
+func makeDir(w http.ResponseWriter, r *http.Request) {
+	vfs := requestFS(r)
+
+	var err error
+	if isReplica(r) {
+		err = vfs.MkdirAll(r.URL.Path)
+	} else {
+		err = vfs.Mkdir(r.URL.Path)
+	}
+
+	if err != nil && !replicaIgnore(r, err) {
+		fmt.Fprint(w, "Mkdir Error", err)
+		reqLog(r).Notice("Mkdir Error", "err", err)
+		return
+	}
+
+	if vfs != fs {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	err = replicate(r, &replOp{Op: REPL_MKDIR, Path: cleanPath(r.URL.Path)})
+	if !replicaResult(w, r, err) {
+		return
+	}
+	fmt.Fprint(w, "Success")
+}
+
+//MOVE /src 目标在Destination头里
+func moveTo(w http.ResponseWriter, r *http.Request) {
+	to := destination(r)
+	if to == "" {
+		http.Error(w, "Destination Need", http.StatusBadRequest)
+		return
+	}
+	if !destAuth(w, r, requestSecret, to) {
+		return
+	}
+
+	serveMove(w, r, to)
+}
+
+func serveMove(w http.ResponseWriter, r *http.Request, to string) {
+	vfs := requestFS(r)
+
+	var err error
+	if isReplica(r) {
+		err = vfs.ReplicaRename(r.URL.Path, to)
+	} else {
+		err = vfs.Rename(r.URL.Path, to)
+	}
+	if replicaSourceMissing(w, r, r.URL.Path, err) {
+		return
+	}
+	if isQuotaError(err) {
+		quotaFail(w, r, err)
+		return
+	}
+	if err != nil && !replicaIgnore(r, err) {
+		fmt.Fprint(w, "Rename Error", err)
+		reqLog(r).Notice("Rename Error", "to", to, "err", err)
+		return
+	}
+
+	if vfs != fs {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	err = replicate(r, &replOp{Op: REPL_RENAME, Path: cleanPath(r.URL.Path), To: cleanPath(to)})
+	if !replicaResult(w, r, err) {
+		return
+	}
+	fmt.Fprint(w, "Success")
+}
+
+//Destination头可以是完整URL
+func destination(r *http.Request) string {
+	to := r.Header.Get("Destination")
+	if u, err := url.Parse(to); err == nil {
+		to = u.Path
+	}
+
+	return to
+}
+
+//COPY /src 目标在Destination头里
+func copyTo(w http.ResponseWriter, r *http.Request) {
+	to := destination(r)
+	if to == "" {
+		http.Error(w, "Destination Need", http.StatusBadRequest)
+		return
+	}
+	if !destAuth(w, r, requestSecret, to) {
+		return
+	}
+
+	serveCopy(w, r, r.URL.Path, to)
+}
+
+//PUT /dst?copy-from=/src
+func copyFrom(w http.ResponseWriter, r *http.Request) {
+	serveCopy(w, r, r.URL.Query().Get("copy-from"), r.URL.Path)
+}
+
+func serveCopy(w http.ResponseWriter, r *http.Request, name, to string) {
+	vfs := requestFS(r)
+
+	//目标已过期的当作不存在
+	if vfs == fs {
+		reapIfExpired(to, isReplica(r))
+	}
+
+	dir, _ := path.Split(vfs.pathToFile(to))
+	if dir != "" {
+		err := os.MkdirAll(dir, vfs.fileMode)
+		if err != nil {
+			fmt.Fprint(w, "Mkdir Error", err)
+			reqLog(r).Notice("Mkdir Error", "to", to, "err", err)
+			return
+		}
+	}
+
+	var err error
+	if isReplica(r) {
+		err = vfs.ReplicaCopy(name, to)
+	} else {
+		err = vfs.Copy(name, to)
+	}
+	if replicaSourceMissing(w, r, name, err) {
+		return
+	}
+	if isQuotaError(err) {
+		quotaFail(w, r, err)
+		return
+	}
+	if err != nil && !replicaIgnore(r, err) {
+		fmt.Fprint(w, "Copy Error", err)
+		reqLog(r).Notice("Copy Error", "from", name, "to", to, "err", err)
 		return
 	}
 
+	if vfs != fs {
+		fmt.Fprint(w, "Success")
+		return
+	}
+
+	err = replicate(r, &replOp{Op: REPL_COPY, Path: cleanPath(name), To: cleanPath(to)})
+	if !replicaResult(w, r, err) {
+		return
+	}
 	fmt.Fprint(w, "Success")
 }
 
+//超出配额
+func quotaFail(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	reqLog(r).Notice(err.Error())
+}
+
+func isStreamRequest(r *http.Request) bool {
+	return r.Method == "POST" && r.Header.Get("Upgrade") == "Byfs-Stream"
+}
+
 func postStream(w http.ResponseWriter, r *http.Request) {
-	f, ok := FconnInit(w, r, *password)
+	var v *volume
+	lookup := requestSecret
+	if name := r.Header.Get(volumeHeader); name != "" {
+		v = volumes[name]
+		lookup = v.secret
+	}
+
+	key, secret, ok := lookup(r.Header)
+	if !ok {
+		authFailed("http")
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		reqLog(r).Notice("Auth Error Unknown Key", "key", r.Header.Get(keyHeader))
+		return
+	}
+
+	//退出中的新连接直接拒绝,客户端去连别的节点或稍后重试
+	if isStopping() {
+		http.Error(w, "Server Shutting Down", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, ok := FconnInit(w, r, secret)
 	if !ok {
 		return
 	}
+	f.key = key
+	f.vol = v
+	f.id = requestID(r)
+	f.log = logRoot.With("conn", f.id, "remote", r.RemoteAddr)
 
-	log.Println("link")
+	if !streamRegister(f) {
+		f.sendServerClose()
+		f.drain()
+		f.conn.Close()
+		return
+	}
+	defer streamUnregister(f)
+
+	f.replica = isReplica(r)
+
+	start := time.Now()
+	f.log.Debug("stream open", "replica", f.replica, "key", key)
+	defer func() {
+		f.log.Debug("stream closed", "duration_ms", ms(time.Since(start)),
+			"bytes_in", atomic.LoadInt64(&f.cc.in), "bytes_out", atomic.LoadInt64(&f.cc.out))
+	}()
 
 	defer f.close()
 
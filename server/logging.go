@@ -0,0 +1,222 @@
+package main
+
+import (
+	"os"
+	"flag"
+	"time"
+	"errors"
+	"context"
+	"strings"
+	"net/http"
+	"log/slog"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+//分级的结构化日志,logfmt或JSON
+//原来的[Notice]/[Warning]/[Fatal]对应NOTICE/WARNING/FATAL三级,FATAL只是连接级的错误,启动失败才退出
+//HTTP请求带req,流连接带conn,都有remote,流指令再带op和path
+
+var logLevelFlag = flag.String("log-level", "info", "Log Level (debug|info|notice|warning|fatal)")
+var logFormat = flag.String("log-format", "logfmt", "Log Format (logfmt|json)")
+
+const (
+	levelDebug = slog.LevelDebug
+	levelInfo = slog.LevelInfo
+	levelNotice = slog.Level(2)
+	levelWarning = slog.LevelWarn
+	levelFatal = slog.LevelError
+)
+
+var levelNames = map[string]slog.Level{
+	"debug": levelDebug,
+	"info": levelInfo,
+	"notice": levelNotice,
+	"warning": levelWarning,
+	"fatal": levelFatal,
+}
+
+//SIGHUP时可以改
+var logLevel = new(slog.LevelVar)
+
+type logger struct {
+	l *slog.Logger
+}
+
+//没有请求和连接的日志用这个
+var logRoot = logger{slog.Default()}
+
+func (g logger) With(args ...any) logger {
+	return logger{g.l.With(args...)}
+}
+
+func (g logger) log(level slog.Level, msg string, args []any) {
+	g.l.Log(context.Background(), level, msg, args...)
+}
+
+func (g logger) Debug(msg string, args ...any) {
+	g.log(levelDebug, msg, args)
+}
+
+func (g logger) Info(msg string, args ...any) {
+	g.log(levelInfo, msg, args)
+}
+
+func (g logger) Notice(msg string, args ...any) {
+	g.log(levelNotice, msg, args)
+}
+
+func (g logger) Warning(msg string, args ...any) {
+	g.log(levelWarning, msg, args)
+}
+
+func (g logger) Fatal(msg string, args ...any) {
+	g.log(levelFatal, msg, args)
+}
+
+func logInfo(msg string, args ...any) {
+	logRoot.Info(msg, args...)
+}
+
+func logNotice(msg string, args ...any) {
+	logRoot.Notice(msg, args...)
+}
+
+func logWarning(msg string, args ...any) {
+	logRoot.Warning(msg, args...)
+}
+
+//启动时的错误,记下来就退出
+func logExit(msg string, args ...any) {
+	logRoot.Fatal(msg, args...)
+	os.Exit(1)
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	level, ok := levelNames[strings.ToLower(name)]
+	if !ok {
+		return 0, errors.New("log-level error " + name)
+	}
+	return level, nil
+}
+
+//日志文件换掉时handler不用重建
+type logSink struct{}
+
+func (logSink) Write(b []byte) (int, error) {
+	logOut.mu.Lock()
+	defer logOut.mu.Unlock()
+
+	if logOut.fp != nil {
+		return logOut.fp.Write(b)
+	}
+	return os.Stderr.Write(b)
+}
+
+//在initConfig里,参数检查过以后
+func initLogging() {
+	level, _ := parseLevel(*logLevelFlag)
+	logLevel.Set(level)
+
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.LevelKey && len(groups) == 0 {
+				a.Value = slog.StringValue(levelName(a.Value.Any().(slog.Level)))
+			}
+			return a
+		},
+	}
+
+	var h slog.Handler
+	if *logFormat == "json" {
+		h = slog.NewJSONHandler(logSink{}, opts)
+	} else {
+		h = slog.NewTextHandler(logSink{}, opts)
+	}
+
+	l := slog.New(countHandler{h})
+	slog.SetDefault(l)
+	logRoot = logger{l}
+}
+
+func levelName(level slog.Level) string {
+	switch {
+	case level >= levelFatal:
+		return "FATAL"
+	case level >= levelWarning:
+		return "WARNING"
+	case level >= levelNotice:
+		return "NOTICE"
+	case level >= levelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+//按级别统计错误,级别低于设置的也要数
+type countHandler struct {
+	slog.Handler
+}
+
+func (h countHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= levelNotice || h.Handler.Enabled(ctx, level)
+}
+
+func (h countHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= levelNotice {
+		metrics.errors.Inc(strings.ToLower(levelName(r.Level)))
+	}
+	if !h.Handler.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h countHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return countHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h countHandler) WithGroup(name string) slog.Handler {
+	return countHandler{h.Handler.WithGroup(name)}
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+//回复里带上请求ID,方便对日志
+const requestIDHeader = "Byfs-Request-Id"
+
+type logKey struct{}
+
+type requestLog struct {
+	id string
+	log logger
+}
+
+func withRequestLog(r *http.Request) (*http.Request, *requestLog) {
+	id := newID()
+	rl := &requestLog{id, logRoot.With("req", id, "remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)}
+	return r.WithContext(context.WithValue(r.Context(), logKey{}, rl)), rl
+}
+
+func reqLog(r *http.Request) logger {
+	if rl, ok := r.Context().Value(logKey{}).(*requestLog); ok {
+		return rl.log
+	}
+	return logRoot.With("remote", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+}
+
+func requestID(r *http.Request) string {
+	if rl, ok := r.Context().Value(logKey{}).(*requestLog); ok {
+		return rl.id
+	}
+	return newID()
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,608 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"strings"
+	"path/filepath"
+	"encoding/json"
+)
+
+//系统目录,客户端不可见
+const sysDirName = ".byfs"
+
+//文件元数据,和文件路径一一对应
+type metadata struct {
+	//校验缓存时的文件大小和修改时间
+	Size int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+	Hash map[string]string `json:"hash,omitempty"`
+	//集群模式下的版本,Deleted表示这是删除后留下的墓碑
+	Version versionVector `json:"version,omitempty"`
+	VersionTime int64 `json:"vtime,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+	//纠删码存储的分片清单,这时没有普通文件
+	Erasure *ecManifest `json:"erasure,omitempty"`
+	//去重存储时内容的sha256,文件是blob的硬链接
+	Blob string `json:"blob,omitempty"`
+	//过期时间(unix秒),0不过期
+	Expires int64 `json:"expires,omitempty"`
+	//创建文件时用的访问密钥,按密钥的配额用
+	Owner string `json:"owner,omitempty"`
+}
+
+//同步保存在 .byfs/metadata 下的镜像目录里,每一级路径一个目录
+//条目自己的元数据在它目录下的 .meta,子条目里以.开头的名字前面再加一个.,不会和 .meta 重名
+type metaStore struct {
+	mu sync.Mutex
+	rootdir string
+	metadir string
+	//有过期时间的文件, 本地路径 -> unix秒, 过期清理只看这里
+	expires map[string]int64
+}
+
+func newMetaStore(root string) *metaStore {
+	return &metaStore{
+		rootdir: root,
+		metadir: filepath.Join(root, sysDirName, "metadata"),
+		expires: make(map[string]int64),
+	}
+}
+
+//条目自己的元数据文件名
+const metaSelf = ".meta"
+
+func metaEscape(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return "." + name
+	}
+	return name
+}
+
+func metaUnescape(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return name[1:]
+	}
+	return name
+}
+
+//相对路径每一级转义
+func metaEscapeRel(rel string) string {
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i := range parts {
+		parts[i] = metaEscape(parts[i])
+	}
+	return filepath.Join(parts...)
+}
+
+func metaUnescapeRel(rel string) string {
+	if rel == "." {
+		return rel
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	for i := range parts {
+		parts[i] = metaUnescape(parts[i])
+	}
+	return filepath.Join(parts...)
+}
+
+//name是已经转换过的本地路径
+//元数据在 name/.meta, 目录下的文件元数据都在 name/ 下
+func (m *metaStore) metaPath(name string) string {
+	d := m.metaDir(name)
+	if d == "" {
+		return ""
+	}
+
+	return filepath.Join(d, metaSelf)
+}
+
+func (m *metaStore) metaDir(name string) string {
+	rel, err := filepath.Rel(m.rootdir, name)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return ""
+	}
+
+	return filepath.Join(m.metadir, metaEscapeRel(rel))
+}
+
+//d下所有的元数据文件,rel是条目相对d的本地路径,d自己是"."
+func walkMeta(d string, fn func(q, rel string)) error {
+	err := filepath.Walk(d, func(q string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Name() != metaSelf {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d, filepath.Dir(q))
+		if err == nil {
+			fn(q, metaUnescapeRel(rel))
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (m *metaStore) Get(name string) *metadata {
+	p := m.metaPath(name)
+	if p == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.read(p)
+}
+
+func (m *metaStore) read(p string) *metadata {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+
+	md := new(metadata)
+	err = json.Unmarshal(data, md)
+	if err != nil {
+		return nil
+	}
+
+	return md
+}
+
+func (m *metaStore) Put(name string, md *metadata) error {
+	p := m.metaPath(name)
+	if p == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.write(p, md)
+	if err == nil {
+		m.index(name, md)
+	}
+	return err
+}
+
+//读改写一次完成,没有元数据时fn收到的是空的,fn返回false不保存
+func (m *metaStore) Update(name string, fn func(md *metadata) bool) error {
+	p := m.metaPath(name)
+	if p == "" {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	md := m.read(p)
+	if md == nil {
+		md = new(metadata)
+	}
+	if !fn(md) {
+		return nil
+	}
+
+	err := m.write(p, md)
+	if err == nil {
+		m.index(name, md)
+	}
+	return err
+}
+
+func (m *metaStore) write(p string, md *metadata) error {
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, p)
+}
+
+//删除文件或整个目录的元数据
+func (m *metaStore) Remove(name string) {
+	p := m.metaPath(name)
+	if p == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	os.RemoveAll(m.metaDir(name))
+	m.unindex(name)
+}
+
+//文件或目录下所有文件的元数据
+func (m *metaStore) Each(name string, fn func(md *metadata)) {
+	d := m.metaDir(name)
+	if d == "" {
+		return
+	}
+
+	m.EachIn(d, fn)
+}
+
+//base是MoveOut保存的位置
+func (m *metaStore) EachIn(base string, fn func(md *metadata)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	walkMeta(base, func(q, rel string) {
+		if md := m.read(q); md != nil {
+			fn(md)
+		}
+	})
+}
+
+//MoveOut保存的某个文件的元数据,rel是相对于移出去的文件的路径
+func (m *metaStore) GetIn(base, rel string) *metadata {
+	if rel != "." {
+		base = filepath.Join(base, metaEscapeRel(rel))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.read(filepath.Join(base, metaSelf))
+}
+
+//有元数据的子条目名,列目录时补纠删码的文件用
+func (m *metaStore) Children(name string) []string {
+	d := m.metaDir(name)
+	if d == "" {
+		if name != m.rootdir {
+			return nil
+		}
+		d = m.metadir
+	}
+
+	list, err := os.ReadDir(d)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, ent := range list {
+		if !ent.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(d, ent.Name(), metaSelf)); err == nil {
+			names = append(names, metaUnescape(ent.Name()))
+		}
+	}
+	return names
+}
+
+//元数据移出去单独保存(回收站),base是保存的目录
+func (m *metaStore) MoveOut(name, base string) {
+	d := m.metaDir(name)
+	if d == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	os.Rename(d, base)
+	m.unindex(name)
+}
+
+//MoveOut的反向,原来的元数据会被替换
+func (m *metaStore) MoveIn(base, name string) {
+	d := m.metaDir(name)
+	if d == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	os.RemoveAll(d)
+	os.MkdirAll(filepath.Dir(d), 0755)
+	os.Rename(base, d)
+
+	m.unindex(name)
+	m.indexDir(name)
+}
+
+func (m *metaStore) Rename(name, to string) {
+	d := m.metaDir(name)
+	t := m.metaDir(to)
+	if d == "" || t == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	os.RemoveAll(t)
+	m.unindex(to)
+
+	if _, err := os.Stat(d); err != nil {
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(t), 0755)
+	os.Rename(d, t)
+
+	for k, exp := range m.expires {
+		if k == name || strings.HasPrefix(k, name + string(filepath.Separator)) {
+			delete(m.expires, k)
+			m.expires[to + k[len(name):]] = exp
+		}
+	}
+}
+
+//旧的布局是 name.meta 加 name/,名字叫 x.meta 的目录和文件x的元数据会撞在一起
+//启动时把根目录和回收站里的都搬到新布局
+func (f *filesystem) migrateMeta() {
+	moved, failed := 0, 0
+	count := func(n, e int) {
+		moved += n
+		failed += e
+	}
+
+	old := filepath.Join(f.rootdir, sysDirName, "meta")
+	if _, err := os.Lstat(old); err == nil {
+		n, e := moveMetaTree(old, f.meta.metadir)
+		if e == 0 {
+			os.RemoveAll(old)
+		}
+		count(n, e)
+	}
+
+	items, _ := os.ReadDir(f.trashRoot())
+	for _, it := range items {
+		count(migrateMetaItem(filepath.Join(f.trashRoot(), it.Name(), "meta")))
+	}
+
+	if moved > 0 || failed > 0 {
+		logNotice("Metadata Migrated", "dir", f.rootdir, "files", moved, "failed", failed)
+	}
+}
+
+//旧布局里除了新的 .meta 以外,以 .meta 结尾的文件
+func oldMetaTree(base string) bool {
+	if _, err := os.Lstat(base + ".meta"); err == nil {
+		return true
+	}
+
+	found := false
+	filepath.Walk(base, func(q string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && fi.Name() != metaSelf && strings.HasSuffix(q, ".meta") {
+			found = true
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
+
+//回收站里MoveOut出去的一份,先整个改名成 .old 再搬,中途退出下次接着搬
+func migrateMetaItem(base string) (int, int) {
+	old := base + ".old"
+	if _, err := os.Lstat(old); err != nil {
+		if !oldMetaTree(base) {
+			return 0, 0
+		}
+		err = os.Rename(base, old)
+		if err != nil && !os.IsNotExist(err) {
+			logWarning("Metadata Migrate Error", "dir", base, "err", err)
+			return 0, 1
+		}
+	}
+
+	moved, failed := moveMetaTree(old, base)
+
+	//移出去的条目自己的元数据
+	if _, err := os.Lstat(base + ".meta"); err == nil {
+		err = moveMetaFile(base + ".meta", base)
+		if err != nil {
+			logWarning("Metadata Migrate Error", "file", base + ".meta", "err", err)
+			failed++
+		} else {
+			moved++
+		}
+	}
+
+	if failed == 0 {
+		os.RemoveAll(old)
+	}
+	return moved, failed
+}
+
+//旧布局 old 下的 x.meta 搬到 to 下转义后的 x/.meta
+func moveMetaTree(old, to string) (int, int) {
+	moved, failed := 0, 0
+	filepath.Walk(old, func(q string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || !strings.HasSuffix(q, ".meta") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(old, strings.TrimSuffix(q, ".meta"))
+		if err != nil || rel == "." {
+			return nil
+		}
+
+		err = moveMetaFile(q, filepath.Join(to, metaEscapeRel(rel)))
+		if err != nil {
+			logWarning("Metadata Migrate Error", "file", q, "err", err)
+			failed++
+			return nil
+		}
+		moved++
+		return nil
+	})
+	return moved, failed
+}
+
+func moveMetaFile(q, d string) error {
+	err := os.MkdirAll(d, 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(q, filepath.Join(d, metaSelf))
+}
+
+//以下要持有m.mu
+func (m *metaStore) index(name string, md *metadata) {
+	if md.Expires > 0 {
+		m.expires[name] = md.Expires
+	} else {
+		delete(m.expires, name)
+	}
+}
+
+//文件或整个目录
+func (m *metaStore) unindex(name string) {
+	prefix := name + string(filepath.Separator)
+	for k := range m.expires {
+		if k == name || strings.HasPrefix(k, prefix) {
+			delete(m.expires, k)
+		}
+	}
+}
+
+//文件或整个目录下有过期时间的都加进索引
+func (m *metaStore) indexDir(name string) {
+	m.scanExpires(name, func(name string, exp int64) {
+		m.expires[name] = exp
+	})
+}
+
+func (m *metaStore) scanExpires(name string, fn func(name string, exp int64)) {
+	d := m.metaDir(name)
+	if d == "" {
+		d = m.metadir
+	}
+
+	walkMeta(d, func(q, rel string) {
+		if md := m.read(q); md != nil && md.Expires > 0 {
+			fn(filepath.Join(name, rel), md.Expires)
+		}
+	})
+}
+
+//启动时扫一遍元数据建立过期索引,扫的时候不锁,已经有的以索引为准
+func (m *metaStore) LoadExpires() {
+	found := make(map[string]int64)
+	m.scanExpires(m.rootdir, func(name string, exp int64) {
+		found[name] = exp
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for k, exp := range found {
+		if _, ok := m.expires[k]; !ok {
+			m.expires[k] = exp
+		}
+	}
+}
+
+//扫描时读到的可能已经变了,按当前的元数据重新记
+func (m *metaStore) Reindex(name string) {
+	p := m.metaPath(name)
+	if p == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	md := m.read(p)
+	if md == nil {
+		delete(m.expires, name)
+		return
+	}
+	m.index(name, md)
+}
+
+//已到期的文件(本地路径)
+func (m *metaStore) DueExpires(now int64) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var list []string
+	for k, exp := range m.expires {
+		if exp <= now {
+			list = append(list, k)
+		}
+	}
+	return list
+}
+
+//按索引判断,列目录时用,不读元数据文件
+func (m *metaStore) ExpiredAt(name string, now int64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	exp, ok := m.expires[name]
+	return ok && exp <= now
+}
+
+//内容变化后缓存的hash全部作废
+func (m *metaStore) InvalidateHash(name string) {
+	m.Update(name, func(md *metadata) bool {
+		if md.Hash == nil {
+			return false
+		}
+
+		md.Hash = nil
+		return true
+	})
+}
+
+//取缓存的hash,文件大小或修改时间变了就不算数
+func (m *metaStore) CachedHash(name string, fi os.FileInfo, key string) (string, bool) {
+	md := m.Get(name)
+	if md == nil || md.Hash == nil {
+		return "", false
+	}
+
+	if md.Size != fi.Size() || md.ModTime != fi.ModTime().UnixNano() {
+		return "", false
+	}
+
+	sum, ok := md.Hash[key]
+	return sum, ok
+}
+
+//最多缓存的hash数量(包含区间hash)
+const maxCachedHash = 16
+
+func (m *metaStore) CacheHash(name string, fi os.FileInfo, key, sum string) {
+	m.Update(name, func(md *metadata) bool {
+		if md.Hash == nil || md.Size != fi.Size() || md.ModTime != fi.ModTime().UnixNano() ||
+			len(md.Hash) >= maxCachedHash {
+			md.Hash = make(map[string]string)
+		}
+
+		md.Size = fi.Size()
+		md.ModTime = fi.ModTime().UnixNano()
+		md.Hash[key] = sum
+		return true
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"strings"
+	"path/filepath"
+)
+
+//每对路径的元数据位置不能相同,也不能一个在另一个的目录里
+func TestMetaPathNoCollision(t *testing.T) {
+	m := newMetaStore("/root")
+
+	pairs := [][2]string{
+		{"z", "z.meta/child"},
+		{"z", "z.meta"},
+		{"z.meta", "z.meta.meta"},
+		{".meta", "x"},
+		{"d/.meta", "d"},
+		{"d/.meta/x", "d/x"},
+		{".a", "..a"},
+		{"..a", "a"},
+		{"d/.meta.tmp", "d"},
+		{"a/b", "a.b"},
+	}
+
+	for _, pair := range pairs {
+		a, b := filepath.Join("/root", pair[0]), filepath.Join("/root", pair[1])
+		pa, pb := m.metaPath(a), m.metaPath(b)
+
+		if pa == pb {
+			t.Errorf("%s and %s share %s", pair[0], pair[1], pa)
+		}
+		if strings.HasPrefix(pb, pa + string(filepath.Separator)) || strings.HasPrefix(pa, pb + string(filepath.Separator)) {
+			t.Errorf("%s %s nested: %s %s", pair[0], pair[1], pa, pb)
+		}
+		//文件自己的元数据不在别的条目的目录下,除非那个是它的上级目录
+		if da := m.metaDir(a); strings.HasPrefix(pb, da + string(filepath.Separator)) && !strings.HasPrefix(b, a + string(filepath.Separator)) {
+			t.Errorf("%s under %s", pair[1], pair[0])
+		}
+	}
+
+	if m.metaPath("/root") != "" || m.metaPath("/other/x") != "" {
+		t.Fatal("root and outside paths have no metadata")
+	}
+}
+
+func TestMetaEscapeRoundTrip(t *testing.T) {
+	for _, rel := range []string{"a", ".a", "..a", ".meta", "a/.b/..c", "x.meta/y"} {
+		rel = filepath.FromSlash(rel)
+		esc := metaEscapeRel(rel)
+		for _, part := range strings.Split(esc, string(filepath.Separator)) {
+			if part == metaSelf {
+				t.Errorf("%s escaped to reserved %s", rel, esc)
+			}
+		}
+		if got := metaUnescapeRel(esc); got != rel {
+			t.Errorf("%s: round trip got %s", rel, got)
+		}
+	}
+}
+
+//文件z和目录z.meta下的文件各自保存,删除、改名和列出不会串
+func TestMetaStoreSiblings(t *testing.T) {
+	root := t.TempDir()
+	m := newMetaStore(root)
+
+	z := filepath.Join(root, "z")
+	child := filepath.Join(root, "z.meta", "c")
+
+	m.Put(z, &metadata{Owner: "z"})
+	m.Put(child, &metadata{Owner: "c", Expires: 100})
+
+	if md := m.Get(z); md == nil || md.Owner != "z" {
+		t.Fatal("z lost", md)
+	}
+	if md := m.Get(child); md == nil || md.Owner != "c" {
+		t.Fatal("child lost", md)
+	}
+
+	var owners []string
+	m.Each(filepath.Join(root, "z.meta"), func(md *metadata) {
+		owners = append(owners, md.Owner)
+	})
+	if len(owners) != 1 || owners[0] != "c" {
+		t.Fatal("each z.meta", owners)
+	}
+
+	names := m.Children(root)
+	sort.Strings(names)
+	if strings.Join(names, ",") != "z" {
+		t.Fatal("children", names)
+	}
+
+	m.Remove(z)
+	if m.Get(child) == nil {
+		t.Fatal("removing z dropped z.meta/c")
+	}
+
+	m.Rename(filepath.Join(root, "z.meta"), z)
+	if md := m.Get(filepath.Join(root, "z", "c")); md == nil || md.Owner != "c" {
+		t.Fatal("rename lost child", md)
+	}
+	if list := m.DueExpires(100); len(list) != 1 || list[0] != filepath.Join(root, "z", "c") {
+		t.Fatal("expire index after rename", list)
+	}
+}
+
+//旧布局 x.meta 加 x/ 搬到新布局,回收站里的也搬
+func TestMigrateMeta(t *testing.T) {
+	f := new(filesystem).Init(t.TempDir(), 0755)
+	old := filepath.Join(f.rootdir, sysDirName, "meta")
+
+	write := func(name, owner string) {
+		os.MkdirAll(filepath.Dir(name), 0755)
+		os.WriteFile(name, []byte(`{"size":0,"mtime":0,"owner":"` + owner + `"}`), 0644)
+	}
+	write(filepath.Join(old, "z.meta"), "z")
+	write(filepath.Join(old, "d", "x.meta"), "x")
+	write(filepath.Join(old, ".h", ".y.meta"), "y")
+
+	item := filepath.Join(f.trashRoot(), "t1", "meta")
+	write(item + ".meta", "t")
+	write(filepath.Join(item, "sub", "f.meta"), "f")
+
+	f.migrateMeta()
+
+	for name, owner := range map[string]string{"z": "z", "d/x": "x", ".h/.y": "y"} {
+		md := f.meta.Get(filepath.Join(f.rootdir, filepath.FromSlash(name)))
+		if md == nil || md.Owner != owner {
+			t.Errorf("%s: %v", name, md)
+		}
+	}
+	if _, err := os.Lstat(old); !os.IsNotExist(err) {
+		t.Error("old meta dir left", err)
+	}
+
+	if md := f.meta.GetIn(item, "."); md == nil || md.Owner != "t" {
+		t.Error("trash item", md)
+	}
+	if md := f.meta.GetIn(item, filepath.Join("sub", "f")); md == nil || md.Owner != "f" {
+		t.Error("trash child", md)
+	}
+	if _, err := os.Lstat(item + ".meta"); !os.IsNotExist(err) {
+		t.Error("old trash meta left", err)
+	}
+
+	//再跑一次不会动新布局
+	f.migrateMeta()
+	if md := f.meta.GetIn(item, filepath.Join("sub", "f")); md == nil || md.Owner != "f" {
+		t.Error("second migrate broke trash", md)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"bufio"
+	"bytes"
+	"strings"
+	"net/http"
+	"sync/atomic"
+)
+
+//Prometheus格式的监控数据,只在管理接口上 GET /metrics
+//计数都在内存里,进程重启后从0开始
+
+//延迟的分桶,单位秒
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type counterVec struct {
+	mu sync.Mutex
+	name string
+	help string
+	labels []string
+	m map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, m: make(map[string]float64)}
+}
+
+func (c *counterVec) Add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+	c.mu.Lock()
+	c.m[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.m) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, labelString(c.labels, key, ""), c.m[key])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum float64
+	count uint64
+}
+
+type histogramVec struct {
+	mu sync.Mutex
+	name string
+	help string
+	labels []string
+	m map[string]*histogram
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, m: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(d time.Duration, values ...string) {
+	key := strings.Join(values, "\xff")
+	v := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	o := h.m[key]
+	if o == nil {
+		o = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		h.m[key] = o
+	}
+
+	for i, b := range latencyBuckets {
+		if v <= b {
+			o.counts[i]++
+		}
+	}
+	o.sum += v
+	o.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	keys := make([]string, 0, len(h.m))
+	for key := range h.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		o := h.m[key]
+		for i, b := range latencyBuckets {
+			le := fmt.Sprintf("le=\"%v\"", b)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, key, le), o.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(h.labels, key, "le=\"+Inf\""), o.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labelString(h.labels, key, ""), o.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, key, ""), o.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelString(names []string, key, extra string) string {
+	var list []string
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			list = append(list, fmt.Sprintf("%s=%q", name, values[i]))
+		}
+	}
+	if extra != "" {
+		list = append(list, extra)
+	}
+	if len(list) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(list, ",") + "}"
+}
+
+var metrics = struct {
+	httpRequests *counterVec
+	httpLatency *histogramVec
+	streamOps *counterVec
+	streamLatency *histogramVec
+	bytesIn *counterVec
+	bytesOut *counterVec
+	authFailures *counterVec
+	errors *counterVec
+	//filesystem.mu 拿锁要等的次数和时间
+	lockContended int64
+	lockWait int64
+}{
+	httpRequests: newCounterVec("byfs_http_requests_total", "HTTP requests.", "method", "code"),
+	httpLatency: newHistogramVec("byfs_http_request_duration_seconds", "HTTP request latency.", "method"),
+	streamOps: newCounterVec("byfs_stream_ops_total", "Stream opcodes executed.", "op", "status"),
+	streamLatency: newHistogramVec("byfs_stream_op_duration_seconds", "Stream opcode latency.", "op"),
+	bytesIn: newCounterVec("byfs_bytes_received_total", "Bytes received from clients.", "proto"),
+	bytesOut: newCounterVec("byfs_bytes_sent_total", "Bytes sent to clients.", "proto"),
+	authFailures: newCounterVec("byfs_auth_failures_total", "Failed authentications.", "proto"),
+	errors: newCounterVec("byfs_errors_total", "Logged errors by class.", "class"),
+}
+
+//方法名是客户端给的,不认识的归到一起
+func methodLabel(m string) string {
+	switch m {
+	case "GET", "HEAD", "PUT", "POST", "DELETE", "COPY", "MOVE", "MKCOL":
+		return m
+	}
+	return "OTHER"
+}
+
+func authFailed(proto string) {
+	metrics.authFailures.Inc(proto)
+}
+
+//记录状态码和写出的字节,流协议劫持后不算HTTP请求
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	bytes int64
+	hijacked bool
+}
+
+func (w *metricsWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *metricsWriter) Flush() {
+	if fl, ok := w.ResponseWriter.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+func (w *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+//http.ResponseController要拿到里面的连接设置超时
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type countReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+func instrumentHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w}
+		body := &countReader{ReadCloser: r.Body}
+		r.Body = body
+
+		r, rl := withRequestLog(r)
+		w.Header().Set(requestIDHeader, rl.id)
+		//处理时路径会被改掉
+		uri := r.URL.RequestURI()
+
+		next.ServeHTTP(mw, r)
+
+		metrics.bytesIn.Add(float64(body.n), "http")
+		//流协议的指令各自记,这里只记连接
+		if mw.hijacked {
+			accessHTTP(r, rl.id, uri, http.StatusSwitchingProtocols, body.n, mw.bytes, time.Since(start))
+			return
+		}
+
+		status := mw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		d := time.Since(start)
+		method := methodLabel(r.Method)
+		metrics.httpRequests.Inc(method, fmt.Sprint(status))
+		metrics.httpLatency.Observe(d, method)
+		metrics.bytesOut.Add(float64(mw.bytes), "http")
+
+		accessHTTP(r, rl.id, uri, status, body.n, mw.bytes, d)
+		rl.log.Debug("request done", "status", status, "duration_ms", ms(d), "bytes_in", body.n, "bytes_out", mw.bytes)
+	})
+}
+
+//流连接的收发字节
+type countConn struct {
+	net.Conn
+	in int64
+	out int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	metrics.bytesIn.Add(float64(n), "stream")
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	metrics.bytesOut.Add(float64(n), "stream")
+	return n, err
+}
+
+func streamOpDone(code uint16, status string, d time.Duration) {
+	op := codeName(code)
+	metrics.streamOps.Inc(op, status)
+	metrics.streamLatency.Observe(d, op)
+}
+
+//有人拿着锁时才计时
+func (f *filesystem) lockMu() {
+	if f.mu.TryLock() {
+		return
+	}
+
+	start := time.Now()
+	f.mu.Lock()
+	atomic.AddInt64(&metrics.lockContended, 1)
+	atomic.AddInt64(&metrics.lockWait, int64(time.Since(start)))
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, v)
+}
+
+func adminMetrics(w http.ResponseWriter, r *http.Request) {
+	streams.mu.Lock()
+	conns := len(streams.conns)
+	handles := 0
+	for f := range streams.conns {
+		f.mu.Lock()
+		handles += len(f.files)
+		f.mu.Unlock()
+	}
+	streams.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	metrics.httpRequests.write(&buf)
+	metrics.httpLatency.write(&buf)
+	metrics.streamOps.write(&buf)
+	metrics.streamLatency.write(&buf)
+	metrics.bytesIn.write(&buf)
+	metrics.bytesOut.write(&buf)
+	metrics.authFailures.write(&buf)
+	metrics.errors.write(&buf)
+
+	writeGauge(&buf, "byfs_stream_connections", "Active stream connections.", float64(conns))
+	writeGauge(&buf, "byfs_open_handles", "Open file and dir handles on stream connections.", float64(handles))
+
+	fmt.Fprintf(&buf, "# HELP byfs_fs_lock_contended_total Times filesystem.mu was already held.\n# TYPE byfs_fs_lock_contended_total counter\nbyfs_fs_lock_contended_total %d\n", atomic.LoadInt64(&metrics.lockContended))
+	fmt.Fprintf(&buf, "# HELP byfs_fs_lock_wait_seconds_total Time spent waiting for filesystem.mu.\n# TYPE byfs_fs_lock_wait_seconds_total counter\nbyfs_fs_lock_wait_seconds_total %v\n", time.Duration(atomic.LoadInt64(&metrics.lockWait)).Seconds())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
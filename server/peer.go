@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+	"net/http"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//节点之间的请求用单独的密钥签名,和客户端的-auth分开
+//副本头只有签名对了才认,否则当成普通客户端的请求
+//签名是 HMAC-SHA256(密钥, 方法 路径 来源节点 时间),时间差超过窗口的不认
+
+var peerPassword = flag.String("peer-auth", "", "Node To Node Auth Secret (required for -peers, -cluster and -join)")
+
+const peerAuthHeader = "Byfs-Peer-Auth"
+
+//两边的时钟差加上请求排队的时间
+var peerAuthWindow = 5 * time.Minute
+
+var errPeerAuthNeed = errors.New("peer-auth need for cluster and replica")
+
+//有副本或集群时必须配置
+func initPeerAuth() {
+	if *peerPassword != "" {
+		return
+	}
+	if len(staticPeers) > 0 || currentRing() != nil || gossip.on {
+		logExit(errPeerAuthNeed.Error())
+	}
+}
+
+func peerSign(method, p, name string, t int64) string {
+	h := hmac.New(sha256.New, []byte(*peerPassword))
+	h.Write([]byte(method + " " + p + " " + name + " " + strconv.FormatInt(t, 10)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+//加上副本头和签名
+func signPeer(h http.Header, method, p string) {
+	name := replicaName()
+	t := time.Now().Unix()
+
+	h.Set(replicaHeader, name)
+	h.Set(peerAuthHeader, strconv.FormatInt(t, 10) + ":" + peerSign(method, p, name, t))
+}
+
+func peerAuth(h http.Header, method, p string) bool {
+	if *peerPassword == "" {
+		return false
+	}
+
+	ts, sign, ok := strings.Cut(h.Get(peerAuthHeader), ":")
+	if !ok {
+		return false
+	}
+
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	d := time.Since(time.Unix(t, 0))
+	if d > peerAuthWindow || d < -peerAuthWindow {
+		return false
+	}
+
+	want := peerSign(method, p, h.Get(replicaHeader), t)
+	return hmac.Equal([]byte(sign), []byte(want))
+}
+
+//请求一进来就检查,签名不对的把副本头去掉,后面isReplica只看头
+func verifyPeer(r *http.Request) {
+	if r.Header.Get(replicaHeader) == "" {
+		return
+	}
+
+	if !peerAuth(r.Header, r.Method, r.URL.Path) {
+		authFailed("peer")
+		reqLog(r).Notice("Peer Auth Error", "from", r.Header.Get(replicaHeader))
+		r.Header.Del(replicaHeader)
+	}
+	r.Header.Del(peerAuthHeader)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"os"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+)
+
+//集群模式下的法定数读写,版本向量保存在元数据里
+const (
+	vectorHeader = "Byfs-Vector"
+	vtimeHeader = "Byfs-Vtime"
+	conflictHeader = "Byfs-Conflict"
+)
+
+//等副本确认或回复版本的时间
+var quorumTimeout = 30 * time.Second
+
+//一个副本上对象的版本
+type objVersion struct {
+	addr string
+	vv versionVector
+	//修改时间,并发修改时后写的赢
+	time int64
+	exists bool
+	deleted bool
+	dir bool
+}
+
+func localVersion(p string) *objVersion {
+	v := new(objVersion)
+
+	name := fs.pathToFile(p)
+	if name == "." {
+		return v
+	}
+
+	fi, err := os.Stat(name)
+	if err == nil {
+		v.exists = true
+		v.dir = fi.IsDir()
+	}
+
+	md := fs.meta.Get(name)
+	if md != nil {
+		v.vv, v.time = md.Version, md.VersionTime
+		v.deleted = md.Deleted && !v.exists
+	}
+
+	return v
+}
+
+func setVersion(p string, v *objVersion) {
+	fs.meta.Update(fs.pathToFile(p), func(md *metadata) bool {
+		md.Version, md.VersionTime, md.Deleted = v.vv, v.time, v.deleted
+		return true
+	})
+}
+
+//本节点修改了一次,只有集群模式才记版本
+func bumpVersion(p string) *objVersion {
+	if currentRing() == nil {
+		return nil
+	}
+
+	v := new(objVersion)
+	fs.meta.Update(fs.pathToFile(p), func(md *metadata) bool {
+		md.Version = md.Version.Bump(*serverName)
+		md.VersionTime = time.Now().UnixNano()
+		md.Deleted = false
+
+		v.vv, v.time = md.Version, md.VersionTime
+		return true
+	})
+
+	return v
+}
+
+//删除后留下墓碑,免得读修复把旧副本又复制回来
+func versionedRemove(p string, remove func(string) error) (*objVersion, error) {
+	if currentRing() == nil {
+		return nil, remove(p)
+	}
+
+	old := localVersion(p)
+
+	err := remove(p)
+	if err != nil || old.dir {
+		return nil, err
+	}
+
+	v := &objVersion{vv: old.vv.Bump(*serverName), time: time.Now().UnixNano(), deleted: true}
+	setVersion(p, v)
+
+	return v, nil
+}
+
+//版本一样时按向量的字符串比,保证各节点选的一样
+func newerVersion(a, b *objVersion) bool {
+	if a.time != b.time {
+		return a.time > b.time
+	}
+	return a.vv.String() > b.vv.String()
+}
+
+func setVersionHeader(h http.Header, v *objVersion) {
+	if v == nil || len(v.vv) == 0 {
+		return
+	}
+
+	h.Set(vectorHeader, v.vv.String())
+	h.Set(vtimeHeader, strconv.FormatInt(v.time, 10))
+}
+
+//没有版本头返回nil
+func headerVersion(h http.Header) (*objVersion, error) {
+	str := h.Get(vectorHeader)
+	if str == "" {
+		return nil, nil
+	}
+
+	vv, err := parseVector(str)
+	if err != nil {
+		return nil, err
+	}
+
+	t, _ := strconv.ParseInt(h.Get(vtimeHeader), 10, 64)
+	return &objVersion{vv: vv, time: t}, nil
+}
+
+type quorum struct {
+	n, r, w int
+}
+
+//Byfs-N/Byfs-R/Byfs-W 单独指定,不是集群模式或者是副本请求返回nil
+func requestQuorum(r *http.Request) (*quorum, error) {
+	rg := currentRing()
+	if rg == nil || isReplica(r) {
+		return nil, nil
+	}
+
+	q := &quorum{n: rg.replicas(), r: rg.m.ReadQuorum, w: rg.m.WriteQuorum}
+	if q.r == 0 {
+		q.r = 1
+	}
+	if q.w == 0 {
+		q.w = 1
+	}
+
+	set := false
+	for _, h := range []struct{name string; v *int}{{"Byfs-N", &q.n}, {"Byfs-R", &q.r}, {"Byfs-W", &q.w}} {
+		str := r.Header.Get(h.name)
+		if str == "" {
+			continue
+		}
+
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 {
+			return nil, errors.New(h.name + " error")
+		}
+		*h.v = n
+		set = true
+	}
+
+	if q.n > rg.replicas() {
+		return nil, errors.New("Byfs-N greater than replicas")
+	}
+
+	if q.r > q.n || q.w > q.n {
+		if !set {
+			return nil, errors.New("quorum greater than replicas")
+		}
+		return nil, errors.New("Byfs-R or Byfs-W greater than Byfs-N")
+	}
+
+	return q, nil
+}
+
+//前n个副本节点里除了自己的
+func quorumTargets(p string, n int) []string {
+	var addrs []string
+
+	owners := currentRing().Owners(p)
+	for i, node := range owners {
+		if i >= n {
+			break
+		}
+		if node.Name != *serverName {
+			addrs = append(addrs, node.Addr)
+		}
+	}
+
+	return addrs
+}
+
+//本地已经写成功,再等够W个节点确认,没送到的留在队列里重试
+func quorumWrite(q *quorum, r *http.Request, op *replOp) error {
+	if q == nil || repl == nil {
+		return replicate(r, op)
+	}
+
+	addrs := quorumTargets(op.Path, q.n)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	need := q.w - 1
+	op.Time = time.Now().UnixNano()
+
+	if need <= 0 {
+		err := repl.Replicate(op, addrs)
+		if err != nil {
+			logWarning("Replica Queued", "op", op.Op, "path", op.Path, "err", err)
+		}
+		return err
+	}
+
+	acks := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			o := *op
+			err := sendReplOp(addr, &o)
+			if err == errFileGone {
+				err = nil
+			}
+			if err != nil && err != errConflict {
+				logWarning("Replica Queued", "peer", addr, "op", op.Op, "path", op.Path, "err", err)
+
+				p, err1 := repl.peer(addr)
+				if err1 == nil {
+					_, err1 = p.push(op, false)
+				}
+				if err1 != nil {
+					logWarning("Replica Queue Error", "peer", addr, "err", err1)
+				}
+			}
+			acks <- err
+		}(addr)
+	}
+
+	ok, conflict := 0, false
+	timeout := time.After(quorumTimeout)
+
+	wait:
+	for range addrs {
+		select {
+		case err := <-acks:
+			if err == nil {
+				ok++
+			} else if err == errConflict {
+				conflict = true
+			}
+		case <-timeout:
+			break wait
+		}
+
+		if ok >= need {
+			break
+		}
+	}
+
+	if conflict {
+		return errConflict
+	}
+
+	if ok < need {
+		return errors.New("write quorum not reached " + strconv.Itoa(ok + 1) + "/" + strconv.Itoa(q.w))
+	}
+
+	return nil
+}
+
+//副本收到带版本的修改,返回要不要应用和应用后的版本
+func replicaAccept(r *http.Request) (*objVersion, bool, error) {
+	in, err := headerVersion(r.Header)
+	if err != nil || in == nil {
+		return nil, err == nil, err
+	}
+
+	p := cleanPath(r.URL.Path)
+	local := localVersion(p)
+
+	switch in.vv.Compare(local.vv) {
+	case VV_AFTER:
+		return in, true, nil
+	case VV_EQUAL:
+		//元数据还在文件丢了
+		return in, !local.exists && !local.deleted, nil
+	case VV_BEFORE:
+		return nil, false, nil
+	}
+
+	if *conflictMode == "report" {
+		reqLog(r).Notice("Version Conflict", "file", p, "incoming", in.vv, "local", local.vv)
+		return nil, false, errConflict
+	}
+
+	v := &objVersion{vv: in.vv.Merge(local.vv), time: in.time}
+	if newerVersion(in, local) {
+		return v, true, nil
+	}
+
+	//本地的赢,版本合并后旧的那边会被读修复
+	v.time, v.deleted = local.time, local.deleted
+	setVersion(p, v)
+	return nil, false, nil
+}
+
+//GET 时比较R个节点的版本,本地旧了先从新的节点修复,旧的节点在后台修复
+func quorumRead(w http.ResponseWriter, r *http.Request) bool {
+	q, err := requestQuorum(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	if q == nil || q.r <= 1 {
+		return false
+	}
+
+	p := cleanPath(r.URL.Path)
+	addrs := quorumTargets(p, q.n)
+	need := q.r - 1
+
+	replies := make(chan *objVersion, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			v, err := fetchVersion(addr, p)
+			if err != nil {
+				logNotice("Read Version Error", "peer", addr, "path", p, "err", err)
+			}
+			replies <- v
+		}(addr)
+	}
+
+	var got []*objVersion
+	timeout := time.After(quorumTimeout)
+
+	wait:
+	for range addrs {
+		select {
+		case v := <-replies:
+			if v != nil {
+				got = append(got, v)
+			}
+		case <-timeout:
+			break wait
+		}
+
+		if len(got) >= need {
+			break
+		}
+	}
+
+	if len(got) < need {
+		http.Error(w, "Read Quorum Not Reached", http.StatusServiceUnavailable)
+		return true
+	}
+
+	local := localVersion(p)
+	best, merged, conflict := local, local.vv, false
+
+	for _, v := range got {
+		merged = merged.Merge(v.vv)
+
+		switch v.vv.Compare(best.vv) {
+		case VV_AFTER:
+			best = v
+		case VV_CONCURRENT:
+			conflict = true
+			if newerVersion(v, best) {
+				best = v
+			}
+		}
+	}
+
+	if conflict && *conflictMode == "report" {
+		list := []string{"self " + local.vv.String()}
+		for _, v := range got {
+			list = append(list, v.addr + " " + v.vv.String())
+		}
+		w.Header().Set(conflictHeader, strings.Join(list, "; "))
+		return false
+	}
+
+	final := &objVersion{vv: best.vv, time: best.time, exists: best.exists, deleted: best.deleted}
+	if conflict {
+		final.vv = merged
+	}
+
+	if best != local {
+		err = repairLocal(p, best, final)
+		if err != nil {
+			logWarning("Read Repair Error", "path", p, "peer", best.addr, "err", err)
+			return false
+		}
+	} else if conflict && (local.exists || local.deleted) {
+		setVersion(p, final)
+	}
+
+	for _, v := range got {
+		if v.vv.Compare(final.vv) != VV_EQUAL {
+			repairPeer(v.addr, p, final)
+		}
+	}
+
+	return false
+}
+
+//HEAD 取副本上的版本,404带版本是墓碑
+func fetchVersion(addr, p string) (*objVersion, error) {
+	u := url.URL{Scheme: "http", Host: addr, Path: p}
+
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	internalHeader(req)
+
+	c := *replicaClient
+	c.Timeout = quorumTimeout
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return nil, errors.New(resp.Status)
+	}
+
+	v, err := headerVersion(resp.Header)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		v = new(objVersion)
+	}
+
+	v.addr = addr
+	v.exists = resp.StatusCode == http.StatusOK
+	v.deleted = !v.exists && len(v.vv) > 0
+
+	return v, nil
+}
+
+//从版本最新的节点取回内容
+func repairLocal(p string, best, final *objVersion) error {
+	if !best.exists {
+		if !best.deleted {
+			return nil
+		}
+
+		err := fs.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		setVersion(p, final)
+		logNotice("Read Repair Delete", "path", p, "peer", best.addr)
+		return nil
+	}
+
+	err := pullFile(best.addr, p, nil)
+	if err != nil {
+		return err
+	}
+
+	setVersion(p, final)
+	logNotice("Read Repair", "path", p, "peer", best.addr)
+	return nil
+}
+
+//旧的节点放进复制队列,发送时带上本地的新版本
+func repairPeer(addr, p string, final *objVersion) {
+	op := &replOp{Op: REPL_PUT, Path: p, Time: time.Now().UnixNano()}
+	if final.deleted {
+		op = &replOp{Op: REPL_DELETE, Path: p, Version: final.vv, VersionTime: final.time, Time: op.Time}
+	} else if !final.exists {
+		return
+	}
+
+	pr, err := repl.peer(addr)
+	if err == nil {
+		_, err = pr.push(op, false)
+	}
+	if err != nil {
+		logWarning("Read Repair Queue Error", "peer", addr, "path", p, "err", err)
+	}
+}
+
+//从其它节点取回整个文件覆盖本地,修改时间和对方一致
+func pullFile(addr, p string, limit *rateLimiter) error {
+	u := url.URL{Scheme: "http", Host: addr, Path: p}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	internalHeader(req)
+
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	err = fs.Replace(p, limit.Reader(resp.Body))
+	if err != nil {
+		return err
+	}
+
+	applyMtime(p, resp.Header)
+	return nil
+}
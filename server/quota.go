@@ -0,0 +1,645 @@
+package main
+
+import (
+	"io"
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/http"
+	"path/filepath"
+)
+
+//配额,按目录前缀或访问密钥限制字节数和文件数
+//格式 /app1:10G:100000,@app2:5G  文件数省略或0表示不限
+//写入时增量记账,后台定时全盘扫描校正
+//按密钥的配额看文件的所有者,所有者是创建文件时用的密钥,记在元数据里
+
+//访问密钥,名字放在Byfs-Key头里,token用对应的密码计算
+const keyHeader = "Byfs-Key"
+
+//SIGHUP时会整个换掉
+var accessKeys struct {
+	mu sync.RWMutex
+	m map[string]string
+}
+
+type quotaRule struct {
+	Name string `json:"name"`
+	prefix string
+	key string
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+//每个根目录(卷)一套
+type quotaSet struct {
+	mu sync.Mutex
+	rules []*quotaRule
+	//有按密钥的配额时才需要读所有者
+	byKey bool
+	scanned time.Time
+	//全盘扫描期间的记账,扫描结果要加上,同时只有一个扫描
+	delta map[*quotaRule]*quotaTotal
+	scanMu sync.Mutex
+}
+
+type quotaError struct {
+	rule string
+	what string
+	limit int64
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Quota Exceeded: %s %s limit %d", e.rule, e.what, e.limit)
+}
+
+func isQuotaError(err error) bool {
+	_, ok := err.(*quotaError)
+	return ok
+}
+
+func initKeys() {
+	err := loadKeys(*keysConf)
+	if err != nil {
+		logExit("keys config error", "err", err)
+	}
+}
+
+func parseKeys(conf string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, item := range splitList(conf) {
+		i := strings.Index(item, ":")
+		if i < 1 || i == len(item) - 1 {
+			return nil, errors.New("key error " + item)
+		}
+		m[item[:i]] = item[i+1:]
+	}
+	return m, nil
+}
+
+func loadKeys(conf string) error {
+	m, err := parseKeys(conf)
+	if err != nil {
+		return err
+	}
+
+	accessKeys.mu.Lock()
+	accessKeys.m = m
+	accessKeys.mu.Unlock()
+	return nil
+}
+
+//请求用的密钥和对应的密码,没带密钥的用-auth
+func requestSecret(h http.Header) (string, string, bool) {
+	key := h.Get(keyHeader)
+	if key == "" {
+		return "", authPassword(), true
+	}
+
+	accessKeys.mu.RLock()
+	defer accessKeys.mu.RUnlock()
+
+	secret, ok := accessKeys.m[key]
+	return key, secret, ok
+}
+
+//10G 512M 1024
+func parseSize(str string) (int64, error) {
+	mul := int64(1)
+
+	if n := len(str); n > 0 {
+		switch str[n-1] {
+		case 'K', 'k':
+			mul = 1 << 10
+		case 'M', 'm':
+			mul = 1 << 20
+		case 'G', 'g':
+			mul = 1 << 30
+		case 'T', 't':
+			mul = 1 << 40
+		}
+		if mul > 1 {
+			str = str[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || v < 0 {
+		return 0, errors.New("size error " + str)
+	}
+	return v * mul, nil
+}
+
+func parseQuota(conf string) ([]*quotaRule, error) {
+	var rules []*quotaRule
+
+	for _, item := range splitList(conf) {
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, errors.New("quota error " + item)
+		}
+
+		rule := &quotaRule{}
+		if parts[0][0] == '@' {
+			rule.key = parts[0][1:]
+			rule.Name = parts[0]
+		} else {
+			rule.prefix = cleanPath(parts[0])
+			rule.Name = rule.prefix
+		}
+
+		var err error
+		rule.MaxBytes, err = parseSize(parts[1])
+		if err == nil && len(parts) == 3 {
+			rule.MaxFiles, err = strconv.ParseInt(parts[2], 10, 64)
+		}
+		if err != nil {
+			return nil, errors.New("quota error " + item + " " + err.Error())
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+//换成新的规则,用量要重新扫描
+func (q *quotaSet) load(conf string) error {
+	rules, err := parseQuota(conf)
+	if err != nil {
+		return err
+	}
+
+	byKey := false
+	for _, r := range rules {
+		if r.key != "" {
+			byKey = true
+		}
+	}
+
+	q.mu.Lock()
+	q.rules = rules
+	q.byKey = byKey
+	q.scanned = time.Time{}
+	q.mu.Unlock()
+	return nil
+}
+
+func initQuota() {
+	err := fs.quota.load(*quotaConf)
+	if err != nil {
+		logExit("quota config error", "err", err)
+	}
+
+	go func() {
+		for {
+			for _, f := range allFilesystems() {
+				err := f.quotaReconcile()
+				if err != nil {
+					logWarning("Quota Scan Error", "dir", f.rootdir, "err", err)
+				}
+			}
+			if *quotaScan <= 0 {
+				return
+			}
+			time.Sleep(*quotaScan)
+		}
+	}()
+}
+
+func (q *quotaSet) enabled() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.rules) > 0
+}
+
+//当前规则的快照
+func (q *quotaSet) snapshot() ([]*quotaRule, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.rules, q.byKey
+}
+
+func (r *quotaRule) match(p, owner string) bool {
+	if r.key != "" {
+		return r.key == owner
+	}
+	return hasPathPrefix(p, r.prefix)
+}
+
+//检查并记账,有一条超出就都不记
+func (q *quotaSet) charge(p, owner string, bytes, files int64) error {
+	if !q.enabled() {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var hit []*quotaRule
+	for _, r := range q.rules {
+		if !r.match(p, owner) {
+			continue
+		}
+		if bytes > 0 && r.MaxBytes > 0 && r.Bytes + bytes > r.MaxBytes {
+			return &quotaError{r.Name, "bytes", r.MaxBytes}
+		}
+		if files > 0 && r.MaxFiles > 0 && r.Files + files > r.MaxFiles {
+			return &quotaError{r.Name, "files", r.MaxFiles}
+		}
+		hit = append(hit, r)
+	}
+
+	for _, r := range hit {
+		q.count(r, bytes, files)
+	}
+	return nil
+}
+
+//不检查,删除和副本写入用
+func (q *quotaSet) adjust(p, owner string, bytes, files int64) {
+	if !q.enabled() {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, r := range q.rules {
+		if r.match(p, owner) {
+			q.count(r, bytes, files)
+		}
+	}
+}
+
+//要持有q.mu
+func (q *quotaSet) count(r *quotaRule, bytes, files int64) {
+	r.Bytes += bytes
+	r.Files += files
+
+	if q.delta != nil {
+		d := q.delta[r]
+		if d == nil {
+			d = &quotaTotal{}
+			q.delta[r] = d
+		}
+		d.bytes += bytes
+		d.files += files
+	}
+}
+
+//name是本地路径
+func (f *filesystem) owner(name string) string {
+	if _, byKey := f.quota.snapshot(); !byKey {
+		return ""
+	}
+
+	md := f.meta.Get(name)
+	if md == nil {
+		return ""
+	}
+	return md.Owner
+}
+
+func (f *filesystem) setOwner(name, key string) {
+	if key == "" {
+		return
+	}
+
+	f.meta.Update(name, func(md *metadata) bool {
+		md.Owner = key
+		return true
+	})
+}
+
+type quotaEntry struct {
+	path string
+	owner string
+	size int64
+}
+
+//删除或移动之前统计下面的文件
+func (f *filesystem) quotaEntries(name string) []quotaEntry {
+	if !f.quota.enabled() {
+		return nil
+	}
+
+	var list []quotaEntry
+	filepath.Walk(name, func(q string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			list = append(list, quotaEntry{f.localToPath(q), f.owner(q), fi.Size()})
+		}
+		return nil
+	})
+	return list
+}
+
+func (q *quotaSet) drop(list []quotaEntry) {
+	for _, e := range list {
+		q.adjust(e.path, e.owner, -e.size, -1)
+	}
+}
+
+//副本跟着主节点复制或改名出来的
+func (q *quotaSet) add(list []quotaEntry) {
+	for _, e := range list {
+		q.adjust(e.path, e.owner, e.size, 1)
+	}
+}
+
+//复制、改名、恢复之前按目标检查并记账,有一个超出就都不记
+func (q *quotaSet) chargeAll(list []quotaEntry) error {
+	for i, e := range list {
+		err := q.charge(e.path, e.owner, e.size, 1)
+		if err != nil {
+			q.drop(list[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+//复制或改名到目标路径下的用量
+func rebaseEntries(list []quotaEntry, from, to string) []quotaEntry {
+	moved := make([]quotaEntry, 0, len(list))
+	for _, e := range list {
+		e.path = to + strings.TrimPrefix(e.path, from)
+		moved = append(moved, e)
+	}
+	return moved
+}
+
+//写入时按增长的部分记账,超出后丢掉剩下的数据,由调用的人返回错误
+type quotaWriter struct {
+	w io.Writer
+	q *quotaSet
+	path string
+	owner string
+	//追加模式每次都是增长
+	appending bool
+	pos int64
+	size int64
+	err error
+}
+
+func newQuotaWriter(fp *file) *quotaWriter {
+	q := &quotaWriter{w: fp, q: fp.root.quota, path: fp.path, owner: fp.owner, appending: fp.flag & os.O_APPEND != 0}
+	if !q.q.enabled() {
+		return q
+	}
+
+	fi, err := fp.Stat()
+	if err == nil {
+		q.size = fi.Size()
+	}
+	q.pos, _ = fp.Seek(0, io.SeekCurrent)
+	return q
+}
+
+func (q *quotaWriter) Write(b []byte) (int, error) {
+	if q.err != nil {
+		return len(b), nil
+	}
+
+	if q.q.enabled() {
+		grow := int64(len(b))
+		if !q.appending {
+			grow = q.pos + int64(len(b)) - q.size
+		}
+
+		if grow > 0 {
+			q.err = q.q.charge(q.path, q.owner, grow, 0)
+			if q.err != nil {
+				return len(b), nil
+			}
+			q.size += grow
+		}
+		q.pos += int64(len(b))
+	}
+
+	return q.w.Write(b)
+}
+
+//SIGHUP时换规则,没变的规则沿用现在的用量,新加的先扫描统计再换上
+//换的过程中旧规则一直有效
+func (f *filesystem) reloadQuota(conf string) error {
+	rules, err := parseQuota(conf)
+	if err != nil {
+		return err
+	}
+
+	old, _ := f.quota.snapshot()
+	known := make(map[string]bool)
+	for _, r := range old {
+		known[r.Name] = true
+	}
+
+	var fresh []*quotaRule
+	for _, r := range rules {
+		if !known[r.Name] {
+			fresh = append(fresh, r)
+		}
+	}
+
+	if len(fresh) > 0 {
+		usage, err := f.quotaUsage(fresh)
+		if err != nil {
+			return err
+		}
+		for r, u := range usage {
+			r.Bytes, r.Files = u.bytes, u.files
+		}
+	}
+
+	byKey := false
+	for _, r := range rules {
+		if r.key != "" {
+			byKey = true
+		}
+	}
+
+	q := f.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	//扫描期间旧规则还在记账,用最新的
+	cur := make(map[string]*quotaRule)
+	for _, r := range q.rules {
+		cur[r.Name] = r
+	}
+	for _, r := range rules {
+		if o := cur[r.Name]; o != nil {
+			r.Bytes, r.Files = o.Bytes, o.Files
+		}
+	}
+
+	q.rules = rules
+	q.byKey = byKey
+	return nil
+}
+
+type quotaTotal struct {
+	bytes, files int64
+}
+
+//扫描整个目录统计这些规则的用量
+func (f *filesystem) quotaUsage(rules []*quotaRule) (map[*quotaRule]*quotaTotal, error) {
+	usage := make(map[*quotaRule]*quotaTotal)
+	byKey := false
+	for _, r := range rules {
+		usage[r] = &quotaTotal{}
+		if r.key != "" {
+			byKey = true
+		}
+	}
+
+	//规则还没换上,不能用f.owner
+	ownerOf := func(name string) string {
+		if !byKey {
+			return ""
+		}
+		if md := f.meta.Get(name); md != nil {
+			return md.Owner
+		}
+		return ""
+	}
+
+	sysdir := filepath.Join(f.rootdir, sysDirName)
+	err := filepath.Walk(f.rootdir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if name == sysdir {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		p, owner := f.localToPath(name), ownerOf(name)
+		for _, r := range rules {
+			if r.match(p, owner) {
+				usage[r].bytes += fi.Size()
+				usage[r].files++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//旧版本算在原来的路径下,不分所有者
+	err = f.eachVersion(func(p string, fi os.FileInfo) {
+		for _, r := range rules {
+			if r.match(p, "") {
+				usage[r].bytes += fi.Size()
+				usage[r].files++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+//扫描整个目录重新统计,扫描期间的记账另外记下来加上
+//扫描已经走过的文件再写入的不会丢,还没走到的会多算一次,等下次扫描校正
+func (f *filesystem) quotaReconcile() error {
+	q := f.quota
+	q.scanMu.Lock()
+	defer q.scanMu.Unlock()
+
+	q.mu.Lock()
+	rules := q.rules
+	if len(rules) > 0 {
+		q.delta = make(map[*quotaRule]*quotaTotal)
+	}
+	q.mu.Unlock()
+
+	if len(rules) == 0 {
+		return nil
+	}
+
+	usage, err := f.quotaUsage(rules)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delta := q.delta
+	q.delta = nil
+	if err != nil {
+		return err
+	}
+
+	for r, u := range usage {
+		if d := delta[r]; d != nil {
+			u.bytes += d.bytes
+			u.files += d.files
+		}
+		r.Bytes, r.Files = u.bytes, u.files
+	}
+	//扫描期间规则换过的,这次的结果不算
+	if len(q.rules) > 0 && usage[q.rules[0]] != nil {
+		q.scanned = time.Now()
+	}
+	return nil
+}
+
+//各条规则的用量
+func (q *quotaSet) usage() map[string]interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	list := make([]quotaRule, 0, len(q.rules))
+	for _, r := range q.rules {
+		list = append(list, *r)
+	}
+
+	return map[string]interface{}{
+		"rules": list,
+		"scanned": q.scanned,
+	}
+}
+
+//GET 各条配额的用量,卷的在volumes里, POST ?action=scan 立即重新统计
+func adminQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		if r.URL.Query().Get("action") != "scan" {
+			http.Error(w, "Action Error", http.StatusBadRequest)
+			return
+		}
+
+		for _, f := range allFilesystems() {
+			err := f.quotaReconcile()
+			if err != nil {
+				http.Error(w, "Quota Scan Error "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	res := fs.quota.usage()
+
+	vols := make(map[string]interface{})
+	for name, v := range volumes {
+		vols[name] = v.fs.quota.usage()
+	}
+	if len(vols) > 0 {
+		res["volumes"] = vols
+	}
+
+	writeJSON(w, res)
+}
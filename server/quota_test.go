@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		in string
+		want int64
+		err bool
+	}{
+		{"1024", 1024, false},
+		{"0", 0, false},
+		{"2K", 2 << 10, false},
+		{"512m", 512 << 20, false},
+		{"10G", 10 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"10X", 0, true},
+	}
+
+	for _, c := range cases {
+		n, err := parseSize(c.in)
+		if (err != nil) != c.err || n != c.want {
+			t.Errorf("%q: got %d %v", c.in, n, err)
+		}
+	}
+}
+
+func TestParseQuota(t *testing.T) {
+	type rule struct {
+		name, prefix, key string
+		bytes, files int64
+	}
+
+	cases := []struct {
+		conf string
+		want []rule
+		err bool
+	}{
+		{"", nil, false},
+		{"/app1:10G:100000", []rule{{"/app1", "/app1", "", 10 << 30, 100000}}, false},
+		{"app1/:1M", []rule{{"/app1", "/app1", "", 1 << 20, 0}}, false},
+		{"@k1:5G", []rule{{"@k1", "", "k1", 5 << 30, 0}}, false},
+		{"/a:1K:0,@k:2K:3", []rule{{"/a", "/a", "", 1 << 10, 0}, {"@k", "", "k", 2 << 10, 3}}, false},
+		{"/a", nil, true},
+		{":1G", nil, true},
+		{"/a:1G:2:3", nil, true},
+		{"/a:big", nil, true},
+		{"/a:1G:x", nil, true},
+	}
+
+	for _, c := range cases {
+		rules, err := parseQuota(c.conf)
+		if (err != nil) != c.err {
+			t.Errorf("%q: err %v", c.conf, err)
+			continue
+		}
+		if len(rules) != len(c.want) {
+			t.Errorf("%q: got %d rules", c.conf, len(rules))
+			continue
+		}
+		for i, r := range rules {
+			w := c.want[i]
+			if r.Name != w.name || r.prefix != w.prefix || r.key != w.key || r.MaxBytes != w.bytes || r.MaxFiles != w.files {
+				t.Errorf("%q: rule %d got %+v", c.conf, i, *r)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+//只读模式和维护模式
+//只读: 客户端的写入、删除都拒绝,副本同步照常写入,用来做只读副本
+//维护: 连副本同步和后台的清理任务也停掉,迁移磁盘时用
+//读一直可以
+
+const (
+	modeNormal = iota
+	modeReadOnly
+	modeMaintenance
+)
+
+var modeNames = []string{"normal", "readonly", "maintenance"}
+
+var errReadOnly = errors.New("Server Read Only")
+var errMaintenance = errors.New("Server In Maintenance")
+
+var serverMode int32
+
+//按参数设置,SIGHUP改了参数时也调用
+func initMode() {
+	switch {
+	case *maintenanceMode:
+		setMode(modeMaintenance)
+	case *readOnlyMode:
+		setMode(modeReadOnly)
+	default:
+		setMode(modeNormal)
+	}
+}
+
+func currentMode() int32 {
+	return atomic.LoadInt32(&serverMode)
+}
+
+func setMode(m int32) {
+	old := atomic.SwapInt32(&serverMode, m)
+	if old != m {
+		logNotice("Server Mode", "from", modeNames[old], "to", modeNames[m])
+	}
+}
+
+//后台的清理任务在维护模式下跳过
+func inMaintenance() bool {
+	return currentMode() == modeMaintenance
+}
+
+//副本同步只在维护模式下拒绝
+func writeDenied(replica bool) error {
+	switch currentMode() {
+	case modeMaintenance:
+		return errMaintenance
+	case modeReadOnly:
+		if !replica {
+			return errReadOnly
+		}
+	}
+	return nil
+}
+
+//会修改文件的请求,流协议的连接在指令里检查
+func isWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case "PUT", "DELETE", "COPY", "MOVE", "MKCOL":
+		return true
+	case "POST":
+		q := r.URL.Query()
+		return q.Has("append") || q.Get("restore") != ""
+	}
+	return false
+}
+
+//拒绝时已经回复了
+func denyWrite(w http.ResponseWriter, r *http.Request) bool {
+	if !isWriteRequest(r) {
+		return false
+	}
+
+	err := writeDenied(isReplica(r))
+	if err == nil {
+		return false
+	}
+
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	reqLog(r).Notice(err.Error())
+	return true
+}
+
+//管理接口里会改文件的操作,只读和维护模式下也不能做
+func adminDenied(w http.ResponseWriter, r *http.Request) bool {
+	err := writeDenied(false)
+	if err == nil {
+		return false
+	}
+
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	reqLog(r).Notice(err.Error())
+	return true
+}
+
+func (f *fconn) checkMode() {
+	if err := writeDenied(f.replica); err != nil {
+		panic(NoticeError(err.Error()))
+	}
+}
+
+//GET 当前模式, POST ?action=normal|readonly|maintenance 切换
+func adminMode(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		action := r.URL.Query().Get("action")
+
+		m := -1
+		for i, name := range modeNames {
+			if name == action {
+				m = i
+			}
+		}
+		if m < 0 {
+			http.Error(w, "Action Error", http.StatusBadRequest)
+			return
+		}
+
+		setMode(int32(m))
+	}
+
+	writeJSON(w, map[string]string{"mode": modeNames[currentMode()]})
+}
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"path"
+	"errors"
+	"strings"
+	"net/http"
+	"path/filepath"
+	"encoding/json"
+)
+
+//集群配置变化后把本地文件迁到新的存放节点
+//用流协议传,对方校验hash后才改名成正式文件,本节点不再存放的全部迁完才删除
+//迁移期间读请求还由旧节点提供
+
+const (
+	REBALANCE_RUNNING = "running"
+	REBALANCE_PAUSED = "paused"
+	REBALANCE_DONE = "done"
+)
+
+//有失败的文件时,隔多久再扫一遍
+var rebalanceRetry = 30 * time.Second
+
+//进度多久保存一次
+var rebalanceSaveInterval = 5 * time.Second
+
+var errRebalanceStop = errors.New("rebalance stop")
+
+type rebalanceJob struct {
+	Old *clusterMap `json:"old"`
+	New *clusterMap `json:"new"`
+	State string `json:"state"`
+	//第几遍扫描,有失败的下一遍重试
+	Pass int `json:"pass"`
+	//这一遍已经处理到的路径,重启后接着处理
+	Checkpoint string `json:"checkpoint"`
+	Scanned int64 `json:"scanned"`
+	Copied int64 `json:"copied"`
+	Verified int64 `json:"verified"`
+	Removed int64 `json:"removed"`
+	Failed int64 `json:"failed"`
+	Bytes int64 `json:"bytes"`
+	LastError string `json:"last_error,omitempty"`
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+var rebalancer struct {
+	mu sync.Mutex
+	job *rebalanceJob
+	//迁移期间的旧集群
+	prev *ring
+	wake chan bool
+	file string
+}
+
+func initRebalance() {
+	rebalancer.file = filepath.Join(fs.rootdir, sysDirName, "rebalance.json")
+	rebalancer.wake = make(chan bool, 1)
+
+	data, err := os.ReadFile(rebalancer.file)
+	if err == nil {
+		job := new(rebalanceJob)
+		err = json.Unmarshal(data, job)
+		if err != nil || job.Old == nil || job.New == nil {
+			logWarning("Rebalance State Broken", "err", err)
+		} else if job.State != REBALANCE_DONE {
+			rebalancer.job = job
+			rebalancer.prev = newRing(job.Old)
+			logNotice("Rebalance Resume", "state", job.State, "checkpoint", job.Checkpoint)
+		}
+	}
+
+	go rebalanceLoop()
+}
+
+//迁移中返回旧集群
+func rebalancePrev() *ring {
+	rebalancer.mu.Lock()
+	defer rebalancer.mu.Unlock()
+	return rebalancer.prev
+}
+
+//新的迁移替换还没完成的,旧节点上没迁走的文件还会被新一轮扫描到
+func startRebalance(old, m *clusterMap) {
+	a, _ := json.Marshal(old)
+	b, _ := json.Marshal(m)
+	if string(a) == string(b) {
+		return
+	}
+
+	rebalancer.mu.Lock()
+	rebalancer.job = &rebalanceJob{
+		Old: old,
+		New: m,
+		State: REBALANCE_RUNNING,
+		Started: time.Now(),
+		Updated: time.Now(),
+	}
+	rebalancer.prev = newRing(old)
+	rebalancer.mu.Unlock()
+
+	rebalanceSave()
+	rebalanceWake()
+	logNotice("Rebalance Start")
+}
+
+func rebalanceWake() {
+	select {
+	case rebalancer.wake <- true:
+	default:
+	}
+}
+
+func rebalanceSave() {
+	rebalancer.mu.Lock()
+	defer rebalancer.mu.Unlock()
+
+	if rebalancer.job == nil {
+		return
+	}
+
+	rebalancer.job.Updated = time.Now()
+
+	data, err := json.MarshalIndent(rebalancer.job, "", "\t")
+	if err == nil {
+		err = writeFileSync(rebalancer.file, data)
+	}
+	if err != nil {
+		logWarning("Rebalance Save Error", "err", err)
+	}
+}
+
+//job被替换或暂停时返回错误
+func rebalanceCheck(job *rebalanceJob) error {
+	rebalancer.mu.Lock()
+	defer rebalancer.mu.Unlock()
+
+	if rebalancer.job != job || job.State != REBALANCE_RUNNING || isHandedOver() {
+		return errRebalanceStop
+	}
+	return nil
+}
+
+func rebalanceUpdate(fn func(job *rebalanceJob)) {
+	rebalancer.mu.Lock()
+	defer rebalancer.mu.Unlock()
+
+	if rebalancer.job != nil {
+		fn(rebalancer.job)
+	}
+}
+
+func rebalanceLoop() {
+	for {
+		rebalancer.mu.Lock()
+		job := rebalancer.job
+		running := job != nil && job.State == REBALANCE_RUNNING
+		rebalancer.mu.Unlock()
+
+		if !running || isHandedOver() {
+			<-rebalancer.wake
+			continue
+		}
+
+		failed, err := rebalancePass(job)
+
+		//新进程接着迁移,进度由它保存
+		if isHandedOver() {
+			<-rebalancer.wake
+			continue
+		}
+		rebalanceSave()
+
+		if err == errRebalanceStop {
+			continue
+		}
+
+		if err == nil && failed == 0 {
+			rebalancer.mu.Lock()
+			if rebalancer.job == job {
+				job.State = REBALANCE_DONE
+				job.Finished = time.Now()
+				rebalancer.prev = nil
+			}
+			rebalancer.mu.Unlock()
+
+			rebalanceSave()
+			logNotice("Rebalance Done", "copied", job.Copied, "removed", job.Removed)
+			continue
+		}
+
+		if err != nil {
+			logWarning("Rebalance Error", "err", err)
+		}
+
+		select {
+		case <-rebalancer.wake:
+		case <-time.After(rebalanceRetry):
+		}
+
+		rebalanceUpdate(func(j *rebalanceJob) {
+			if j == job {
+				j.Pass++
+				j.Checkpoint = ""
+			}
+		})
+	}
+}
+
+//按目录顺序扫描一遍本地文件
+func rebalancePass(job *rebalanceJob) (int, error) {
+	oldRg, newRg := newRing(job.Old), newRing(job.New)
+	sysdir := filepath.Join(fs.rootdir, sysDirName)
+
+	rebalancer.mu.Lock()
+	checkpoint := job.Checkpoint
+	rebalancer.mu.Unlock()
+
+	conns := make(map[string]*streamClient)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	failed := 0
+	lastSave := time.Now()
+
+	err := filepath.Walk(fs.rootdir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if name == sysdir {
+			return filepath.SkipDir
+		}
+
+		if !fi.Mode().IsRegular() || isRebalanceTemp(fi.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(fs.rootdir, name)
+		if err != nil {
+			return nil
+		}
+		p := "/" + filepath.ToSlash(rel)
+
+		if checkpoint != "" && !walkAfter(p, checkpoint) {
+			return nil
+		}
+
+		err = rebalanceCheck(job)
+		if err != nil {
+			return err
+		}
+
+		err = rebalanceFile(conns, oldRg, newRg, p, fi, job)
+		if err != nil {
+			failed++
+			logNotice("Rebalance File Error", "path", p, "err", err)
+		}
+
+		rebalanceUpdate(func(j *rebalanceJob) {
+			if j != job {
+				return
+			}
+			j.Scanned++
+			j.Checkpoint = p
+			if err != nil {
+				j.Failed++
+				j.LastError = p + ": " + err.Error()
+			}
+		})
+
+		if time.Since(lastSave) > rebalanceSaveInterval {
+			rebalanceSave()
+			lastSave = time.Now()
+		}
+
+		return nil
+	})
+
+	return failed, err
+}
+
+//按filepath.Walk的顺序(逐级按名字)比较
+func walkAfter(p, checkpoint string) bool {
+	a := strings.Split(p, "/")
+	b := strings.Split(checkpoint, "/")
+
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+
+	return len(a) > len(b)
+}
+
+const rebalanceTempPrefix = ".rebalance."
+
+func isRebalanceTemp(name string) bool {
+	return strings.HasPrefix(name, rebalanceTempPrefix)
+}
+
+func rebalanceFile(conns map[string]*streamClient, oldRg, newRg *ring, p string, fi os.FileInfo, job *rebalanceJob) error {
+	owners := newRg.Owners(p)
+
+	stay := false
+	for _, n := range owners {
+		if n.Name == *serverName {
+			stay = true
+		}
+	}
+
+	wasOwner := make(map[string]bool)
+	for _, n := range oldRg.Owners(p) {
+		wasOwner[n.Name] = true
+	}
+
+	//本节点还存放的只需要给新增的节点,要删除的必须确认所有节点都有了
+	var targets []*clusterNode
+	for _, n := range owners {
+		if n.Name != *serverName && (!stay || !wasOwner[n.Name]) {
+			targets = append(targets, n)
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil
+	}
+
+	sum, err := fs.Hash(p, "sha256", 0, -1)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range targets {
+		c := conns[n.Addr]
+		if c == nil {
+			c, err = dialStream(n.Addr)
+			if err != nil {
+				return err
+			}
+			conns[n.Addr] = c
+		}
+
+		copied, err := rebalanceCopy(c, n.Addr, p, sum, fi.Size())
+		if c.broken {
+			c.conn.Close()
+			delete(conns, n.Addr)
+		}
+		if err != nil {
+			return err
+		}
+
+		rebalanceUpdate(func(j *rebalanceJob) {
+			if j == job {
+				j.Verified++
+				if copied {
+					j.Copied++
+					j.Bytes += fi.Size()
+				}
+			}
+		})
+	}
+
+	if stay {
+		return nil
+	}
+
+	//所有新节点都确认过了才删除,只读和维护模式下留到以后
+	err = writeDenied(false)
+	if err != nil {
+		return err
+	}
+
+	err = fs.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	rebalanceUpdate(func(j *rebalanceJob) {
+		if j == job {
+			j.Removed++
+		}
+	})
+
+	return nil
+}
+
+//对方已经有相同内容或者更新的版本就不传了,返回是否传过
+//大小不同的内容肯定不一样,不用让对方算hash
+func rebalanceCopy(c *streamClient, addr, p, sum string, size int64) (bool, error) {
+	rsize, err := c.Stat(p)
+	if err == nil {
+		if rsize == size {
+			rsum, err := c.Hash(p, "sha256", size)
+			if err != nil {
+				return false, err
+			}
+			if rsum == sum {
+				return false, nil
+			}
+		}
+
+		//内容不一样,本地版本新才覆盖
+		rv, err := fetchVersion(addr, p)
+		if err != nil {
+			return false, err
+		}
+		if localVersion(p).vv.Compare(rv.vv) != VV_AFTER {
+			return false, nil
+		}
+	} else if !isStreamNotExist(err) {
+		return false, err
+	}
+
+	fp, err := fs.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+
+	dir, base := path.Split(p)
+	tmp := path.Join(dir, rebalanceTempPrefix + *serverName + "." + base)
+
+	err = c.Mkdir(dir, true)
+	if err != nil {
+		return false, err
+	}
+
+	pos, err := c.Open(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.Write(pos, fp)
+	if err1 := c.CloseFile(pos); err == nil {
+		err = err1
+	}
+
+	if err == nil {
+		var rsum string
+		rsum, err = c.Hash(tmp, "sha256", size)
+		if err == nil && rsum != sum {
+			err = errors.New("rebalance verify failed")
+		}
+	}
+
+	if err == nil {
+		err = c.Rename(tmp, p)
+	}
+
+	if err != nil {
+		if !c.broken {
+			c.Unlink(tmp)
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+//GET 取进度, POST ?action=pause|resume
+func adminRebalance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		rebalancer.mu.Lock()
+		var job rebalanceJob
+		if rebalancer.job != nil {
+			job = *rebalancer.job
+		}
+		has := rebalancer.job != nil
+		rebalancer.mu.Unlock()
+
+		if !has {
+			http.Error(w, "No Rebalance", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &job)
+	case "POST":
+		action := r.URL.Query().Get("action")
+
+		ok := false
+		rebalanceUpdate(func(j *rebalanceJob) {
+			switch {
+			case action == "pause" && j.State == REBALANCE_RUNNING:
+				j.State = REBALANCE_PAUSED
+				ok = true
+			case action == "resume" && j.State == REBALANCE_PAUSED:
+				j.State = REBALANCE_RUNNING
+				ok = true
+			}
+		})
+
+		if !ok {
+			http.Error(w, "Rebalance Action Error", http.StatusBadRequest)
+			return
+		}
+
+		rebalanceSave()
+		rebalanceWake()
+		reqLog(r).Notice("Rebalance", "action", action)
+		fmt.Fprint(w, "Success")
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
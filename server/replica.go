@@ -0,0 +1,739 @@
+package main
+
+import (
+	"io"
+	"bytes"
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/url"
+	"net/http"
+	"path/filepath"
+	"encoding/json"
+)
+
+const (
+	REPL_PUT = "put"
+	REPL_APPEND = "append"
+	REPL_DELETE = "delete"
+	REPL_MKDIR = "mkdir"
+	REPL_RENAME = "rename"
+	REPL_COPY = "copy"
+)
+
+//同步模式下等待副本确认的时间,超时后留在队列里重试
+var replicaSyncTimeout = 30 * time.Second
+
+var replicaClient = &http.Client{Timeout: 300 * time.Second}
+
+//副本请求的标记,值是来源节点名
+const replicaHeader = "Byfs-Replica"
+
+//副本保持和来源一样的修改时间,纳秒
+const mtimeHeader = "Byfs-Mtime"
+
+//追加后文件的长度,副本已经有这段数据就不再追加
+const appendEndHeader = "Byfs-Append-End"
+
+var repl *replicator
+
+//-peers 配置的副本节点,集群模式下不用
+var staticPeers []string
+
+//一次需要复制的修改
+type replOp struct {
+	Seq uint64 `json:"seq"`
+	Op string `json:"op"`
+	Path string `json:"path"`
+	To string `json:"to,omitempty"`
+	//REPL_DELETE 是否递归
+	Recursive bool `json:"recursive,omitempty"`
+	//REPL_APPEND 的数据, REPL_PUT 发送时才读文件
+	Data []byte `json:"data,omitempty"`
+	//REPL_APPEND 追加后文件的长度
+	End int64 `json:"end,omitempty"`
+	Time int64 `json:"time"`
+	//REPL_DELETE 删除时的版本, REPL_PUT 发送时取文件当时的版本
+	Version versionVector `json:"version,omitempty"`
+	VersionTime int64 `json:"vtime,omitempty"`
+}
+
+type replicator struct {
+	mu sync.Mutex
+	root string
+	peers map[string]*replPeer
+	sync bool
+}
+
+//上次没发完的队列接着发
+func newReplicator(sync bool, root string) (*replicator, error) {
+	r := &replicator{
+		sync: sync,
+		root: root,
+		peers: make(map[string]*replPeer),
+	}
+
+	dir := filepath.Join(root, sysDirName, "replica")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, n := range names {
+		addr := queueAddr(filepath.Join(dir, n), n)
+		if addr == "" {
+			continue
+		}
+		_, err = r.peer(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+//队列目录名里的冒号换成了下划线,地址另外存在addr文件里
+func queueDirName(addr string) string {
+	return strings.Replace(addr, ":", "_", -1)
+}
+
+//以前的队列目录没有addr文件,端口前面是最后一个下划线
+func queueAddr(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "addr"))
+	if err == nil {
+		return strings.TrimSpace(string(data))
+	}
+
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return ""
+	}
+	return name[:i] + ":" + name[i+1:]
+}
+
+func (r *replicator) peer(addr string) (*replPeer, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p := r.peers[addr]
+	if p != nil {
+		return p, nil
+	}
+
+	p, err := newReplPeer(addr, r.root)
+	if err != nil {
+		return nil, err
+	}
+
+	r.peers[addr] = p
+	go p.loop()
+
+	return p, nil
+}
+
+//先写进每个副本的队列,同步模式再等第一次发送的结果
+func (r *replicator) Replicate(op *replOp, addrs []string) error {
+	op.Time = time.Now().UnixNano()
+
+	var waits []chan error
+	var err error
+
+	for _, addr := range addrs {
+		p, err1 := r.peer(addr)
+		if err1 != nil {
+			err = err1
+			continue
+		}
+
+		c, err1 := p.push(op, r.sync)
+		if err1 != nil {
+			err = err1
+			continue
+		}
+		if c != nil {
+			waits = append(waits, c)
+		}
+	}
+
+	timeout := time.After(replicaSyncTimeout)
+	for _, c := range waits {
+		select {
+		case err1 := <-c:
+			if err1 != nil {
+				err = err1
+			}
+		case <-timeout:
+			return errors.New("replica ack timeout")
+		}
+	}
+
+	return err
+}
+
+//升级时拿写锁,发送队列时拿读锁
+var replPause sync.RWMutex
+
+var errHandedOver = errors.New("replica queue handed over to new process")
+
+//暂停所有的发送,等正在发的发完
+func (r *replicator) Pause() {
+	replPause.Lock()
+}
+
+func (r *replicator) Resume() {
+	replPause.Unlock()
+}
+
+//新进程接着发队列,老进程里等结果的请求不用再等
+func (r *replicator) HandOver() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.peers {
+		p.fail(errHandedOver)
+	}
+}
+
+//一个副本节点和它的持久化队列
+type replPeer struct {
+	addr string
+	dir string
+
+	mu sync.Mutex
+	seq uint64
+	waiters map[uint64]chan error
+	wake chan bool
+
+	//发送时文件已经不在的PUT,后面改名或复制了它时补发,只在loop里用
+	gone map[string]bool
+}
+
+func newReplPeer(addr string, root string) (*replPeer, error) {
+	p := &replPeer{
+		addr: addr,
+		dir: filepath.Join(root, sysDirName, "replica", queueDirName(addr)),
+		waiters: make(map[uint64]chan error),
+		wake: make(chan bool, 1),
+		gone: make(map[string]bool),
+	}
+
+	err := os.MkdirAll(p.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	addrFile := filepath.Join(p.dir, "addr")
+	if _, err := os.Stat(addrFile); os.IsNotExist(err) {
+		err = writeFileSync(addrFile, []byte(addr))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//接着上次的序号
+	names, err := p.queue()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > 0 {
+		p.seq, _ = strconv.ParseUint(strings.TrimSuffix(names[len(names)-1], ".json"), 10, 64)
+	}
+
+	return p, nil
+}
+
+func (p *replPeer) queue() ([]string, error) {
+	d, err := os.Open(p.dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	list := names[:0]
+	for _, n := range names {
+		if strings.HasSuffix(n, ".json") {
+			list = append(list, n)
+		}
+	}
+
+	//序号是定长的,按名字排就是按顺序
+	sort.Strings(list)
+	return list, nil
+}
+
+func (p *replPeer) push(op *replOp, wait bool) (chan error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	//序号按时间取,升级时新老进程同时写队列也不会重
+	seq := uint64(time.Now().UnixNano())
+	if seq <= p.seq {
+		seq = p.seq + 1
+	}
+
+	name := filepath.Join(p.dir, fmt.Sprintf("%020d.json", seq))
+	for {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			break
+		}
+		seq++
+		name = filepath.Join(p.dir, fmt.Sprintf("%020d.json", seq))
+	}
+	p.seq = seq
+
+	o := *op
+	o.Seq = seq
+
+	data, err := json.Marshal(&o)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFileSync(name, data)
+	if err != nil {
+		return nil, err
+	}
+
+	//已经交给新进程发了,等不到结果
+	if wait && isHandedOver() {
+		return nil, errHandedOver
+	}
+
+	var c chan error
+	if wait {
+		c = make(chan error, 1)
+		p.waiters[o.Seq] = c
+	}
+
+	select {
+	case p.wake <- true:
+	default:
+	}
+
+	return c, nil
+}
+
+func (p *replPeer) done(seq uint64, err error) {
+	p.mu.Lock()
+	c := p.waiters[seq]
+	delete(p.waiters, seq)
+	p.mu.Unlock()
+
+	if c != nil {
+		c <- err
+	}
+}
+
+func (p *replPeer) fail(err error) {
+	p.mu.Lock()
+	waiters := p.waiters
+	p.waiters = make(map[uint64]chan error)
+	p.mu.Unlock()
+
+	for _, c := range waiters {
+		c <- err
+	}
+}
+
+//按顺序发送,失败后退避重试,队头没成功后面的不会发
+func (p *replPeer) loop() {
+	backoff := time.Second
+
+	for {
+		names, err := p.queue()
+		if err != nil {
+			logWarning("Replica Queue Error", "peer", p.addr, "err", err)
+		}
+
+		if len(names) == 0 {
+			//改名和删除都在PUT之后进队列,队列空了就用不上了
+			clear(p.gone)
+
+			select {
+			case <-p.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+
+		var failed error
+
+		//升级时暂停,交给新进程后不再发
+		replPause.RLock()
+		for _, n := range names {
+			name := filepath.Join(p.dir, n)
+
+			op, err := readReplOp(name)
+			if err != nil {
+				logWarning("Replica Queue Broken", "file", name, "err", err)
+				os.Remove(name)
+				continue
+			}
+
+			err = p.send(op)
+			if err == errConflict {
+				//冲突上报模式下副本拒绝了,重试也没用
+				logNotice("Replica Conflict", "peer", p.addr, "op", op.Op, "path", op.Path)
+				err = nil
+			}
+			if err != nil {
+				logWarning("Replica Error", "peer", p.addr, "ops", n, "err", err)
+				failed = err
+				break
+			}
+
+			p.done(op.Seq, nil)
+			os.Remove(name)
+			backoff = time.Second
+		}
+		replPause.RUnlock()
+
+		if failed != nil {
+			//同步等待的请求不用等到重试成功
+			p.fail(failed)
+
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+		}
+	}
+}
+
+func (p *replPeer) send(op *replOp) error {
+	err := sendReplOp(p.addr, op)
+	if err == errFileGone {
+		p.gone[op.Path] = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch op.Op {
+	case REPL_RENAME, REPL_COPY:
+		for q := range p.gone {
+			if !hasPathPrefix(q, op.Path) {
+				continue
+			}
+			if op.Op == REPL_RENAME {
+				delete(p.gone, q)
+			}
+
+			//副本上刚改名过去的是没有内容的旧文件或者没有这个文件
+			to := op.To + strings.TrimPrefix(q, op.Path)
+			err = sendReplOp(p.addr, &replOp{Op: REPL_PUT, Path: to})
+			if err == errFileGone {
+				p.gone[to] = true
+				continue
+			}
+			if err != nil {
+				//重发改名时副本上没有源,会整个发目标
+				return err
+			}
+		}
+	case REPL_DELETE:
+		for q := range p.gone {
+			if hasPathPrefix(q, op.Path) {
+				delete(p.gone, q)
+			}
+		}
+	}
+
+	return nil
+}
+
+func readReplOp(name string) (*replOp, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	op := new(replOp)
+	err = json.Unmarshal(data, op)
+	return op, err
+}
+
+var errConflict = errors.New("version conflict")
+
+func sendReplOp(addr string, op *replOp) error {
+	var body io.Reader
+	var size int64 = -1
+	var mtime, expires int64
+	method := ""
+	query := ""
+	blob := ""
+
+	switch op.Op {
+	case REPL_PUT:
+		fp, err := fs.Open(op.Path)
+		if os.IsNotExist(err) {
+			//已经删了或改名了,后面会有删除或改名
+			return errFileGone
+		}
+		if err != nil {
+			return err
+		}
+		defer fp.Close()
+
+		fi, err := fp.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		//内容和版本都取发送时的
+		v := localVersion(op.Path)
+		op.Version, op.VersionTime = v.vv, v.time
+
+		method, body, size = "PUT", fp, fi.Size()
+		mtime = fi.ModTime().UnixNano()
+		expires = fs.Expires(op.Path)
+		blob = fs.blobOf(fs.pathToFile(op.Path))
+	case REPL_APPEND:
+		method, query = "POST", "append"
+		body, size = bytes.NewReader(op.Data), int64(len(op.Data))
+
+		fi, err := os.Stat(fs.pathToFile(op.Path))
+		if err == nil {
+			mtime = fi.ModTime().UnixNano()
+		}
+	case REPL_DELETE:
+		method = "DELETE"
+	case REPL_MKDIR:
+		method = "MKCOL"
+	case REPL_RENAME:
+		method = "MOVE"
+	case REPL_COPY:
+		method = "COPY"
+	default:
+		//不认识的直接丢掉
+		logWarning("Replica Op Error", "op", op.Op)
+		return nil
+	}
+
+	u := url.URL{Scheme: "http", Host: addr, Path: op.Path, RawQuery: query}
+
+	//去重的内容先只发sha256,对方没有这份内容再带上body
+	if blob != "" {
+		req, err := http.NewRequest(method, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		replHeader(req, op, mtime, expires)
+		req.Header.Set(sha256Header, blob)
+
+		err = doReplRequest(req, op)
+		if err != errBlobMissing {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 {
+		req.ContentLength = size
+	}
+
+	replHeader(req, op, mtime, expires)
+	err = doReplRequest(req, op)
+	if err == errSourceMissing {
+		return sendReplTree(addr, op.To)
+	}
+	return err
+}
+
+//副本上没有改名或复制的源,直接发目标现在的内容,目录整个发
+func sendReplTree(addr, p string) error {
+	return filepath.Walk(fs.pathToFile(p), func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		op := &replOp{Op: REPL_PUT, Path: fs.localToPath(name)}
+		if fi.IsDir() {
+			op.Op = REPL_MKDIR
+		}
+
+		err = sendReplOp(addr, op)
+		if err == errFileGone {
+			return nil
+		}
+		return err
+	})
+}
+
+var errFileGone = errors.New("file gone")
+var errBlobMissing = errors.New("blob missing")
+var errSourceMissing = errors.New("source missing")
+
+func replHeader(req *http.Request, op *replOp, mtime, expires int64) {
+	internalHeader(req)
+	if op.To != "" {
+		req.Header.Set("Destination", op.To)
+	}
+	if op.Recursive {
+		req.Header.Set("Byfs-Recursive", "1")
+	}
+	if mtime > 0 {
+		req.Header.Set(mtimeHeader, strconv.FormatInt(mtime, 10))
+	}
+	if expires > 0 {
+		req.Header.Set(expiresHeader, strconv.FormatInt(expires, 10))
+	}
+	if op.End > 0 {
+		req.Header.Set(appendEndHeader, strconv.FormatInt(op.End, 10))
+	}
+	if len(op.Version) > 0 {
+		setVersionHeader(req.Header, &objVersion{vv: op.Version, time: op.VersionTime})
+	}
+}
+
+func doReplRequest(req *http.Request, op *replOp) error {
+	resp, err := replicaClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusConflict {
+		return errConflict
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed && req.Header.Get(sha256Header) != "" {
+		return errBlobMissing
+	}
+	if resp.StatusCode == http.StatusNotFound && (op.Op == REPL_RENAME || op.Op == REPL_COPY) {
+		return errSourceMissing
+	}
+	if resp.StatusCode != http.StatusOK || string(msg) != "Success" {
+		return fmt.Errorf("%s %s: %s", resp.Status, op.Op, msg)
+	}
+
+	return nil
+}
+
+func replicaName() string {
+	if *serverName != "" {
+		return *serverName
+	}
+	return "1"
+}
+
+//副本节点发来的请求不再往外复制,签名不对的头在verifyPeer里已经去掉
+func isReplica(r *http.Request) bool {
+	return r.Header.Get(replicaHeader) != ""
+}
+
+//副本上文件已经不存在或已经存在都当作成功,差异留给后台修复
+func replicaIgnore(r *http.Request, err error) bool {
+	return isReplica(r) && (os.IsNotExist(err) || os.IsExist(err))
+}
+
+//改名和复制的源在副本上不存在,一般是前面的PUT发送时文件已经改名了
+//回复404,来源节点改发目标的内容
+func replicaSourceMissing(w http.ResponseWriter, r *http.Request, name string, err error) bool {
+	if !isReplica(r) || !os.IsNotExist(err) {
+		return false
+	}
+
+	_, err = os.Lstat(fs.pathToFile(name))
+	if !os.IsNotExist(err) {
+		return false
+	}
+
+	http.Error(w, "Source Not Found", http.StatusNotFound)
+	return true
+}
+
+//r为nil表示来自流协议
+//同步模式下副本没确认或写队列失败时返回错误,本地已经改了,留在队列里重试
+func replicate(r *http.Request, op *replOp) error {
+	if repl == nil || (r != nil && isReplica(r)) {
+		return nil
+	}
+
+	addrs := replicaTargets(op.Path)
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	err := repl.Replicate(op, addrs)
+	if err != nil {
+		logWarning("Replica Queued", "op", op.Op, "path", op.Path, "err", err)
+	}
+	return err
+}
+
+//副本失败时回复客户端
+func replicaResult(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	fmt.Fprint(w, "Replica Error ", err)
+	reqLog(r).Notice("Replica Error", "err", err)
+	return false
+}
+
+func applyMtime(p string, h http.Header) {
+	mtime, err := strconv.ParseInt(h.Get(mtimeHeader), 10, 64)
+	if err != nil || mtime <= 0 {
+		return
+	}
+
+	t := time.Unix(0, mtime)
+	os.Chtimes(fs.pathToFile(p), t, t)
+}
+
+func writeFileSync(name string, data []byte) error {
+	tmp := name + ".tmp"
+
+	fp, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = fp.Write(data)
+	if err == nil {
+		err = fp.Sync()
+	}
+	if err1 := fp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"sync/atomic"
+	"path/filepath"
+	"net/http/httptest"
+)
+
+//副本已经有的部分不再写
+func TestAppendAt(t *testing.T) {
+	cases := []struct {
+		name string
+		have string
+		data string
+		at int64
+		want string
+		off int64
+	}{
+		{"plain", "ab", "cd", -1, "abcd", 2},
+		{"new file", "", "cd", -1, "cd", 0},
+		{"at end", "ab", "cd", 2, "abcd", 2},
+		{"already there", "abcd", "cd", 2, "abcd", 2},
+		{"half there", "abc", "cd", 2, "abcd", 2},
+		{"replica behind", "a", "cd", 2, "acd", 1},
+	}
+
+	for _, c := range cases {
+		f := testRoot(t)
+		if c.have != "" {
+			os.WriteFile(filepath.Join(f.rootdir, "log"), []byte(c.have), 0644)
+		}
+
+		off, err := f.AppendAt("/log", []byte(c.data), "", c.at)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		data, _ := os.ReadFile(filepath.Join(f.rootdir, "log"))
+		if string(data) != c.want || off != c.off {
+			t.Errorf("%s: got %q at %d, want %q at %d", c.name, data, off, c.want, c.off)
+		}
+	}
+}
+
+//PUT发送时读的是当时的内容,已经包含了后面排着的追加,重放追加不能再写一次
+func TestReplicaAppendReplay(t *testing.T) {
+	atomic.StoreInt64(&liveMaxAppend, 1 << 20)
+
+	cases := []struct {
+		name string
+		have string
+		version string
+		data string
+		end string
+		inVersion string
+		want string
+		wantVersion string
+	}{
+		//集群模式,PUT带的版本已经包含这次追加
+		{"covered by put", "hello+one", "n1=2", "+one", "9", "n1=2", "hello+one", "n1=2"},
+		{"older append", "hello+one+two", "n1=3", "+one", "9", "n1=2", "hello+one+two", "n1=3"},
+		{"newer append", "hello+one", "n1=2", "+two", "13", "n1=3", "hello+one+two", "n1=3"},
+		//没有版本的副本只看位置
+		{"peers covered", "hello+one", "", "+one", "9", "", "hello+one", ""},
+		{"peers half", "hello+o", "", "+one", "9", "", "hello+one", ""},
+		{"peers new", "hello", "", "+one", "9", "", "hello+one", ""},
+		//旧的队列里没有位置,照原来的追加
+		{"no end", "hello", "", "+one", "", "", "hello+one", ""},
+	}
+
+	for _, c := range cases {
+		f := testRoot(t)
+		os.WriteFile(filepath.Join(f.rootdir, "log"), []byte(c.have), 0644)
+		if c.version != "" {
+			vv, _ := parseVector(c.version)
+			setVersion("/log", &objVersion{vv: vv, time: 1})
+		}
+
+		r := httptest.NewRequest("POST", "/log?append", strings.NewReader(c.data))
+		r.Header.Set(replicaHeader, "n1")
+		if c.end != "" {
+			r.Header.Set(appendEndHeader, c.end)
+		}
+		if c.inVersion != "" {
+			r.Header.Set(vectorHeader, c.inVersion)
+			r.Header.Set(vtimeHeader, "2")
+		}
+
+		w := httptest.NewRecorder()
+		appendFile(w, r)
+		if w.Body.String() != "Success" {
+			t.Fatalf("%s: %s", c.name, w.Body.String())
+		}
+
+		data, _ := os.ReadFile(filepath.Join(f.rootdir, "log"))
+		if string(data) != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, data, c.want)
+		}
+		if v := localVersion("/log"); v.vv.String() != c.wantVersion {
+			t.Errorf("%s: version %q, want %q", c.name, v.vv, c.wantVersion)
+		}
+	}
+}
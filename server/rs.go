@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+)
+
+//GF(2^8) 上的 Reed-Solomon, 生成多项式 x^8+x^4+x^3+x^2+1 (0x11d)
+
+var gfExp [512]byte
+var gfLog [256]byte
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x & 0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a]) + int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255 - int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(int(gfLog[a]) * n) % 255]
+}
+
+type gfMatrix [][]byte
+
+func newMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (m gfMatrix) Mul(o gfMatrix) gfMatrix {
+	r := newMatrix(len(m), len(o[0]))
+	for i := range m {
+		for j := range o[0] {
+			var v byte
+			for k := range o {
+				v ^= gfMul(m[i][k], o[k][j])
+			}
+			r[i][j] = v
+		}
+	}
+	return r
+}
+
+//高斯消元求逆
+func (m gfMatrix) Invert() (gfMatrix, error) {
+	n := len(m)
+	work := newMatrix(n, n*2)
+	for i := range m {
+		copy(work[i], m[i])
+		work[i][n+i] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		p := c
+		for p < n && work[p][c] == 0 {
+			p++
+		}
+		if p == n {
+			return nil, errors.New("matrix is singular")
+		}
+		work[c], work[p] = work[p], work[c]
+
+		inv := gfInv(work[c][c])
+		for j := range work[c] {
+			work[c][j] = gfMul(work[c][j], inv)
+		}
+
+		for r := 0; r < n; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			f := work[r][c]
+			for j := range work[r] {
+				work[r][j] ^= gfMul(f, work[c][j])
+			}
+		}
+	}
+
+	res := newMatrix(n, n)
+	for i := range res {
+		copy(res[i], work[i][n:])
+	}
+	return res, nil
+}
+
+//data个数据分片加parity个校验分片
+type reedSolomon struct {
+	data, parity int
+	//(data+parity) x data, 上面是单位矩阵
+	matrix gfMatrix
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data < 1 || parity < 1 || data + parity > 255 {
+		return nil, errors.New("erasure shards error")
+	}
+
+	total := data + parity
+
+	vm := newMatrix(total, data)
+	for r := range vm {
+		for c := range vm[r] {
+			vm[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	top, err := gfMatrix(vm[:data]).Invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &reedSolomon{data: data, parity: parity, matrix: vm.Mul(top)}, nil
+}
+
+//shards前data个是数据,按同样长度填好后面的校验分片
+func (rs *reedSolomon) Encode(shards [][]byte) {
+	rs.apply(rs.matrix[rs.data:], shards[:rs.data], shards[rs.data:])
+}
+
+//have是可用分片的序号(正好data个),in是对应的内容,恢复出全部数据分片到out
+func (rs *reedSolomon) Reconstruct(have []int, in [][]byte, out [][]byte) error {
+	if len(have) != rs.data {
+		return errors.New("erasure shards not enough")
+	}
+
+	sub := newMatrix(rs.data, rs.data)
+	for i, idx := range have {
+		copy(sub[i], rs.matrix[idx])
+	}
+
+	dec, err := sub.Invert()
+	if err != nil {
+		return err
+	}
+
+	rs.apply(dec, in, out)
+	return nil
+}
+
+func (rs *reedSolomon) apply(m gfMatrix, in [][]byte, out [][]byte) {
+	for r := range out {
+		o := out[r]
+		for x := range o {
+			o[x] = 0
+		}
+
+		for c, src := range in {
+			f := m[r][c]
+			if f == 0 {
+				continue
+			}
+			if f == 1 {
+				for x := range o {
+					o[x] ^= src[x]
+				}
+				continue
+			}
+
+			//按系数查表
+			lf := int(gfLog[f])
+			for x, b := range src {
+				if b != 0 {
+					o[x] ^= gfExp[lf + int(gfLog[b])]
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"math/rand"
+)
+
+var rsConfigs = [][2]int{{1, 1}, {2, 1}, {3, 2}, {4, 2}, {6, 3}, {10, 4}}
+
+//随机内容编码,返回全部分片
+func rsEncoded(rs *reedSolomon, size int) [][]byte {
+	r := rand.New(rand.NewSource(int64(rs.data * 1000 + rs.parity)))
+
+	shards := make([][]byte, rs.data + rs.parity)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < rs.data {
+			r.Read(shards[i])
+		}
+	}
+
+	rs.Encode(shards)
+	return shards
+}
+
+//total个里选k个的所有组合
+func combinations(total, k int, fn func(have []int)) {
+	have := make([]int, 0, k)
+
+	var walk func(start int)
+	walk = func(start int) {
+		if len(have) == k {
+			fn(have)
+			return
+		}
+		for i := start; i <= total - (k - len(have)); i++ {
+			have = append(have, i)
+			walk(i + 1)
+			have = have[:len(have)-1]
+		}
+	}
+	walk(0)
+}
+
+func TestReedSolomonEncodeKeepsData(t *testing.T) {
+	for _, c := range rsConfigs {
+		rs, err := newReedSolomon(c[0], c[1])
+		if err != nil {
+			t.Fatal(c, err)
+		}
+
+		shards := rsEncoded(rs, 1000)
+		data := make([][]byte, rs.data)
+		for i := range data {
+			data[i] = append([]byte(nil), shards[i]...)
+		}
+
+		//再编码一次数据分片不变,校验分片一样
+		again := make([][]byte, len(shards))
+		for i := range again {
+			again[i] = append([]byte(nil), shards[i]...)
+		}
+		rs.Encode(again)
+
+		for i := range shards {
+			if i < rs.data && !bytes.Equal(shards[i], data[i]) {
+				t.Fatalf("%d+%d data shard %d changed", c[0], c[1], i)
+			}
+			if !bytes.Equal(shards[i], again[i]) {
+				t.Fatalf("%d+%d shard %d not stable", c[0], c[1], i)
+			}
+		}
+	}
+}
+
+//去掉任意parity个分片,剩下的任意data个都能恢复出全部数据分片
+func TestReedSolomonReconstructEveryCombination(t *testing.T) {
+	for _, c := range rsConfigs {
+		rs, err := newReedSolomon(c[0], c[1])
+		if err != nil {
+			t.Fatal(c, err)
+		}
+
+		total := rs.data + rs.parity
+		shards := rsEncoded(rs, 257)
+
+		count := 0
+		combinations(total, rs.data, func(have []int) {
+			count++
+
+			in := make([][]byte, len(have))
+			for j, i := range have {
+				in[j] = shards[i]
+			}
+
+			out := make([][]byte, rs.data)
+			for i := range out {
+				out[i] = make([]byte, len(shards[0]))
+			}
+
+			err := rs.Reconstruct(have, in, out)
+			if err != nil {
+				t.Fatalf("%d+%d have %v: %v", c[0], c[1], have, err)
+			}
+
+			for i := range out {
+				if !bytes.Equal(out[i], shards[i]) {
+					t.Fatalf("%d+%d have %v: data shard %d wrong", c[0], c[1], have, i)
+				}
+			}
+		})
+
+		if count == 0 {
+			t.Fatalf("%d+%d no combination tested", c[0], c[1])
+		}
+	}
+}
+
+func TestReedSolomonNotEnoughShards(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shards := rsEncoded(rs, 16)
+	out := make([][]byte, 4)
+	for i := range out {
+		out[i] = make([]byte, 16)
+	}
+
+	err = rs.Reconstruct([]int{0, 1, 5}, [][]byte{shards[0], shards[1], shards[5]}, out)
+	if err == nil {
+		t.Fatal("reconstruct with 3 of 4 shards should fail")
+	}
+}
+
+func TestReedSolomonConfigError(t *testing.T) {
+	for _, c := range [][2]int{{0, 1}, {1, 0}, {200, 56}} {
+		if _, err := newReedSolomon(c[0], c[1]); err == nil {
+			t.Fatalf("%d+%d should fail", c[0], c[1])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+	"context"
+	"net/http"
+	"sync/atomic"
+)
+
+//平滑退出
+//先停止接收新连接,等进行中的HTTP请求做完
+//流连接在两个指令之间发CODE_SERVER_CLOSE通知客户端重连,正在执行的指令做完再发
+//还有打开的文件的,等客户端关掉文件再发
+//超过期限还没结束的,把打开的文件落盘后直接退出
+
+var httpServers struct {
+	mu sync.Mutex
+	list []*http.Server
+}
+
+//退出时要关闭的监听
+func trackServer(s *http.Server) {
+	httpServers.mu.Lock()
+	httpServers.list = append(httpServers.list, s)
+	httpServers.mu.Unlock()
+}
+
+var streams struct {
+	mu sync.Mutex
+	conns map[*fconn]bool
+	wg sync.WaitGroup
+	//关闭后开始退出
+	stop chan struct{}
+	//连接自己读,不用拿锁
+	stopping int32
+}
+
+func init() {
+	streams.conns = make(map[*fconn]bool)
+	streams.stop = make(chan struct{})
+}
+
+func isStopping() bool {
+	return atomic.LoadInt32(&streams.stopping) == 1
+}
+
+//退出中不再接受新的流连接
+func streamRegister(f *fconn) bool {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+
+	if isStopping() {
+		return false
+	}
+
+	streams.conns[f] = true
+	streams.wg.Add(1)
+	return true
+}
+
+func streamUnregister(f *fconn) {
+	streams.mu.Lock()
+	delete(streams.conns, f)
+	streams.mu.Unlock()
+
+	streams.wg.Done()
+}
+
+func gracefulShutdown(timeout time.Duration) {
+	logNotice("Shutting Down", "timeout", timeout.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	//流连接是劫持过的,http.Server不管,要自己通知
+	streams.mu.Lock()
+	atomic.StoreInt32(&streams.stopping, 1)
+	close(streams.stop)
+	for f := range streams.conns {
+		f.wakeIdle()
+	}
+	streams.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	httpServers.mu.Lock()
+	for _, s := range httpServers.list {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			err := s.Shutdown(ctx)
+			if err != nil {
+				logWarning("HTTP Shutdown Error", "addr", s.Addr, "err", err)
+			}
+		}(s)
+	}
+	httpServers.mu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		done := make(chan struct{})
+		go func() {
+			streams.wg.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			streamForceSync()
+		}
+	}()
+
+	wg.Wait()
+	logNotice("Shutdown Complete")
+}
+
+//到期还没结束的连接,打开的文件先落盘
+func streamForceSync() {
+	streams.mu.Lock()
+	defer streams.mu.Unlock()
+
+	logWarning("Shutdown Timeout, Stream Left", "streams", len(streams.conns))
+
+	for f := range streams.conns {
+		f.mu.Lock()
+		for _, fp := range f.files {
+			err := fp.Sync()
+			if err != nil {
+				logWarning("Sync Error", "path", fp.path, "err", err)
+			}
+		}
+		f.mu.Unlock()
+	}
+}
+
+//空闲等待下一个指令的连接,让读马上超时返回
+func (f *fconn) wakeIdle() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.idle && len(f.files) == 0 {
+		f.conn.SetReadDeadline(time.Now())
+	}
+}
+
+//读下一个指令,退出中并且没有打开的文件时返回false
+func (f *fconn) nextCode() (code uint16, ok bool) {
+	f.mu.Lock()
+	if isStopping() && len(f.files) == 0 {
+		f.mu.Unlock()
+		return 0, false
+	}
+	f.idle = true
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.idle = false
+		f.mu.Unlock()
+
+		//被wakeIdle打断的
+		if x := recover(); x != nil {
+			if _, fatal := x.(FatalError); !fatal || !isStopping() || len(f.files) > 0 {
+				panic(x)
+			}
+			code, ok = 0, false
+		}
+	}()
+
+	return f.readUint16(), true
+}
+
+//发完CODE_SERVER_CLOSE后等客户端断开的时间
+var serverCloseDrain = 2 * time.Second
+
+//告诉客户端服务器要关闭了,这时没有指令在执行
+//客户端可能已经发出了下一个指令,只关写的一半,调用方读完它发来的数据再关
+//带着没读的数据直接关,对方会收到RST,可能连CODE_SERVER_CLOSE都读不到
+func (f *fconn) sendServerClose() {
+	f.writeTimeLimit()
+	f.writeUint16(CODE_SERVER_CLOSE)
+	f.flush()
+
+	if cw, ok := f.conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
+
+//丢掉客户端发来的数据,直到客户端断开或超时
+func (f *fconn) drain() {
+	f.conn.SetReadDeadline(time.Now().Add(serverCloseDrain))
+	io.Copy(io.Discard, f.bufrw.Reader)
+}
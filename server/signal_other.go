@@ -0,0 +1,15 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//没有SIGUSR2,不支持不停服升级
+var watchSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+func isUpgradeSignal(s os.Signal) bool {
+	return false
+}
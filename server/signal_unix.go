@@ -0,0 +1,15 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//退出、重新加载配置和不停服升级
+var watchSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGUSR2, syscall.SIGHUP}
+
+func isUpgradeSignal(s os.Signal) bool {
+	return s == syscall.SIGUSR2
+}
@@ -4,17 +4,22 @@ import (
 	"net"
 	"net/http"
 	"time"
-	"log"
 	"bufio"
 	"os"
 	"fmt"
 	"io"
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"path/filepath"
 	"encoding/binary"
 )
 
 const (
 	CODE_AUTH = 0xee01
 	CODE_CLOSE = 0xee02
+	//服务器要关闭,在指令之间代替状态字节发给客户端
+	CODE_SERVER_CLOSE = 0xee03
 
 	CODE_FILE_OPEN = 0xff01
 	CODE_FILE_READ = 0xff02
@@ -24,6 +29,8 @@ const (
 	CODE_FILE_FLUSH = 0xff06
 	CODE_FILE_TRUNCATE = 0xff07
 	CODE_FILE_CLOSE = 0xff08
+	CODE_FILE_HASH = 0xff09
+	CODE_FILE_APPEND = 0xff0a
 
 	CODE_DIR_OPEN = 0xfe01
 	CODE_DIR_READ = 0xfe02
@@ -34,8 +41,49 @@ const (
 	CODE_RENAME = 0xfc03
 	CODE_STAT = 0xfc04
 	CODE_LSTAT = 0xfc05
+	CODE_COPY = 0xfc06
+	CODE_UNLINK = 0xfc07
+	CODE_RMDIR_ALL = 0xfc08
+
+	CODE_WATCH = 0xfd01
+	CODE_WATCH_EVENT = 0xfd02
+	CODE_WATCH_PING = 0xfd03
+	CODE_WATCH_STOP = 0xfd04
 )
 
+//监控和日志里用的指令名
+var codeNames = map[uint16]string{
+	CODE_FILE_OPEN: "fopen",
+	CODE_FILE_READ: "fread",
+	CODE_FILE_WRITE: "fwrite",
+	CODE_FILE_SEEK: "fseek",
+	CODE_FILE_STAT: "fstat",
+	CODE_FILE_FLUSH: "flush",
+	CODE_FILE_TRUNCATE: "truncate",
+	CODE_FILE_CLOSE: "fclose",
+	CODE_FILE_HASH: "fhash",
+	CODE_FILE_APPEND: "fappend",
+	CODE_DIR_OPEN: "opendir",
+	CODE_DIR_READ: "readdir",
+	CODE_DIR_CLOSE: "closedir",
+	CODE_MKDIR: "mkdir",
+	CODE_RMDIR: "rmdir",
+	CODE_RENAME: "rename",
+	CODE_STAT: "stat",
+	CODE_LSTAT: "lstat",
+	CODE_COPY: "copy",
+	CODE_UNLINK: "unlink",
+	CODE_RMDIR_ALL: "rmdir_all",
+	CODE_WATCH: "watch",
+}
+
+func codeName(code uint16) string {
+	if name, ok := codeNames[code]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 var (
 	//成功
 	status_ok uint8 = 0xff
@@ -43,8 +91,7 @@ var (
 	status_fail uint8 = 0xfe
 )
 
-var actionTimeout = 3 * time.Second
-var idleTimeout = 300 * time.Second
+var watchPingInterval = 30 * time.Second
 
 type FatalError string
 func (e FatalError) Error() string {
@@ -64,22 +111,45 @@ func (e NoticeError) Error() string {
 type fconn struct{
 	conn net.Conn
 	bufrw *bufio.ReadWriter
+	//收发的字节数
+	cc *countConn
 	files map[uint32]*file
 	pos uint32
 	pass string
 	token string
+	//客户端要求关闭
+	closed bool
+	//其它节点的连接(比如数据迁移),不再往外复制
+	replica bool
+	//访问密钥,新建的文件记在它名下
+	key string
+	//连接ID,就是升级请求的ID
+	id string
+	//带连接ID和客户端地址
+	log logger
+	//正在执行的指令和路径,日志用
+	op uint16
+	opPath string
+	//改名和复制的目标
+	opTo string
+	//连接时用Byfs-Volume选的卷
+	vol *volume
+	//退出时别的goroutine会访问files和idle
+	mu sync.Mutex
+	//在等下一个指令
+	idle bool
 }
 
 func FconnInit(w http.ResponseWriter, r *http.Request, password string) (*fconn, bool) {
 	if r.Header.Get("Connection") != "Upgrade" {
 		http.Error(w, "Connection Need Upgrade", http.StatusPreconditionFailed)
-		log.Println("Connection Need Upgrade", r.RemoteAddr)
+		reqLog(r).Notice("Connection Need Upgrade")
 		return nil, false
 	}
 
 	if r.Header.Get("Upgrade") != "Byfs-Stream" {
 		http.Error(w, "Upgrade Error", http.StatusPreconditionFailed)
-		log.Println("Upgrade Error", r.RemoteAddr)
+		reqLog(r).Notice("Upgrade Error")
 		return nil, false
 	}
 
@@ -110,9 +180,15 @@ func FconnInit(w http.ResponseWriter, r *http.Request, password string) (*fconn,
 		return nil, false
 	}
 
+	//之后的收发都经过计数,劫持时已经读进缓冲的数据放在前面
+	cc := &countConn{Conn: conn}
+	pre, _ := bufrw.Reader.Peek(bufrw.Reader.Buffered())
+	rd := io.MultiReader(bytes.NewReader(append([]byte(nil), pre...)), cc)
+
 	f := &fconn{}
 	f.conn = conn
-	f.bufrw = bufrw
+	f.cc = cc
+	f.bufrw = bufio.NewReadWriter(bufio.NewReader(rd), bufio.NewWriter(cc))
 	f.token = token
 	f.pass = password
 	f.files = make(map[uint32]*file)
@@ -121,12 +197,26 @@ func FconnInit(w http.ResponseWriter, r *http.Request, password string) (*fconn,
 }
 
 func (f *fconn) close() {
-	for _, fp := range f.files {
+	f.mu.Lock()
+	files := f.files
+	f.files = make(map[uint32]*file)
+
+	for _, fp := range files {
+		//退出时保证落盘
+		if isStopping() {
+			fp.Sync()
+		}
 		fp.Close()
 	}
 
 	f.bufrw.Flush()
 	f.conn.Close()
+	f.mu.Unlock()
+
+	//同步模式下要等副本确认,不能拿着锁等
+	for _, fp := range files {
+		f.replicateFile(fp)
+	}
 }
 
 func (f *fconn) auth() {
@@ -135,6 +225,7 @@ func (f *fconn) auth() {
 
 	//协议错误
 	if code != CODE_AUTH {
+		authFailed("stream")
 		panic(FatalError("Auth Code Not Give"))
 	}
 
@@ -143,19 +234,17 @@ func (f *fconn) auth() {
 
 	ok := tokenAuth(f.token, f.pass, data)
 	if !ok {
+		authFailed("stream")
 		panic(FatalError("Auth Error"))
 	}
 }
 
 func (f *fconn) run() {
-		log.Println("run")
 	defer func() {
-		log.Println("defer")
 		if x := recover(); x != nil {
-			log.Println(x)
 			switch v := x.(type) {
 			case FatalError :
-				log.Println("[Fatal]", v, f.conn.RemoteAddr())
+				f.opLog().Fatal(string(v))
 			default:
 				panic(x)
 			}
@@ -164,38 +253,63 @@ func (f *fconn) run() {
 
 	//这里要求马上认证
 	if f.pass != "" {
-		log.Println("auth")
 		f.auth()
 	}
 
 	for {
 		f.idleTimeLimit()
-		code := f.readUint16()
+		code, ok := f.nextCode()
+		if !ok {
+			f.sendServerClose()
+			f.drain()
+			return
+		}
 
 		if code == CODE_CLOSE {
-			log.Println("link CLOSE")
 			return
 		}
 
-		log.Printf("code 0x%x", code)
 		f._run(code)
+
+		if f.closed {
+			return
+		}
 	}
 }
 
 func (f *fconn) _run(code uint16) {
+	start := time.Now()
+	in, out := f.consumed(), atomic.LoadInt64(&f.cc.out)
+	f.op, f.opPath, f.opTo = code, "", ""
+
 	defer func() {
-		if x := recover(); x != nil {
+		status := "ok"
+		x := recover()
+		if x != nil {
 			switch v := x.(type) {
 			case NoticeError :
-				log.Println("[Notice]", v)
+				status = "notice"
+				f.opLog().Notice(string(v))
 				f.writeError("[Notice]", v)
 			case WarningError :
-				log.Println("[Warning]", v)
+				status = "warning"
+				f.opLog().Warning(string(v))
 				f.writeError("[Warning]", v)
 			default:
-				panic(x)
+				status = "fatal"
 			}
 		}
+
+		d := time.Since(start)
+		bytesIn, bytesOut := f.consumed() - in, atomic.LoadInt64(&f.cc.out) - out
+		streamOpDone(code, status, d)
+		f.accessOp(code, status, bytesIn, bytesOut, d)
+		f.opLog().Debug("op done", "status", status, "duration_ms", ms(d), "bytes_in", bytesIn, "bytes_out", bytesOut)
+
+		if status == "fatal" {
+			panic(x)
+		}
+		f.op = 0
 	}()
 
 	switch (code) {
@@ -215,6 +329,10 @@ func (f *fconn) _run(code uint16) {
 			f.a_truncate()
 		case CODE_FILE_CLOSE :
 			f.a_fclose()
+		case CODE_FILE_HASH :
+			f.a_fhash()
+		case CODE_FILE_APPEND :
+			f.a_fappend()
 
 		case CODE_DIR_OPEN :
 			f.a_opendir()
@@ -233,6 +351,15 @@ func (f *fconn) _run(code uint16) {
 			f.a_stat()
 		case CODE_LSTAT :
 			f.a_lstat()
+		case CODE_COPY :
+			f.a_copy()
+		case CODE_UNLINK :
+			f.a_unlink()
+		case CODE_RMDIR_ALL :
+			f.a_rmdir_all()
+
+		case CODE_WATCH :
+			f.a_watch()
 		default:
 			panic(FatalError("未定义的指令"))
 	}
@@ -243,16 +370,83 @@ func (f *fconn) _run(code uint16) {
 
 func (f *fconn) a_fopen() {
 	f.readTimeLimit()
-	name := f.readString()
+	name := f.readPath()
 	flag := f.readInt32()
 
-	fp, err := fs.OpenFile(name, int(flag))
+	setExpires := flag & O_EXPIRES != 0
+	var expires int64
+	if setExpires {
+		expires = f.readInt64()
+		flag &^= O_EXPIRES
+	}
+
+	v, vfs, name := f.resolve(name)
+	if int(flag) & (os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 || setExpires {
+		f.writable(v)
+	}
+
+	//过期清理只在默认的根目录
+	if v != nil && setExpires {
+		panic(NoticeError("Volume Not Support Expires"))
+	}
+	if v == nil {
+		reapIfExpired(name, f.replica)
+		//不能写的模式下没清理掉
+		if fs.Expired(name) {
+			panic(WarningError(expiredError("open", name).Error()))
+		}
+	}
+
+	//截断的部分从用量里减掉
+	var truncated int64
+	if int(flag) & os.O_TRUNC != 0 && int(flag) & (os.O_WRONLY|os.O_RDWR) != 0 {
+		if fi, err := os.Lstat(vfs.pathToFile(name)); err == nil {
+			truncated = fi.Size()
+		}
+	}
+
+	//纠删码存储的文件只能读
+	man := vfs.erasure(name)
+	if man != nil && int(flag) & (os.O_WRONLY|os.O_RDWR) != 0 {
+		panic(NoticeError("Erasure File Read Only"))
+	}
+
+	var fp *file
+	var err error
+	if man != nil {
+		fp, err = vfs.openErasure(name, man)
+	} else {
+		fp, err = vfs.OpenFile(name, int(flag))
+	}
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
 
+	if fp.created {
+		err = fp.root.quota.charge(fp.path, f.key, 0, 1)
+		if err != nil {
+			fp.ghost = true
+			fp.Close()
+			panic(NoticeError(err.Error()))
+		}
+		fp.owner = f.key
+		vfs.setOwner(fp.name, f.key)
+	} else if truncated > 0 {
+		fp.root.quota.adjust(fp.path, fp.owner, -truncated, 0)
+	}
+
+	if setExpires {
+		err = fs.SetExpires(name, expires)
+		if err != nil {
+			fp.Close()
+			panic(WarningError(err.Error()))
+		}
+	}
+
+	f.mu.Lock()
 	f.pos++
 	f.files[f.pos] = fp
+	f.mu.Unlock()
 
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
@@ -279,7 +473,23 @@ func (f *fconn) a_fwrite() {
 
 	fp := f.getFile(pos)
 
-	f.readChunkedToWriter(fp)
+	//拒绝写入时数据也要读完
+	if err := writeDenied(f.replica); err != nil {
+		f.readChunkedToWriter(io.Discard)
+		panic(NoticeError(err.Error()))
+	}
+	if fp.ec != nil {
+		f.readChunkedToWriter(io.Discard)
+		panic(NoticeError("Erasure File Read Only"))
+	}
+
+	//超出配额时数据照样读完,再返回错误
+	qw := newQuotaWriter(fp)
+	f.readChunkedToWriter(qw)
+	fp.root.watch.Publish(EVENT_WRITE, fp.path, "")
+	if qw.err != nil {
+		panic(NoticeError(qw.err.Error()))
+	}
 
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
@@ -295,6 +505,11 @@ func (f *fconn) a_flush() {
 		panic(WarningError(err.Error()))
 	}
 
+	err = f.replicateFile(fp)
+	if err != nil {
+		panic(WarningError("Replica Error " + err.Error()))
+	}
+
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
 }
@@ -360,43 +575,141 @@ func (f *fconn) a_truncate() {
 	size := f.readInt64()
 
 	fp := f.getFile(pos)
+	f.checkMode()
+	if fp.ec != nil {
+		panic(NoticeError("Erasure File Read Only"))
+	}
+
+	var grow int64
+	if fi, err := fp.Stat(); err == nil {
+		grow = size - fi.Size()
+	}
+
+	if grow > 0 {
+		err := fp.root.quota.charge(fp.path, fp.owner, grow, 0)
+		if err != nil {
+			panic(NoticeError(err.Error()))
+		}
+	}
 
 	err := fp.Truncate(size)
 	if err != nil {
+		fp.root.quota.adjust(fp.path, fp.owner, -grow, 0)
 		panic(WarningError(err.Error()))
 	}
+	if grow < 0 {
+		fp.root.quota.adjust(fp.path, fp.owner, grow, 0)
+	}
+	fp.root.watch.Publish(EVENT_WRITE, fp.path, "")
 
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
 }
 
 func (f *fconn) a_fclose() {
-	log.Println("fclose")
 	f.readTimeLimit()
 	pos := f.readUint32()
 
 	fp := f.getFile(pos)
 
+	f.mu.Lock()
+	delete(f.files, pos)
+	f.mu.Unlock()
+
 	err := fp.Close()
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
 
+	err = f.replicateFile(fp)
+	if err != nil {
+		panic(WarningError("Replica Error " + err.Error()))
+	}
+
+	f.writeTimeLimit()
+	f.writeUint8(status_ok)
+}
+
+func (f *fconn) a_fhash() {
+	f.readTimeLimit()
+	name := f.readPath()
+	algo := f.readString()
+	offset := f.readInt64()
+	length := f.readInt64()
+
+	_, vfs, name := f.resolve(name)
+
+	sum, err := vfs.Hash(name, algo, offset, length)
+	if err != nil {
+		panic(WarningError(err.Error()))
+	}
+
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
+	f.writeString(sum)
+}
+
+//整条记录收完后再一次性追加
+func (f *fconn) a_fappend() {
+	f.readTimeLimit()
+	name := f.readPath()
+
+	var buf bytes.Buffer
+	lb := &limitedBuffer{Buffer: &buf, max: maxAppendSize()}
+	f.readChunkedToWriter(lb)
+	if lb.over {
+		panic(NoticeError("Append Too Large"))
+	}
+
+	vol, vfs, name := f.resolve(name)
+	f.writable(vol)
+	if vol == nil {
+		reapIfExpired(name, f.replica)
+	}
+
+	off, err := vfs.Append(name, buf.Bytes(), f.key)
+	if err != nil {
+		panic(WarningError(err.Error()))
+	}
+
+	if vol == nil {
+		op := &replOp{Op: REPL_APPEND, Path: cleanPath(name), Data: buf.Bytes(), End: off + int64(buf.Len())}
+		if !f.replica {
+			if v := bumpVersion(op.Path); v != nil {
+				op.Version, op.VersionTime = v.vv, v.time
+			}
+		}
+		f.replicate(op)
+	}
+
+	f.writeTimeLimit()
+	f.writeUint8(status_ok)
+	f.writeInt64(off)
 }
 
 func (f *fconn) a_opendir() {
 	f.readTimeLimit()
-	name := f.readString()
+	name := f.readPath()
+
+	v, vfs, name := f.resolve(name)
 
-	fp, err := fs.Open(name)
+	fp, err := vfs.Open(name)
+	if err == nil && v == nil && fs.Expired(name) {
+		fp.Close()
+		err = expiredError("open", name)
+	}
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
 
+	if v == nil {
+		fp.ecNames = ecEntries(name)
+	}
+
+	f.mu.Lock()
 	f.pos++
 	f.files[f.pos] = fp
+	f.mu.Unlock()
 
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
@@ -415,20 +728,57 @@ func (f *fconn) a_readdir() {
 	}
 
 	fi, err := fp.Readdir(int(count))
-	if err != nil {
+	if err != nil && (err != io.EOF || len(fp.ecNames) == 0) {
 		panic(WarningError(err.Error()))
 	}
 
-	num := uint16(len(fi))
+	//根目录下的系统目录和已过期的文件不给客户端看,少掉的补上,否则客户端会以为读完了
+	list := visibleEntries(fp, fi)
+	for len(list) < int(count) && len(fi) > 0 {
+		fi, _ = fp.Readdir(int(count) - len(list))
+		list = append(list, visibleEntries(fp, fi)...)
+	}
+
+	var names []string
+	for _, val := range list {
+		names = append(names, val.Name())
+	}
+
+	//普通文件列完了再列纠删码存储的
+	for len(names) < int(count) && len(fp.ecNames) > 0 {
+		names = append(names, fp.ecNames[0])
+		fp.ecNames = fp.ecNames[1:]
+	}
+
+	num := uint16(len(names))
 
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
 	f.writeUint16(num)
 
-	for _, val := range fi {
+	for _, name := range names {
 		f.writeTimeLimit()
-		f.writeString(val.Name())
+		f.writeString(name)
+	}
+}
+
+func visibleEntries(fp *file, fi []os.FileInfo) []os.FileInfo {
+	if fp.root != fs {
+		return fi
+	}
+
+	now := time.Now().Unix()
+	list := fi[:0:0]
+	for _, val := range fi {
+		if fp.name == fs.rootdir && val.Name() == sysDirName {
+			continue
+		}
+		if fs.meta.ExpiredAt(filepath.Join(fp.name, val.Name()), now) {
+			continue
+		}
+		list = append(list, val)
 	}
+	return list
 }
 
 func (f *fconn) a_closedir() {
@@ -437,6 +787,10 @@ func (f *fconn) a_closedir() {
 
 	fp := f.getFile(pos)
 
+	f.mu.Lock()
+	delete(f.files, pos)
+	f.mu.Unlock()
+
 	err := fp.Close()
 	if err != nil {
 		panic(WarningError(err.Error()))
@@ -448,64 +802,209 @@ func (f *fconn) a_closedir() {
 
 func (f *fconn) a_mkdir() {
 	f.readTimeLimit()
-	name := f.readString()
+	name := f.readPath()
 	rec := f.readUint8()
 
+	v, vfs, name := f.resolve(name)
+	f.writable(v)
+
 	var err error
 
 	if rec == 0 {
-		err = fs.Mkdir(name)
+		err = vfs.Mkdir(name)
 	} else {
-		err = fs.MkdirAll(name)
+		err = vfs.MkdirAll(name)
 	}
 
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
 
+	if v == nil {
+		f.replicate(&replOp{Op: REPL_MKDIR, Path: cleanPath(name)})
+	}
+
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
 }
 
 func (f *fconn) a_rmdir() {
 	f.readTimeLimit()
-	name := f.readString()
+	name := f.readPath()
 	rec := f.readUint8()
 
+	//递归删除必须用CODE_RMDIR_ALL
+	if rec != 0 {
+		panic(NoticeError("递归删除请使用CODE_RMDIR_ALL"))
+	}
+
+	v, vfs, name := f.resolve(name)
+	f.writable(v)
+
+	//卷没有回收站
+	rm := fs.SoftRmdir
+	if f.replica || v != nil {
+		rm = vfs.Rmdir
+	}
+
+	err := rm(name)
+	if err != nil {
+		panic(WarningError(err.Error()))
+	}
+
+	if v == nil {
+		f.replicate(&replOp{Op: REPL_DELETE, Path: cleanPath(name)})
+	}
+
+	f.writeTimeLimit()
+	f.writeUint8(status_ok)
+}
+
+//递归删除需要单独的授权
+func (f *fconn) a_rmdir_all() {
+	f.readTimeLimit()
+	name := f.readPath()
+	token := f.readString()
+
+	rmall := rmallAuthPassword()
+	if rmall == "" {
+		panic(NoticeError("递归删除未开启"))
+	}
+
+	if !tokenAuth(name, rmall, token) {
+		authFailed("stream")
+		f.opLog().Warning("RmdirAll Auth Error", "path", name)
+		panic(NoticeError("递归删除认证失败"))
+	}
+
+	v, vfs, name := f.resolve(name)
+	f.writable(v)
+
+	rm := fs.SoftRemoveAll
+	if f.replica || v != nil {
+		rm = vfs.RemoveAll
+	}
+
+	err := rm(name)
+	if err != nil {
+		panic(WarningError(err.Error()))
+	}
+
+	if v == nil {
+		f.replicate(&replOp{Op: REPL_DELETE, Path: cleanPath(name), Recursive: true})
+	}
+
+	f.writeTimeLimit()
+	f.writeUint8(status_ok)
+}
+
+func (f *fconn) a_unlink() {
+	f.readTimeLimit()
+	name := f.readPath()
+
+	vol, vfs, name := f.resolve(name)
+	f.writable(vol)
+
+	if vol != nil {
+		err := vfs.Unlink(name)
+		if err != nil {
+			panic(WarningError(err.Error()))
+		}
+
+		f.writeTimeLimit()
+		f.writeUint8(status_ok)
+		return
+	}
+
+	var v *objVersion
 	var err error
-	if rec == 0 {
-		err = fs.Remove(name)
+	if f.replica {
+		err = fs.Unlink(name)
 	} else {
-		err = fs.RemoveAll(name)
+		v, err = versionedRemove(name, fs.SoftUnlink)
 	}
-
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
 
+	op := &replOp{Op: REPL_DELETE, Path: cleanPath(name)}
+	if v != nil {
+		op.Version, op.VersionTime = v.vv, v.time
+	}
+	f.replicate(op)
+
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
 }
 
 func (f *fconn) a_rename() {
 	f.readTimeLimit()
-	name := f.readString()
-	to := f.readString()
+	name := f.readPath()
+	to := f.readTo()
+
+	v, vfs, name, to := f.resolvePair(name, to)
+	f.writable(v)
+
+	var err error
+	if f.replica {
+		err = vfs.ReplicaRename(name, to)
+	} else {
+		err = vfs.Rename(name, to)
+	}
+	if err != nil {
+		panic(WarningError(err.Error()))
+	}
 
-	err := fs.Rename(name, to)
+	if v == nil {
+		f.replicate(&replOp{Op: REPL_RENAME, Path: cleanPath(name), To: cleanPath(to)})
+	}
+
+	f.writeTimeLimit()
+	f.writeUint8(status_ok)
+}
+
+func (f *fconn) a_copy() {
+	f.readTimeLimit()
+	name := f.readPath()
+	to := f.readTo()
+
+	v, vfs, name, to := f.resolvePair(name, to)
+	f.writable(v)
+	if v == nil {
+		reapIfExpired(to, f.replica)
+	}
+
+	var err error
+	if f.replica {
+		err = vfs.ReplicaCopy(name, to)
+	} else {
+		err = vfs.Copy(name, to)
+	}
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
 
+	if v == nil {
+		f.replicate(&replOp{Op: REPL_COPY, Path: cleanPath(name), To: cleanPath(to)})
+	}
+
 	f.writeTimeLimit()
 	f.writeUint8(status_ok)
 }
 
 func (f *fconn) a_stat() {
 	f.readTimeLimit()
-	name := f.readString()
+	name := f.readPath()
+
+	v, vfs, name := f.resolve(name)
 
-	fi, err := fs.Stat(name)
+	fi, err := vfs.Stat(name)
+	if err != nil {
+		fi, err = vfs.erasureStat(name, err)
+	}
+	if err == nil && v == nil && !fi.IsDir() && fs.Expired(name) {
+		err = expiredError("stat", name)
+	}
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
@@ -524,9 +1023,17 @@ func (f *fconn) a_stat() {
 
 func (f *fconn) a_lstat() {
 	f.readTimeLimit()
-	name := f.readString()
+	name := f.readPath()
+
+	v, vfs, name := f.resolve(name)
 
-	fi, err := fs.Lstat(name)
+	fi, err := vfs.Lstat(name)
+	if err != nil {
+		fi, err = vfs.erasureStat(name, err)
+	}
+	if err == nil && v == nil && !fi.IsDir() && fs.Expired(name) {
+		err = expiredError("lstat", name)
+	}
 	if err != nil {
 		panic(WarningError(err.Error()))
 	}
@@ -541,11 +1048,91 @@ func (f *fconn) a_lstat() {
 	f.writeUint8(is_dir)
 	f.writeInt64(fi.Size())
 	f.writeInt64(fi.ModTime().Unix())
-	f.conn.SetReadDeadline(time.Now().Add(actionTimeout))
+	f.conn.SetReadDeadline(time.Now().Add(actionTimeout()))
+}
+
+//订阅后连接只推送事件,客户端发CODE_WATCH_STOP结束订阅
+func (f *fconn) a_watch() {
+	f.readTimeLimit()
+	prefix := f.readPath()
+
+	_, vfs, prefix := f.resolve(prefix)
+
+	w := vfs.watch.Subscribe(prefix)
+	defer vfs.watch.Unsubscribe(w)
+
+	f.writeTimeLimit()
+	f.writeUint8(status_ok)
+	f.flush()
+
+	//订阅期间客户端只会发结束指令
+	err := f.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		panic(FatalError(err.Error()))
+	}
+
+	stop := make(chan uint16, 1)
+	go func() {
+		var code uint16
+		err := binary.Read(f.bufrw, binary.BigEndian, &code)
+		if err != nil {
+			code = CODE_CLOSE
+		}
+		stop <- code
+	}()
+
+	ping := time.NewTicker(watchPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case e := <-w.C:
+			f.writeTimeLimit()
+			f.writeUint16(CODE_WATCH_EVENT)
+			f.writeString(e.Op)
+			f.writeString(e.Path)
+			f.writeString(e.To)
+			if len(w.C) == 0 {
+				f.flush()
+			}
+		case <-ping.C:
+			f.writeTimeLimit()
+			f.writeUint16(CODE_WATCH_PING)
+			f.flush()
+		case <-streams.stop:
+			f.sendServerClose()
+			//读的协程还在,让它读完客户端可能发来的结束指令
+			f.conn.SetReadDeadline(time.Now().Add(serverCloseDrain))
+			<-stop
+			f.closed = true
+			return
+		case code := <-stop:
+			if code != CODE_WATCH_STOP {
+				f.closed = true
+				return
+			}
+			f.writeTimeLimit()
+			f.writeUint16(CODE_WATCH_STOP)
+			return
+		}
+	}
 }
 
 // --------- 字符串读写 ----------
 
+//指令里的路径,读到就记下来,认证失败的日志里也有路径
+func (f *fconn) readPath() string {
+	p := f.readString()
+	f.opPath = p
+	return p
+}
+
+func (f *fconn) readTo() string {
+	to := f.readString()
+	f.opTo = to
+	return to
+}
+
 func (f *fconn) readString() string {
 	var strlen uint16
 	err := binary.Read(f.bufrw, binary.BigEndian, &strlen)
@@ -555,7 +1142,7 @@ func (f *fconn) readString() string {
 
 	//极限是64k(uint16)
 	data := make([]byte, strlen)
-	_, err = f.bufrw.Read(data)
+	_, err = io.ReadFull(f.bufrw, data)
 	if err != nil {
 		panic(FatalError(err.Error()))
 	}
@@ -597,21 +1184,21 @@ func (f *fconn) writeError(str ...interface{}) {
 // ------ 超时 ----------------
 
 func (f *fconn) idleTimeLimit() {
-	err := f.conn.SetReadDeadline(time.Now().Add(idleTimeout))
+	err := f.conn.SetReadDeadline(time.Now().Add(idleTimeout()))
 	if err != nil {
 		panic(FatalError(err.Error()))
 	}
 }
 
 func (f *fconn) readTimeLimit() {
-	err := f.conn.SetReadDeadline(time.Now().Add(actionTimeout))
+	err := f.conn.SetReadDeadline(time.Now().Add(actionTimeout()))
 	if err != nil {
 		panic(FatalError(err.Error()))
 	}
 }
 
 func (f *fconn) writeTimeLimit() {
-	err := f.conn.SetWriteDeadline(time.Now().Add(actionTimeout))
+	err := f.conn.SetWriteDeadline(time.Now().Add(actionTimeout()))
 	if err != nil {
 		panic(FatalError(err.Error()))
 	}
@@ -747,7 +1334,7 @@ func (f *fconn) writeUint64(number uint64) {
 
 // ------ 数据读写 ----------------
 
-func (f fconn) writeChunkedFromReader(r io.Reader) {
+func (f *fconn) writeChunkedFromReader(r io.Reader) {
 	//1k buf
 	buf := make([]byte, 2048)
 
@@ -771,7 +1358,7 @@ func (f fconn) writeChunkedFromReader(r io.Reader) {
 	}
 }
 
-func (f fconn) writeData(buf []byte) {
+func (f *fconn) writeData(buf []byte) {
 	f.writeUint16(uint16(len(buf)))
 
 	_, err := f.bufrw.Write(buf)
@@ -797,6 +1384,22 @@ func (f *fconn) readChunkedToWriter(w io.Writer) {
 	}
 }
 
+//超过大小后剩下的数据照常读完丢掉,连接还能接着用
+type limitedBuffer struct {
+	*bytes.Buffer
+	max int64
+	over bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.over || int64(b.Len() + len(p)) > b.max {
+		b.over = true
+		b.Reset()
+		return io.Discard.Write(p)
+	}
+	return b.Buffer.Write(p)
+}
+
 func (f *fconn) readData() []byte {
 	count := f.readUint16()
 
@@ -807,7 +1410,7 @@ func (f *fconn) readData() []byte {
 	//极限是64k(uint16)
 	buf := make([]byte, count)
 
-	_, err := f.bufrw.Read(buf)
+	_, err := io.ReadFull(f.bufrw, buf)
 	if err != nil {
 		panic(FatalError(err.Error()))
 	}
@@ -825,11 +1428,57 @@ func (f *fconn) flush () {
 }
 
 
+//写过的文件在flush和关闭时整个复制到副本
+func (f *fconn) replicateFile(fp *file) error {
+	if !fp.dirty {
+		return nil
+	}
+
+	fp.dirty = false
+	//卷里的文件不复制
+	if f.replica || fp.root != fs {
+		return nil
+	}
+
+	bumpVersion(fp.path)
+	return replicate(nil, &replOp{Op: REPL_PUT, Path: fp.path})
+}
+
+//同步模式下副本失败,本地已经改了,告诉客户端
+func (f *fconn) replicate(op *replOp) {
+	if f.replica {
+		return
+	}
+
+	err := replicate(nil, op)
+	if err != nil {
+		panic(WarningError("Replica Error " + err.Error()))
+	}
+}
+
+//读缓冲里还没用到的不算
+func (f *fconn) consumed() int64 {
+	return atomic.LoadInt64(&f.cc.in) - int64(f.bufrw.Reader.Buffered())
+}
+
+//指令之外的日志不带op
+func (f *fconn) opLog() logger {
+	if f.op == 0 {
+		return f.log
+	}
+	return f.log.With("op", codeName(f.op), "path", f.opPath)
+}
+
 func (f *fconn) getFile (pos uint32) *file {
 	fp := f.files[pos]
 	if fp == nil {
 		panic(FatalError("文件描术符错误"))
 	}
+	f.opPath = fp.path
+	//连接没选卷时,客户端用的路径里带着卷名
+	if f.vol == nil && fp.root.volume != "" {
+		f.opPath = "/" + fp.root.volume + fp.path
+	}
 
 	return fp
 }
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"io"
+	"net"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"net/http"
+	"encoding/binary"
+)
+
+//节点之间用流协议传文件的客户端
+type streamClient struct {
+	conn net.Conn
+	rw *bufio.ReadWriter
+	//连接已经不能用了
+	broken bool
+}
+
+//服务端返回的失败,连接还能继续用
+type streamError string
+
+func (e streamError) Error() string {
+	return string(e)
+}
+
+//服务端没有统一的错误码,只能看错误信息
+func isStreamNotExist(err error) bool {
+	e, ok := err.(streamError)
+	return ok && strings.Contains(string(e), "no such file or directory")
+}
+
+var streamDialTimeout = 10 * time.Second
+
+//带上副本头,对方不会再往外复制
+func dialStream(addr string) (*streamClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, streamDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &streamClient{
+		conn: conn,
+		rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+	}
+
+	conn.SetDeadline(time.Now().Add(actionTimeout()))
+
+	c.rw.WriteString("POST / HTTP/1.1\r\n")
+	c.rw.WriteString("Host: " + addr + "\r\n")
+	c.rw.WriteString("Connection: Upgrade\r\n")
+	c.rw.WriteString("Upgrade: Byfs-Stream\r\n")
+	c.rw.WriteString("Byfs-Version: 1\r\n")
+	h := make(http.Header)
+	signPeer(h, "POST", "/")
+	h.Write(c.rw)
+	c.rw.WriteString("\r\n")
+
+	err = c.rw.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(c.rw.Reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.New("stream upgrade " + resp.Status)
+	}
+
+	if token := resp.Header.Get("Byfs-Auth"); token != "" {
+		c.writeUint16(CODE_AUTH)
+		c.writeString(makeToken(token, authPassword()))
+		err = c.flush()
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *streamClient) Close() error {
+	if !c.broken {
+		c.conn.SetDeadline(time.Now().Add(actionTimeout()))
+		c.writeUint16(CODE_CLOSE)
+		c.flush()
+	}
+	return c.conn.Close()
+}
+
+//错误里除了服务端返回的失败,其它都说明连接坏了
+func (c *streamClient) fail(err error) error {
+	if _, ok := err.(streamError); !ok && err != nil {
+		c.broken = true
+	}
+	return err
+}
+
+func (c *streamClient) begin(code uint16) {
+	c.conn.SetDeadline(time.Now().Add(actionTimeout()))
+	c.writeUint16(code)
+}
+
+//服务端算hash的速度按这个估,大文件等得更久
+var streamHashRate int64 = 20 << 20
+
+//按文件大小加上读完文件的时间
+func sizeTimeout(size int64) time.Duration {
+	return actionTimeout() + time.Duration(size / streamHashRate) * time.Second
+}
+
+//发送请求并读取状态
+func (c *streamClient) status() error {
+	return c.statusWithin(actionTimeout())
+}
+
+//服务端要读完整个文件才返回的,等待时间由调用方给
+func (c *streamClient) statusWithin(d time.Duration) error {
+	err := c.flush()
+	if err != nil {
+		return c.fail(err)
+	}
+
+	c.conn.SetDeadline(time.Now().Add(d))
+
+	var st [1]byte
+	_, err = io.ReadFull(c.rw, st[:])
+	if err != nil {
+		return c.fail(err)
+	}
+
+	if st[0] == status_ok {
+		return nil
+	}
+
+	if st[0] != status_fail {
+		return c.fail(errors.New("stream status error"))
+	}
+
+	msg, err := c.readString()
+	if err != nil {
+		return c.fail(err)
+	}
+
+	return streamError(msg)
+}
+
+func (c *streamClient) Mkdir(name string, recursive bool) error {
+	c.begin(CODE_MKDIR)
+	c.writeString(name)
+	if recursive {
+		c.rw.WriteByte(1)
+	} else {
+		c.rw.WriteByte(0)
+	}
+	return c.status()
+}
+
+func (c *streamClient) Open(name string, flag int) (uint32, error) {
+	c.begin(CODE_FILE_OPEN)
+	c.writeString(name)
+	binary.Write(c.rw, binary.BigEndian, int32(flag))
+
+	err := c.status()
+	if err != nil {
+		return 0, err
+	}
+
+	var pos uint32
+	err = binary.Read(c.rw, binary.BigEndian, &pos)
+	return pos, c.fail(err)
+}
+
+//数据分段发送,每段最多64k
+func (c *streamClient) Write(pos uint32, r io.Reader) (int64, error) {
+	c.begin(CODE_FILE_WRITE)
+	binary.Write(c.rw, binary.BigEndian, pos)
+
+	var total int64
+	buf := make([]byte, 32 << 10)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			c.conn.SetDeadline(time.Now().Add(actionTimeout()))
+			c.writeUint16(uint16(n))
+			_, err1 := c.rw.Write(buf[:n])
+			if err1 != nil {
+				return total, c.fail(err1)
+			}
+			total += int64(n)
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//分段协议没法中途取消
+			c.broken = true
+			return total, err
+		}
+	}
+
+	c.writeUint16(0)
+	return total, c.status()
+}
+
+func (c *streamClient) CloseFile(pos uint32) error {
+	c.begin(CODE_FILE_CLOSE)
+	binary.Write(c.rw, binary.BigEndian, pos)
+	return c.status()
+}
+
+//返回文件大小,目录返回-1
+func (c *streamClient) Stat(name string) (int64, error) {
+	c.begin(CODE_STAT)
+	c.writeString(name)
+
+	err := c.status()
+	if err != nil {
+		return 0, err
+	}
+
+	var st struct {
+		IsDir uint8
+		Size int64
+		ModTime int64
+	}
+	err = binary.Read(c.rw, binary.BigEndian, &st)
+	if err != nil {
+		return 0, c.fail(err)
+	}
+
+	if st.IsDir != 0 {
+		return -1, nil
+	}
+	return st.Size, nil
+}
+
+//size是文件大小,用来估计等待时间
+func (c *streamClient) Hash(name string, algo string, size int64) (string, error) {
+	c.begin(CODE_FILE_HASH)
+	c.writeString(name)
+	c.writeString(algo)
+	binary.Write(c.rw, binary.BigEndian, int64(0))
+	binary.Write(c.rw, binary.BigEndian, int64(-1))
+
+	err := c.statusWithin(sizeTimeout(size))
+	if err != nil {
+		return "", err
+	}
+
+	sum, err := c.readString()
+	return sum, c.fail(err)
+}
+
+func (c *streamClient) Rename(name, to string) error {
+	c.begin(CODE_RENAME)
+	c.writeString(name)
+	c.writeString(to)
+	return c.status()
+}
+
+func (c *streamClient) Unlink(name string) error {
+	c.begin(CODE_UNLINK)
+	c.writeString(name)
+	return c.status()
+}
+
+func (c *streamClient) flush() error {
+	return c.rw.Flush()
+}
+
+func (c *streamClient) writeUint16(n uint16) {
+	binary.Write(c.rw, binary.BigEndian, n)
+}
+
+func (c *streamClient) writeString(str string) {
+	c.writeUint16(uint16(len(str)))
+	c.rw.WriteString(str)
+}
+
+func (c *streamClient) readString() (string, error) {
+	var n uint16
+	err := binary.Read(c.rw, binary.BigEndian, &n)
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, n)
+	_, err = io.ReadFull(c.rw, data)
+	return string(data), err
+}
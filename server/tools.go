@@ -2,6 +2,7 @@ package main
 
 import (
 	"io"
+	"strings"
 	"crypto/md5"
 	"crypto/rand"
 	"encoding/hex"
@@ -26,6 +27,35 @@ func tokenAuth(str string, pass string, token string) bool {
 	return hash == _hash
 }
 
+//和tokenAuth对应,客户端的token算法
+func makeToken(str string, pass string) string {
+	salt := randString()[:8]
+
+	h := md5.New()
+	io.WriteString(h, pass)
+	io.WriteString(h, str)
+	io.WriteString(h, salt)
+
+	return hex.EncodeToString(h.Sum(nil)) + salt
+}
+
+//逗号分隔的列表,去掉空的
+func splitList(str string) []string {
+	var list []string
+	for _, v := range strings.Split(str, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+//p是否在目录prefix下(包括prefix本身)
+func hasPathPrefix(p, prefix string) bool {
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix + "/")
+}
+
 func randString() string {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
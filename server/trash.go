@@ -0,0 +1,414 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sort"
+	"time"
+	"errors"
+	"strconv"
+	"syscall"
+	"net/http"
+	"encoding/json"
+	"path/filepath"
+)
+
+//回收站,客户端的删除改成移到 .byfs/trash/<id>/ 下
+//data是删掉的文件或目录,meta是它的元数据,info.json记录原路径和删除时间
+//超过保留时间的由后台清理,只有客户端发起的删除进回收站,副本同步和数据迁移的还是直接删
+
+type trashInfo struct {
+	ID string `json:"id"`
+	Path string `json:"path"`
+	Time time.Time `json:"time"`
+	Dir bool `json:"dir"`
+	Size int64 `json:"size"`
+}
+
+//删除前的检查,和原来的删除操作保持一样的限制
+const (
+	TRASH_REMOVE = iota
+	TRASH_UNLINK
+	TRASH_RMDIR
+	TRASH_ALL
+)
+
+func initTrash() {
+	if *trashRetention > 0 {
+		go trashSweepLoop()
+	}
+}
+
+func (f *filesystem) trashRoot() string {
+	return filepath.Join(f.rootdir, sysDirName, "trash")
+}
+
+func (f *filesystem) SoftRemove(name string) error {
+	return f.trash(name, TRASH_REMOVE)
+}
+
+func (f *filesystem) SoftUnlink(name string) error {
+	return f.trash(name, TRASH_UNLINK)
+}
+
+func (f *filesystem) SoftRmdir(name string) error {
+	return f.trash(name, TRASH_RMDIR)
+}
+
+func (f *filesystem) SoftRemoveAll(name string) error {
+	return f.trash(name, TRASH_ALL)
+}
+
+func isEmptyDir(name string) bool {
+	d, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer d.Close()
+
+	_, err = d.Readdirnames(1)
+	return err == io.EOF
+}
+
+//没开回收站时就是原来的删除
+func (f *filesystem) trash(name string, mode int) error {
+	if *trashRetention <= 0 {
+		switch mode {
+		case TRASH_UNLINK:
+			return f.Unlink(name)
+		case TRASH_RMDIR:
+			return f.Rmdir(name)
+		case TRASH_ALL:
+			return f.RemoveAll(name)
+		}
+		return f.Remove(name)
+	}
+
+	p := cleanPath(name)
+	name = f.pathToFile(name)
+	if name == "." || name == f.rootdir {
+		return errors.New("File Name Error")
+	}
+
+	fi, err := os.Lstat(name)
+	if err != nil {
+		//和RemoveAll一样,不存在不算错
+		if mode == TRASH_ALL && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var errno error
+	switch {
+	case mode == TRASH_UNLINK && fi.IsDir():
+		errno = syscall.EISDIR
+	case mode == TRASH_RMDIR && !fi.IsDir():
+		errno = syscall.ENOTDIR
+	case (mode == TRASH_RMDIR || mode == TRASH_REMOVE) && fi.IsDir() && !isEmptyDir(name):
+		errno = syscall.ENOTEMPTY
+	}
+	if errno != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: errno}
+	}
+
+	err = os.MkdirAll(f.trashRoot(), 0755)
+	if err != nil {
+		return err
+	}
+
+	var id, item string
+	for n := time.Now().UnixNano(); ; n++ {
+		id = strconv.FormatInt(n, 10)
+		item = filepath.Join(f.trashRoot(), id)
+		err = os.Mkdir(item, 0755)
+		if !os.IsExist(err) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	info := &trashInfo{ID: id, Path: p, Time: time.Now(), Dir: fi.IsDir(), Size: fi.Size()}
+	data, _ := json.Marshal(info)
+
+	usage := f.quotaEntries(name)
+
+	err = writeFileSync(filepath.Join(item, "info.json"), data)
+	if err == nil {
+		err = os.Rename(name, filepath.Join(item, "data"))
+	}
+	if err != nil {
+		os.RemoveAll(item)
+		return err
+	}
+
+	//回收站里的不算配额
+	f.quota.drop(usage)
+
+	//元数据跟着走,blob的引用也一起留着
+	f.meta.MoveOut(name, filepath.Join(item, "meta"))
+	f.watch.Publish(EVENT_REMOVE, p, "")
+	return nil
+}
+
+func loadTrashInfo(item string) (*trashInfo, error) {
+	data, err := os.ReadFile(filepath.Join(item, "info.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	info := new(trashInfo)
+	err = json.Unmarshal(data, info)
+	return info, err
+}
+
+//新的在前
+func (f *filesystem) TrashList() []*trashInfo {
+	list := make([]*trashInfo, 0)
+
+	d, err := os.Open(f.trashRoot())
+	if err != nil {
+		return list
+	}
+	defer d.Close()
+
+	names, _ := d.Readdirnames(-1)
+	for _, n := range names {
+		info, err := loadTrashInfo(filepath.Join(f.trashRoot(), n))
+		if err == nil {
+			list = append(list, info)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.After(list[j].Time)
+	})
+
+	return list
+}
+
+func (f *filesystem) trashItem(id string) (string, *trashInfo, error) {
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", nil, errors.New("Trash Id Error")
+	}
+
+	item := filepath.Join(f.trashRoot(), id)
+	info, err := loadTrashInfo(item)
+	if err != nil {
+		return "", nil, err
+	}
+	return item, info, nil
+}
+
+//回收站里的文件,路径相对于原来的位置,所有者从移出去的元数据里读
+func (f *filesystem) trashEntries(item string) []quotaEntry {
+	if !f.quota.enabled() {
+		return nil
+	}
+	_, byKey := f.quota.snapshot()
+
+	data := filepath.Join(item, "data")
+
+	var list []quotaEntry
+	filepath.Walk(data, func(q string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(data, q)
+		if err != nil {
+			return nil
+		}
+
+		e := quotaEntry{size: fi.Size()}
+		if rel != "." {
+			e.path = "/" + filepath.ToSlash(rel)
+		}
+		if byKey {
+			if md := f.meta.GetIn(filepath.Join(item, "meta"), rel); md != nil {
+				e.owner = md.Owner
+			}
+		}
+		list = append(list, e)
+		return nil
+	})
+	return list
+}
+
+//放回原路径或to,目标已存在时失败
+func (f *filesystem) TrashRestore(id, to string) (string, error) {
+	item, info, err := f.trashItem(id)
+	if err != nil {
+		return "", err
+	}
+
+	if to == "" {
+		to = info.Path
+	}
+	p := cleanPath(to)
+
+	name := f.pathToFile(p)
+	if name == "." || name == f.rootdir {
+		return "", errors.New("File Name Error")
+	}
+
+	_, err = os.Lstat(name)
+	if err == nil {
+		return "", &os.PathError{Op: "restore", Path: p, Err: os.ErrExist}
+	}
+
+	//回收站里的用量已经退掉了,放回来要重新记账
+	usage := rebaseEntries(f.trashEntries(item), "", p)
+	err = f.quota.chargeAll(usage)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), f.fileMode)
+	if err == nil {
+		err = os.Rename(filepath.Join(item, "data"), name)
+	}
+	if err != nil {
+		f.quota.drop(usage)
+		return "", err
+	}
+
+	//删除时留下的墓碑比回收站里的版本新,要合并进来,恢复后的版本才能盖过墓碑
+	var tomb versionVector
+	if md := f.meta.Get(name); md != nil {
+		tomb = md.Version
+	}
+
+	f.meta.MoveIn(filepath.Join(item, "meta"), name)
+	if tomb != nil {
+		f.meta.Update(name, func(md *metadata) bool {
+			md.Version = md.Version.Merge(tomb)
+			return true
+		})
+	}
+
+	os.RemoveAll(item)
+	f.watch.Publish(EVENT_CREATE, p, "")
+	return p, nil
+}
+
+//彻底删除,释放blob引用
+func (f *filesystem) TrashPurge(id string) error {
+	item, _, err := f.trashItem(id)
+	if err != nil {
+		return err
+	}
+
+	var blobs []string
+	f.meta.EachIn(filepath.Join(item, "meta"), func(md *metadata) {
+		if md.Blob != "" {
+			blobs = append(blobs, md.Blob)
+		}
+	})
+
+	err = os.RemoveAll(item)
+	for _, sum := range blobs {
+		f.blobs.Release(sum)
+	}
+	return err
+}
+
+func trashSweepLoop() {
+	for {
+		time.Sleep(time.Minute * 10)
+		if backgroundPaused() {
+			continue
+		}
+
+		removed := 0
+		for _, info := range fs.TrashList() {
+			if time.Since(info.Time) < *trashRetention {
+				continue
+			}
+
+			err := fs.TrashPurge(info.ID)
+			if err != nil {
+				logWarning("Trash Purge Error", "id", info.ID, "path", info.Path, "err", err)
+				continue
+			}
+			removed++
+		}
+
+		if removed > 0 {
+			logNotice("Trash Purged", "files", removed)
+		}
+	}
+}
+
+//恢复的内容按新写入复制到其它节点,返回第一个失败
+func replicateRestored(p string) error {
+	name := fs.pathToFile(p)
+
+	var first error
+	filepath.Walk(name, func(q string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		qp := fs.localToPath(q)
+		if fi.IsDir() {
+			err = replicate(nil, &replOp{Op: REPL_MKDIR, Path: qp})
+		} else if fi.Mode().IsRegular() {
+			bumpVersion(qp)
+			err = replicate(nil, &replOp{Op: REPL_PUT, Path: qp})
+		}
+		if first == nil {
+			first = err
+		}
+		return nil
+	})
+	return first
+}
+
+//GET 列表, POST ?action=restore&id=&to= 恢复, POST ?action=purge&id= 彻底删除
+func adminTrash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSON(w, fs.TrashList())
+		return
+	}
+
+	if adminDenied(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	id := q.Get("id")
+
+	switch q.Get("action") {
+	case "restore":
+		p, err := fs.TrashRestore(id, q.Get("to"))
+		if isQuotaError(err) {
+			quotaFail(w, r, err)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Trash Restore Error "+err.Error(), http.StatusConflict)
+			return
+		}
+
+		err = replicateRestored(p)
+		if err != nil {
+			http.Error(w, "Replica Error "+err.Error(), http.StatusBadGateway)
+			reqLog(r).Notice("Replica Error", "id", id, "to", p, "err", err)
+			return
+		}
+		reqLog(r).Notice("Trash Restored", "id", id, "to", p)
+		writeJSON(w, map[string]string{"path": p})
+	case "purge":
+		err := fs.TrashPurge(id)
+		if err != nil {
+			http.Error(w, "Trash Purge Error "+err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, map[string]string{"id": id})
+	default:
+		http.Error(w, "Action Error", http.StatusBadRequest)
+	}
+}
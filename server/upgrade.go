@@ -0,0 +1,231 @@
+package main
+
+import (
+	"os"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"errors"
+	"os/exec"
+	"strings"
+	"strconv"
+	"sync/atomic"
+)
+
+//不停服升级
+//收到SIGUSR2后启动新的程序,把监听的socket传给它(fd 3开始),新程序初始化好以后通过管道回话
+//之后老的进程不再接收连接,留着已有的连接做完,流连接关掉所有文件后再通知客户端重连
+//新程序启动失败时老的进程照常服务
+
+//新程序从环境变量知道继承了哪些监听, addr=fd,addr=fd
+const listenFdsEnv = "BYFS_LISTEN_FDS"
+
+//准备好后往这个fd写一个字节
+const readyFdEnv = "BYFS_READY_FD"
+
+//新程序启动时老进程先停掉副本发送,新程序准备好后再停掉后台任务,免得两个进程同时做
+//新程序没起来之前老进程照常工作,升级失败再恢复副本发送
+var handingOver int32
+
+var listeners struct {
+	mu sync.Mutex
+	list []*net.TCPListener
+	addrs []string
+}
+
+//继承来的监听,addr对应的文件
+var inherited = parseInherited()
+
+func parseInherited() map[string]*os.File {
+	m := make(map[string]*os.File)
+
+	for _, item := range splitList(os.Getenv(listenFdsEnv)) {
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			continue
+		}
+
+		fd, err := strconv.Atoi(item[i+1:])
+		if err != nil {
+			continue
+		}
+		m[item[:i]] = os.NewFile(uintptr(fd), "listener " + item[:i])
+	}
+
+	//不再传给以后启动的子进程
+	os.Unsetenv(listenFdsEnv)
+	return m
+}
+
+//有继承来的就用,没有再新建
+func listen(addr string) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+
+	if fp, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		ln, err = net.FileListener(fp)
+		fp.Close()
+		if err == nil {
+			logNotice("Inherited Listener", "addr", addr)
+		}
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, errors.New("not a tcp listener " + addr)
+	}
+
+	listeners.mu.Lock()
+	listeners.list = append(listeners.list, tl)
+	listeners.addrs = append(listeners.addrs, addr)
+	listeners.mu.Unlock()
+
+	return tl, nil
+}
+
+func mustListen(addr string) net.Listener {
+	ln, err := listen(addr)
+	if err != nil {
+		logExit("listen error", "addr", addr, "err", err)
+	}
+	return ln
+}
+
+//监听都建好了,告诉老的进程可以退了
+func upgradeReady() {
+	for _, fp := range inherited {
+		fp.Close()
+	}
+
+	str := os.Getenv(readyFdEnv)
+	if str == "" {
+		return
+	}
+	os.Unsetenv(readyFdEnv)
+
+	fd, err := strconv.Atoi(str)
+	if err != nil {
+		return
+	}
+
+	fp := os.NewFile(uintptr(fd), "upgrade ready")
+	fp.Write([]byte{1})
+	fp.Close()
+}
+
+//启动新程序,等它准备好
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+
+	listeners.mu.Lock()
+	var files []*os.File
+	var fds []string
+	for i, l := range listeners.list {
+		fp, err := l.File()
+		if err != nil {
+			listeners.mu.Unlock()
+			wr.Close()
+			closeFiles(files)
+			return err
+		}
+		files = append(files, fp)
+		fds = append(fds, listeners.addrs[i] + "=" + strconv.Itoa(3 + i))
+	}
+	listeners.mu.Unlock()
+	defer closeFiles(files)
+
+	env := make([]string, 0)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, listenFdsEnv + "=") && !strings.HasPrefix(e, readyFdEnv + "=") {
+			env = append(env, e)
+		}
+	}
+	env = append(env, listenFdsEnv + "=" + strings.Join(fds, ","))
+	env = append(env, readyFdEnv + "=" + strconv.Itoa(3 + len(files)))
+
+	repl.Pause()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = env
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, wr)
+
+	err = cmd.Start()
+	wr.Close()
+	if err != nil {
+		cancelHandOver()
+		return err
+	}
+
+	//新程序退出或超时都算失败,管道在它退出时关闭
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := io.ReadFull(rd, buf)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-time.After(*upgradeTimeout):
+		err = errors.New("new process not ready in time")
+	}
+
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		cancelHandOver()
+		return err
+	}
+
+	atomic.StoreInt32(&handingOver, 1)
+	repl.HandOver()
+	logNotice("Upgrade Started", "pid", cmd.Process.Pid)
+	go cmd.Wait()
+	return nil
+}
+
+func cancelHandOver() {
+	atomic.StoreInt32(&handingOver, 0)
+	repl.Resume()
+
+	//迁移在交接时停下了
+	select {
+	case rebalancer.wake <- true:
+	default:
+	}
+}
+
+func isHandedOver() bool {
+	return atomic.LoadInt32(&handingOver) == 1
+}
+
+//维护模式下和交给新进程以后,后台任务都不做
+func backgroundPaused() bool {
+	return inMaintenance() || isHandedOver()
+}
+
+func closeFiles(files []*os.File) {
+	for _, fp := range files {
+		fp.Close()
+	}
+}
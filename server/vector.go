@@ -0,0 +1,107 @@
+package main
+
+import (
+	"sort"
+	"errors"
+	"strings"
+	"strconv"
+)
+
+//两个版本的关系
+const (
+	VV_EQUAL = iota
+	VV_BEFORE
+	VV_AFTER
+	VV_CONCURRENT
+)
+
+//版本向量,节点名 => 这个节点上的修改次数
+type versionVector map[string]uint64
+
+func (v versionVector) Compare(o versionVector) int {
+	before, after := false, false
+
+	for name, n := range v {
+		if n > o[name] {
+			after = true
+		} else if n < o[name] {
+			before = true
+		}
+	}
+
+	for name, n := range o {
+		if _, ok := v[name]; !ok && n > 0 {
+			before = true
+		}
+	}
+
+	switch {
+	case before && after:
+		return VV_CONCURRENT
+	case before:
+		return VV_BEFORE
+	case after:
+		return VV_AFTER
+	}
+
+	return VV_EQUAL
+}
+
+func (v versionVector) Merge(o versionVector) versionVector {
+	m := make(versionVector, len(v))
+
+	for name, n := range v {
+		m[name] = n
+	}
+
+	for name, n := range o {
+		if n > m[name] {
+			m[name] = n
+		}
+	}
+
+	return m
+}
+
+//本节点修改一次
+func (v versionVector) Bump(name string) versionVector {
+	m := v.Merge(nil)
+	m[name]++
+	return m
+}
+
+//node1=3,node2=1 按节点名排序
+func (v versionVector) String() string {
+	names := make([]string, 0, len(v))
+	for name := range v {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		list = append(list, name + "=" + strconv.FormatUint(v[name], 10))
+	}
+
+	return strings.Join(list, ",")
+}
+
+func parseVector(str string) (versionVector, error) {
+	v := make(versionVector)
+
+	for _, item := range splitList(str) {
+		i := strings.LastIndex(item, "=")
+		if i < 1 {
+			return nil, errors.New("version vector error: " + item)
+		}
+
+		n, err := strconv.ParseUint(item[i+1:], 10, 64)
+		if err != nil {
+			return nil, errors.New("version vector error: " + item)
+		}
+
+		v[item[:i]] = n
+	}
+
+	return v, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVectorCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", VV_EQUAL},
+		{"n1=1", "n1=1", VV_EQUAL},
+		{"n1=1,n2=0", "n1=1", VV_EQUAL},
+		{"n1=2", "n1=1", VV_AFTER},
+		{"n1=1,n2=1", "n1=1", VV_AFTER},
+		{"n1=1", "", VV_AFTER},
+		{"n1=1", "n1=2", VV_BEFORE},
+		{"", "n2=1", VV_BEFORE},
+		{"n1=1", "n1=1,n2=3", VV_BEFORE},
+		{"n1=2", "n2=1", VV_CONCURRENT},
+		{"n1=2,n2=1", "n1=1,n2=2", VV_CONCURRENT},
+	}
+
+	for _, c := range cases {
+		a, err := parseVector(c.a)
+		if err != nil {
+			t.Fatal(c.a, err)
+		}
+		b, err := parseVector(c.b)
+		if err != nil {
+			t.Fatal(c.b, err)
+		}
+
+		if got := a.Compare(b); got != c.want {
+			t.Errorf("%q vs %q: got %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestVectorMerge(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want string
+	}{
+		{"", "", ""},
+		{"n1=1", "", "n1=1"},
+		{"", "n2=3", "n2=3"},
+		{"n1=2,n2=1", "n1=1,n2=2", "n1=2,n2=2"},
+		{"n1=1", "n2=1", "n1=1,n2=1"},
+	}
+
+	for _, c := range cases {
+		a, _ := parseVector(c.a)
+		b, _ := parseVector(c.b)
+
+		m := a.Merge(b)
+		if m.String() != c.want {
+			t.Errorf("merge %q %q: got %q, want %q", c.a, c.b, m, c.want)
+		}
+
+		//合并后不早于任何一边,原来的不变
+		if r := m.Compare(a); r != VV_AFTER && r != VV_EQUAL {
+			t.Errorf("merge %q %q before %q", c.a, c.b, c.a)
+		}
+		if r := m.Compare(b); r != VV_AFTER && r != VV_EQUAL {
+			t.Errorf("merge %q %q before %q", c.a, c.b, c.b)
+		}
+		if a.String() != c.a {
+			t.Errorf("merge changed %q to %q", c.a, a)
+		}
+	}
+}
+
+func TestVectorBumpAndParse(t *testing.T) {
+	v, _ := parseVector("n1=1")
+	b := v.Bump("n2")
+	if b.String() != "n1=1,n2=1" || v.String() != "n1=1" {
+		t.Fatalf("bump got %q, old %q", b, v)
+	}
+	if b.Compare(v) != VV_AFTER {
+		t.Fatal("bumped not after")
+	}
+
+	for _, s := range []string{"n1", "=1", "n1=x", "n1=-1"} {
+		if _, err := parseVector(s); err == nil {
+			t.Errorf("parse %q should fail", s)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+)
+
+//按路径前缀开启的多版本
+//覆盖、截断、改名覆盖和删除之前,把原来的内容保存到 .byfs/history/<hh>/<路径的sha256>/<id>
+//同一个目录的path文件记着原来的路径,按hash分目录不会和文件名冲突
+//id是保存时的纳秒时间,删除和改名用硬链接,原地改写原来内容的要复制一份,只追加的不用保存
+
+type versionSpec struct {
+	prefix string
+	//最多保留几个,0不限
+	keep int
+	//最多保留几天,0不限
+	days int
+}
+
+var versionSpecs []*versionSpec
+
+type versionInfo struct {
+	ID string `json:"id"`
+	Size int64 `json:"size"`
+	//这个版本内容的修改时间
+	ModTime time.Time `json:"mtime"`
+	//被替换掉的时间
+	Time time.Time `json:"time"`
+}
+
+//格式 /docs:10 保留10个, /reports:30d 保留30天, 只有前缀不限
+func initVersioning() {
+	for _, item := range splitList(*versioningConf) {
+		spec := &versionSpec{prefix: item}
+
+		if i := strings.LastIndex(item, ":"); i > 0 {
+			spec.prefix = item[:i]
+			rule := item[i+1:]
+
+			var err error
+			if strings.HasSuffix(rule, "d") {
+				spec.days, err = strconv.Atoi(rule[:len(rule)-1])
+			} else {
+				spec.keep, err = strconv.Atoi(rule)
+			}
+			if err != nil || spec.days < 0 || spec.keep < 0 {
+				logExit("versioning config error", "item", item)
+			}
+		}
+
+		spec.prefix = cleanPath(spec.prefix)
+		versionSpecs = append(versionSpecs, spec)
+	}
+
+	fs.migrateVersions()
+
+	if len(versionSpecs) > 0 && *versionPrune > 0 {
+		go versionPruneLoop()
+	}
+}
+
+//最长的前缀优先
+func versioningFor(p string) *versionSpec {
+	var best *versionSpec
+
+	for _, s := range versionSpecs {
+		if !hasPathPrefix(p, s.prefix) {
+			continue
+		}
+		if best == nil || len(s.prefix) > len(best.prefix) {
+			best = s
+		}
+	}
+
+	return best
+}
+
+func (f *filesystem) versionRoot() string {
+	return filepath.Join(f.rootdir, sysDirName, "history")
+}
+
+//记录原来路径的文件,和数字的id不会冲突
+const versionPathFile = "path"
+
+//name是本地路径
+func (f *filesystem) versionDir(name string) string {
+	rel, err := filepath.Rel(f.rootdir, name)
+	if err != nil || rel == "." {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(cleanPath(filepath.ToSlash(rel))))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(f.versionRoot(), key[:2], key)
+}
+
+//路径在不在要保留版本的前缀下
+func (f *filesystem) versionable(p string) bool {
+	//卷不保留版本
+	if len(versionSpecs) == 0 || f.volume != "" {
+		return false
+	}
+	return versioningFor(p) != nil
+}
+
+//保存版本和删除空的版本目录不能同时进行
+var versionMu sync.Mutex
+
+func (f *filesystem) localToPath(name string) string {
+	rel, err := filepath.Rel(f.rootdir, name)
+	if err != nil {
+		return ""
+	}
+	return cleanPath(filepath.ToSlash(rel))
+}
+
+//把当前内容保存成一个旧版本,文件不存在或不用保留时什么也不做
+//length < 0 时用硬链接;否则复制前length字节,给原地改写的用. 返回是否保存了
+func (f *filesystem) keepVersion(name string, length int64) (bool, error) {
+	p := f.localToPath(name)
+	if !f.versionable(p) {
+		return false, nil
+	}
+	spec := versioningFor(p)
+
+	fi, err := os.Lstat(name)
+	if err != nil || !fi.Mode().IsRegular() {
+		return false, nil
+	}
+
+	size := fi.Size()
+	if length >= 0 && length < size {
+		size = length
+	}
+
+	dir := f.versionDir(name)
+
+	versionMu.Lock()
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, versionPathFile), []byte(p), 0644)
+	}
+
+	id := time.Now().UnixNano()
+	for err == nil {
+		dst := filepath.Join(dir, strconv.FormatInt(id, 10))
+		if length >= 0 {
+			err = copyFile(name, dst, f.fileMode)
+			if err == nil && size < fi.Size() {
+				err = os.Truncate(dst, size)
+			}
+			if err == nil {
+				os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+			}
+		} else {
+			err = os.Link(name, dst)
+		}
+
+		if os.IsExist(err) {
+			id++
+			err = nil
+			continue
+		}
+		break
+	}
+	versionMu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	f.quota.adjust(p, "", size, 1)
+	f.pruneVersions(dir, spec, time.Now())
+	return true, nil
+}
+
+//删除整个目录之前,保存下面所有需要保留的文件
+func (f *filesystem) keepVersionAll(name string) error {
+	if len(versionSpecs) == 0 || f.volume != "" {
+		return nil
+	}
+
+	return filepath.Walk(name, func(q string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			_, err = f.keepVersion(q, -1)
+		}
+		return err
+	})
+}
+
+//新的在前
+func listVersions(dir string) []versionInfo {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+
+	list := make([]versionInfo, 0)
+
+	fis, _ := d.Readdir(-1)
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		id, err := strconv.ParseInt(fi.Name(), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		list = append(list, versionInfo{
+			ID: fi.Name(),
+			Size: fi.Size(),
+			ModTime: fi.ModTime(),
+			Time: time.Unix(0, id),
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.After(list[j].Time)
+	})
+
+	return list
+}
+
+//版本目录对应的路径,不是版本目录的返回空
+func (f *filesystem) versionPath(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, versionPathFile))
+	if err != nil {
+		return ""
+	}
+
+	p := cleanPath(string(data))
+	name := f.pathToFile(p)
+	if name == "." || f.versionDir(name) != dir {
+		return ""
+	}
+	return p
+}
+
+//所有旧版本文件和它们的路径
+func (f *filesystem) eachVersion(fn func(p string, fi os.FileInfo)) error {
+	var lastDir, lastPath string
+
+	err := filepath.Walk(f.versionRoot(), func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !fi.Mode().IsRegular() || fi.Name() == versionPathFile {
+			return nil
+		}
+
+		if dir := filepath.Dir(name); dir != lastDir {
+			lastDir, lastPath = dir, f.versionPath(dir)
+		}
+		if lastPath != "" {
+			fn(lastPath, fi)
+		}
+		return nil
+	})
+	return err
+}
+
+func (f *filesystem) pruneVersions(dir string, spec *versionSpec, now time.Time) int {
+	removed := 0
+	p := f.versionPath(dir)
+
+	for i, v := range listVersions(dir) {
+		expired := spec.days > 0 && now.Sub(v.Time) > time.Duration(spec.days) * 24 * time.Hour
+		if (spec.keep > 0 && i >= spec.keep) || expired {
+			if os.Remove(filepath.Join(dir, v.ID)) == nil {
+				f.quota.adjust(p, "", -v.Size, -1)
+				removed++
+			}
+		}
+	}
+
+	//全删了的连目录一起删
+	if removed > 0 {
+		versionMu.Lock()
+		if len(listVersions(dir)) == 0 {
+			os.Remove(filepath.Join(dir, versionPathFile))
+			os.Remove(dir)
+		}
+		versionMu.Unlock()
+	}
+
+	return removed
+}
+
+//旧版本保存在 .byfs/versions/<path>.versions/<id>, 和文件名会冲突, 启动时搬到新的目录
+func (f *filesystem) migrateVersions() {
+	old := filepath.Join(f.rootdir, sysDirName, "versions")
+	if _, err := os.Lstat(old); err != nil {
+		return
+	}
+
+	moved, failed := 0, 0
+	filepath.Walk(old, func(dir string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() || !strings.HasSuffix(dir, ".versions") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(old, strings.TrimSuffix(dir, ".versions"))
+		if err != nil {
+			return nil
+		}
+		p := cleanPath(filepath.ToSlash(rel))
+
+		list := listVersions(dir)
+		if len(list) == 0 {
+			return nil
+		}
+
+		to := f.versionDir(f.pathToFile(p))
+		err = os.MkdirAll(to, 0755)
+		if err == nil {
+			err = os.WriteFile(filepath.Join(to, versionPathFile), []byte(p), 0644)
+		}
+		for _, v := range list {
+			if err == nil {
+				err = os.Rename(filepath.Join(dir, v.ID), filepath.Join(to, v.ID))
+			}
+			if err != nil {
+				failed++
+				continue
+			}
+			moved++
+		}
+		if err != nil {
+			logWarning("Version Migrate Error", "path", p, "err", err)
+		}
+		return nil
+	})
+
+	if failed == 0 {
+		os.RemoveAll(old)
+	}
+	logNotice("Versions Migrated", "versions", moved, "failed", failed)
+}
+
+func versionPruneLoop() {
+	for {
+		time.Sleep(*versionPrune)
+		if backgroundPaused() {
+			continue
+		}
+
+		now := time.Now()
+		root := fs.versionRoot()
+		removed := 0
+
+		filepath.Walk(root, func(dir string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil
+			}
+
+			p := fs.versionPath(dir)
+			if p == "" {
+				return nil
+			}
+
+			//前缀去掉了的就不动了
+			spec := versioningFor(p)
+			if spec != nil {
+				removed += fs.pruneVersions(dir, spec, now)
+			}
+			return nil
+		})
+
+		if removed > 0 {
+			logNotice("Version Prune Removed", "versions", removed)
+		}
+	}
+}
+
+func versionFile(p, id string) (string, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return "", errors.New("Version Error")
+	}
+
+	name := fs.pathToFile(p)
+	if name == "." {
+		return "", errors.New("File Name Error")
+	}
+
+	dir := fs.versionDir(name)
+	if dir == "" {
+		return "", errors.New("File Name Error")
+	}
+
+	return filepath.Join(dir, id), nil
+}
+
+// ------ HTTP 接口 ----------------
+
+//GET /file?versions
+func sendVersions(w http.ResponseWriter, r *http.Request) {
+	name := fs.pathToFile(r.URL.Path)
+	if name == "." {
+		http.NotFound(w, r)
+		return
+	}
+
+	writeJSON(w, listVersions(fs.versionDir(name)))
+}
+
+//GET /file?version=id
+func sendVersion(w http.ResponseWriter, r *http.Request) {
+	name, err := versionFile(r.URL.Path, r.URL.Query().Get("version"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	d, err := f.Stat()
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Byfs-Version-Id", r.URL.Query().Get("version"))
+	http.ServeContent(w, r, filepath.Base(r.URL.Path), d.ModTime(), f)
+}
+
+//POST /file?restore=id 当前内容也会先保存成一个版本
+func restoreVersion(w http.ResponseWriter, r *http.Request) {
+	q, err := requestQuorum(r)
+	if err != nil {
+		fmt.Fprint(w, "Quorum Error", err)
+		return
+	}
+
+	name, err := versionFile(r.URL.Path, r.URL.Query().Get("restore"))
+	if err != nil {
+		fmt.Fprint(w, "Restore Error ", err)
+		return
+	}
+
+	src, err := os.Open(name)
+	if err != nil {
+		fmt.Fprint(w, "Restore Error ", err)
+		reqLog(r).Notice("Restore Error", "err", err)
+		return
+	}
+	defer src.Close()
+
+	err = fs.Restore(r.URL.Path, src)
+	if isQuotaError(err) {
+		quotaFail(w, r, err)
+		return
+	}
+	if err != nil {
+		fmt.Fprint(w, "Restore Error ", err)
+		reqLog(r).Notice("Restore Error", "err", err)
+		return
+	}
+
+	saveDone(w, r, q, cleanPath(r.URL.Path))
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+	"path/filepath"
+	"encoding/json"
+)
+
+//命名卷,一个进程服务多个独立的根目录
+//用路径的第一段或Byfs-Volume头选择卷,用头的时候路径就是卷内的路径
+//卷只是本地目录,集群复制、纠删码、去重、多版本和回收站都只在默认的根目录上
+//
+//	-volumes '{"photos": {"dir": "/data/photos", "mode": "0640", "keys": {"app": "secret"}, "quota": "/:10G", "read_only": false}}'
+//	配置文件里是 "volumes": {...}
+
+const volumeHeader = "Byfs-Volume"
+
+type volumeConfig struct {
+	Dir string `json:"dir"`
+	//八进制字符串,默认0644
+	Mode string `json:"mode"`
+	//有的话只能用这些密钥访问
+	Keys map[string]string `json:"keys"`
+	//和-quota一样的格式,路径是卷内的
+	Quota string `json:"quota"`
+	ReadOnly bool `json:"read_only"`
+}
+
+type volume struct {
+	name string
+	fs *filesystem
+	keys map[string]string
+	readOnly bool
+}
+
+var volumes = make(map[string]*volume)
+
+var errVolumeReadOnly = errors.New("Volume Read Only")
+
+func parseVolumes(conf string) (map[string]*volumeConfig, error) {
+	m := make(map[string]*volumeConfig)
+	if conf == "" {
+		return m, nil
+	}
+
+	err := json.Unmarshal([]byte(conf), &m)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, c := range m {
+		if name == "" || name == sysDirName || strings.ContainsAny(name, "/\\") || name == "." || name == ".." {
+			return nil, errors.New("volume name error " + name)
+		}
+		if c == nil || c.Dir == "" {
+			return nil, errors.New("volume dir need " + name)
+		}
+		if c.Mode != "" {
+			if _, err := strconv.ParseUint(c.Mode, 8, 32); err != nil {
+				return nil, errors.New("volume mode error " + name)
+			}
+		}
+		if _, err := parseQuota(c.Quota); err != nil {
+			return nil, errors.New("volume " + name + " " + err.Error())
+		}
+	}
+
+	return m, nil
+}
+
+func initVolumes() {
+	confs, err := parseVolumes(*volumesConf)
+	if err != nil {
+		logExit("volumes config error", "err", err)
+	}
+
+	for name, c := range confs {
+		d, err := os.Stat(c.Dir)
+		if err != nil || !d.IsDir() {
+			logExit("volume dir error", "volume", name, "dir", c.Dir, "err", err)
+		}
+
+		//卷名会盖住默认根目录下同名的目录
+		if _, err := os.Lstat(filepath.Join(fs.rootdir, name)); err == nil {
+			logExit("volume name used by a dir in root", "volume", name)
+		}
+
+		mode := fileMode
+		if c.Mode != "" {
+			n, _ := strconv.ParseUint(c.Mode, 8, 32)
+			mode = os.FileMode(n)
+		}
+
+		v := &volume{name: name, keys: c.Keys, readOnly: c.ReadOnly}
+		v.fs = new(filesystem).Init(c.Dir, mode)
+		v.fs.volume = name
+		v.fs.migrateMeta()
+		v.fs.quota.load(c.Quota)
+
+		volumes[name] = v
+	}
+}
+
+//默认的根目录和所有的卷
+func allFilesystems() []*filesystem {
+	list := []*filesystem{fs}
+
+	names := make([]string, 0, len(volumes))
+	for name := range volumes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		list = append(list, volumes[name].fs)
+	}
+	return list
+}
+
+//路径第一段是卷名时返回卷和卷内的路径
+func volumeOfPath(p string) (*volume, string) {
+	if len(volumes) == 0 {
+		return nil, p
+	}
+
+	p = cleanPath(p)
+	first, rest := p[1:], "/"
+	if i := strings.Index(first, "/"); i >= 0 {
+		first, rest = first[:i], first[i:]
+	}
+
+	v := volumes[first]
+	if v == nil {
+		return nil, p
+	}
+	return v, rest
+}
+
+//请求选择的卷,没有选择时返回nil
+func requestVolume(r *http.Request) (*volume, string, error) {
+	if name := r.Header.Get(volumeHeader); name != "" {
+		v := volumes[name]
+		if v == nil {
+			return nil, "", errors.New("Volume Not Found " + name)
+		}
+		return v, r.URL.Path, nil
+	}
+
+	v, rest := volumeOfPath(r.URL.Path)
+	return v, rest, nil
+}
+
+//卷有自己的密钥时只认这些密钥
+func (v *volume) secret(h http.Header) (string, string, bool) {
+	if len(v.keys) == 0 {
+		return requestSecret(h)
+	}
+
+	key := h.Get(keyHeader)
+	secret, ok := v.keys[key]
+	return key, secret, ok && key != ""
+}
+
+// ------ HTTP 接口 ----------------
+
+type volumeCtxKey struct{}
+
+//卷的请求带上卷,处理函数用requestFS取对应的根目录
+func withVolume(r *http.Request, v *volume) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), volumeCtxKey{}, v))
+}
+
+func requestFS(r *http.Request) *filesystem {
+	if v, ok := r.Context().Value(volumeCtxKey{}).(*volume); ok {
+		return v.fs
+	}
+	return fs
+}
+
+//和默认的根目录用同样的处理函数,只是认证用卷的密钥
+func volumeRouter(w http.ResponseWriter, r *http.Request, v *volume, p string) {
+	r = withVolume(r, v)
+
+	//认证用的是原来的路径,通过后换成卷内的路径
+	auth := func(handler func(http.ResponseWriter, *http.Request)) {
+		authWith(w, r, v.secret, func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = p
+			handler(w, r)
+		})
+	}
+
+	//修改类的请求
+	write := func(handler func(http.ResponseWriter, *http.Request)) {
+		if v.readOnly {
+			http.Error(w, errVolumeReadOnly.Error(), http.StatusForbidden)
+			return
+		}
+		auth(handler)
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		if r.Method == "GET" && r.URL.Query().Get("watch") != "" {
+			auth(watchEvents)
+			return
+		}
+
+		r.URL.Path = p
+		if r.Method == "GET" && r.URL.Query().Get("hash") != "" {
+			sendHash(w, r)
+		} else {
+			sendFile(w, r)
+		}
+	case "PUT":
+		write(saveFile)
+	case "DELETE":
+		write(deleteFile)
+	case "POST":
+		if r.URL.Query().Has("append") {
+			write(appendFile)
+		} else {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	case "COPY", "MOVE":
+		//目标的token签的也是原来的路径
+		dest := destination(r)
+		to := dest
+		if r.Header.Get(volumeHeader) == "" {
+			tv, rest := volumeOfPath(to)
+			if tv != v {
+				http.Error(w, "Cross Volume Not Support", http.StatusBadRequest)
+				return
+			}
+			to = rest
+		}
+		if to == "" {
+			http.Error(w, "Destination Need", http.StatusBadRequest)
+			return
+		}
+
+		write(func(w http.ResponseWriter, r *http.Request) {
+			if !destAuth(w, r, v.secret, dest) {
+				return
+			}
+
+			if r.Method == "COPY" {
+				serveCopy(w, r, r.URL.Path, to)
+			} else {
+				serveMove(w, r, to)
+			}
+		})
+	case "MKCOL":
+		write(makeDir)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		reqLog(r).Notice("Not Allowed Method")
+	}
+}
+
+// ------ 流协议 ----------------
+
+//指令里的路径在哪个根目录,卷为nil时是默认的根目录
+//连接没选卷时也可以用路径的第一段,但有自己密钥的卷必须连接时选
+func (f *fconn) resolve(name string) (*volume, *filesystem, string) {
+	if f.vol != nil {
+		return f.vol, f.vol.fs, name
+	}
+
+	v, rest := volumeOfPath(name)
+	if v == nil {
+		return nil, fs, name
+	}
+
+	if len(v.keys) > 0 {
+		panic(NoticeError("Volume Need " + volumeHeader + " " + v.name))
+	}
+	return v, v.fs, rest
+}
+
+//改名和复制不能跨卷
+func (f *fconn) resolvePair(name, to string) (*volume, *filesystem, string, string) {
+	v, vfs, name := f.resolve(name)
+	vt, _, to := f.resolve(to)
+	if v != vt {
+		panic(NoticeError("Cross Volume Not Support"))
+	}
+	return v, vfs, name, to
+}
+
+func (f *fconn) writable(v *volume) {
+	f.checkMode()
+	if v != nil && v.readOnly {
+		panic(NoticeError(errVolumeReadOnly.Error()))
+	}
+}
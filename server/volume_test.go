@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseVolumes(t *testing.T) {
+	cases := []struct {
+		conf string
+		names []string
+		err bool
+	}{
+		{"", nil, false},
+		{`{}`, nil, false},
+		{`{"photos": {"dir": "/data/photos"}}`, []string{"photos"}, false},
+		{`{"a": {"dir": "/a", "mode": "0750", "quota": "/:1G"}, "b": {"dir": "/b", "read_only": true}}`, []string{"a", "b"}, false},
+		{`{"a": {"dir": "/a", "keys": {"k": "s"}}}`, []string{"a"}, false},
+		{`{"": {"dir": "/a"}}`, nil, true},
+		{`{".byfs": {"dir": "/a"}}`, nil, true},
+		{`{".": {"dir": "/a"}}`, nil, true},
+		{`{"..": {"dir": "/a"}}`, nil, true},
+		{`{"a/b": {"dir": "/a"}}`, nil, true},
+		{`{"a\\b": {"dir": "/a"}}`, nil, true},
+		{`{"a": {}}`, nil, true},
+		{`{"a": null}`, nil, true},
+		{`{"a": {"dir": "/a", "mode": "999"}}`, nil, true},
+		{`{"a": {"dir": "/a", "quota": "/x"}}`, nil, true},
+		{`[1]`, nil, true},
+	}
+
+	for _, c := range cases {
+		m, err := parseVolumes(c.conf)
+		if (err != nil) != c.err {
+			t.Errorf("%s: err %v", c.conf, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if len(m) != len(c.names) {
+			t.Errorf("%s: got %d volumes", c.conf, len(m))
+		}
+		for _, name := range c.names {
+			if m[name] == nil || m[name].Dir == "" {
+				t.Errorf("%s: volume %s missing", c.conf, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"strings"
+)
+
+const (
+	EVENT_CREATE = "create"
+	EVENT_WRITE = "write"
+	EVENT_REMOVE = "remove"
+	EVENT_RENAME = "rename"
+	//订阅者太慢丢了事件
+	EVENT_OVERFLOW = "overflow"
+)
+
+//每个订阅者最多积压的事件
+const watchQueueLen = 256
+
+type event struct {
+	Op string `json:"op"`
+	Path string `json:"path"`
+	To string `json:"to,omitempty"`
+}
+
+type watcher struct {
+	prefix string
+	C chan event
+	lost bool
+}
+
+func (w *watcher) match(p string) bool {
+	if w.prefix == "/" || p == w.prefix {
+		return true
+	}
+
+	return strings.HasPrefix(p, w.prefix + "/")
+}
+
+//变更通知,所有修改都从filesystem里发出
+type watchHub struct {
+	mu sync.Mutex
+	subs map[*watcher]bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{subs: make(map[*watcher]bool)}
+}
+
+//订阅一个目录前缀
+func (h *watchHub) Subscribe(prefix string) *watcher {
+	w := &watcher{
+		prefix: cleanPath(prefix),
+		C: make(chan event, watchQueueLen),
+	}
+
+	h.mu.Lock()
+	h.subs[w] = true
+	h.mu.Unlock()
+
+	return w
+}
+
+func (h *watchHub) Unsubscribe(w *watcher) {
+	h.mu.Lock()
+	delete(h.subs, w)
+	h.mu.Unlock()
+}
+
+//不会阻塞,订阅者处理不过来就丢掉并发出overflow
+func (h *watchHub) Publish(op, p, to string) {
+	e := event{Op: op, Path: p, To: to}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for w := range h.subs {
+		if !w.match(p) && (to == "" || !w.match(to)) {
+			continue
+		}
+
+		if w.lost {
+			select {
+			case w.C <- event{Op: EVENT_OVERFLOW, Path: w.prefix}:
+				w.lost = false
+			default:
+				continue
+			}
+		}
+
+		select {
+		case w.C <- e:
+		default:
+			w.lost = true
+		}
+	}
+}